@@ -0,0 +1,162 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package root
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	certificates "k8s.io/api/certificates/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	certificatesclient "k8s.io/client-go/kubernetes/typed/certificates/v1beta1"
+	"k8s.io/client-go/util/certificate"
+)
+
+// certificateReloadInterval is the minimum interval at which the certificate files are checked for changes.
+const certificateReloadInterval = 10 * time.Second
+
+// getCertificateFunc is the type of tls.Config.GetCertificate.
+type getCertificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// certificateFiles serves a certificate read from files on disk, which are reloaded when they change, e.g. when the
+// secret they are mounted from is updated.
+type certificateFiles struct {
+	certPath string
+	keyPath  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+func newCertificateFiles(certPath, keyPath string) (*certificateFiles, error) {
+	f := &certificateFiles{certPath: certPath, keyPath: keyPath}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+	return f, nil
+}
+
+// GetCertificate implements getCertificateFunc. The files are checked for changes at most once per
+// certificateReloadInterval. If they cannot be loaded, e.g. because only one of them was updated yet, the previous
+// certificate is served until the next check.
+func (f *certificateFiles) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now := time.Now(); now.Sub(f.checked) >= certificateReloadInterval {
+		f.checked = now
+		f.reload() // nolint:errcheck
+	}
+	return f.cert, nil
+}
+
+// reload loads the certificate if either file was modified since it was last loaded. f.mu must be held, except
+// while f is being created.
+func (f *certificateFiles) reload() error {
+	certInfo, err := os.Stat(f.certPath)
+	if err != nil {
+		return errors.Wrap(err, "error reading tls certificate")
+	}
+	keyInfo, err := os.Stat(f.keyPath)
+	if err != nil {
+		return errors.Wrap(err, "error reading tls key")
+	}
+	if f.cert != nil && certInfo.ModTime().Equal(f.certMod) && keyInfo.ModTime().Equal(f.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certPath, f.keyPath)
+	if err != nil {
+		return errors.Wrap(err, "error loading tls certs")
+	}
+	f.cert = &cert
+	f.certMod = certInfo.ModTime()
+	f.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// newServingCertificateManager returns a certificate manager which requests the serving certificate of the node from
+// the API server, through a certificate signing request, and renews it before it expires.
+//
+// The request is made for the "system:node:<name>" user of the "system:nodes" group, with the node's addresses as
+// subject alternative names, and with the server auth usage: this is what makes it a kubelet serving certificate
+// request. Such requests are not approved automatically by the controller manager, so they must be approved by an
+// administrator or by a dedicated approver. Until the certificate is issued, TLS handshakes fail.
+//
+// The key and the issued certificate are stored in certDir, so that they are reused when the process restarts.
+func newServingCertificateManager(client certificatesclient.CertificateSigningRequestInterface, certDir, nodeName string, addresses []corev1.NodeAddress) (certificate.Manager, error) {
+	if err := os.MkdirAll(certDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "error creating certificate directory")
+	}
+	store, err := certificate.NewFileStore("kubelet-server-"+nodeName, certDir, certDir, "", "")
+	if err != nil {
+		return nil, errors.Wrap(err, "error setting up certificate store")
+	}
+
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   "system:node:" + nodeName,
+			Organization: []string{"system:nodes"},
+		},
+	}
+	for _, addr := range addresses {
+		switch addr.Type {
+		case corev1.NodeHostName, corev1.NodeInternalDNS, corev1.NodeExternalDNS:
+			template.DNSNames = append(template.DNSNames, addr.Address)
+		case corev1.NodeInternalIP, corev1.NodeExternalIP:
+			if ip := net.ParseIP(addr.Address); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			}
+		}
+	}
+
+	m, err := certificate.NewManager(&certificate.Config{
+		ClientFn: func(*tls.Certificate) (certificatesclient.CertificateSigningRequestInterface, error) {
+			return client, nil
+		},
+		Template: template,
+		Usages: []certificates.KeyUsage{
+			certificates.UsageDigitalSignature,
+			certificates.UsageKeyEncipherment,
+			certificates.UsageServerAuth,
+		},
+		CertificateStore: store,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error setting up serving certificate manager")
+	}
+	return m, nil
+}
+
+// managerCertificate returns a getCertificateFunc serving the current certificate of the manager.
+func managerCertificate(m certificate.Manager) getCertificateFunc {
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert := m.Current()
+		if cert == nil {
+			return nil, errors.New("no serving certificate available yet, the certificate signing request may not be approved")
+		}
+		return cert, nil
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package root
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"k8s.io/client-go/util/cert"
+)
+
+func writeTestCertificate(t *testing.T, dir, host string, mod time.Time) (string, string) {
+	certPEM, keyPEM, err := cert.GenerateSelfSignedCertKey(host, nil, nil)
+	assert.NilError(t, err)
+
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+	assert.NilError(t, ioutil.WriteFile(certPath, certPEM, 0600))
+	assert.NilError(t, ioutil.WriteFile(keyPath, keyPEM, 0600))
+	assert.NilError(t, os.Chtimes(certPath, mod, mod))
+	assert.NilError(t, os.Chtimes(keyPath, mod, mod))
+	return certPath, keyPath
+}
+
+func certificateHost(t *testing.T, c *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	assert.NilError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateFilesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vk-certs")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	certPath, keyPath := writeTestCertificate(t, dir, "before", now.Add(-time.Hour))
+	f, err := newCertificateFiles(certPath, keyPath)
+	assert.NilError(t, err)
+
+	c, err := f.GetCertificate(nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(certificateHost(t, c), "before"))
+
+	writeTestCertificate(t, dir, "after", now)
+	c, err = f.GetCertificate(nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(certificateHost(t, c), "before"), "the files must not be checked more than once per interval")
+
+	f.checked = time.Time{}
+	c, err = f.GetCertificate(nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(certificateHost(t, c), "after"))
+
+	// Files which cannot be loaded are ignored until they are fixed.
+	assert.NilError(t, ioutil.WriteFile(keyPath, []byte("invalid"), 0600))
+	assert.NilError(t, os.Chtimes(keyPath, now.Add(time.Hour), now.Add(time.Hour)))
+	f.checked = time.Time{}
+	c, err = f.GetCertificate(nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(certificateHost(t, c), "after"))
+}
+
+func TestNewCertificateFilesMissing(t *testing.T) {
+	_, err := newCertificateFiles("/does/not/exist.crt", "/does/not/exist.key")
+	assert.Check(t, is.ErrorContains(err, "error reading tls certificate"))
+}
@@ -62,10 +62,22 @@ func installFlags(flags *pflag.FlagSet, c *Opts) {
 	flags.StringVar(&c.KubeNamespace, "namespace", c.KubeNamespace, "kubernetes namespace (default is 'all')")
 	flags.StringVar(&c.KubeClusterDomain, "cluster-domain", c.KubeClusterDomain, "kubernetes cluster-domain (default is 'cluster.local')")
 	flags.StringVar(&c.NodeName, "nodename", c.NodeName, "kubernetes node name")
+	flags.StringVar(&c.NodesConfigPath, "nodes-config", c.NodesConfigPath, "JSON file listing the nodes to manage from this process, instead of the single node given by --nodename")
 	flags.StringVar(&c.OperatingSystem, "os", c.OperatingSystem, "Operating System (Linux/Windows)")
 	flags.StringVar(&c.Provider, "provider", c.Provider, "cloud provider")
 	flags.StringVar(&c.ProviderConfigPath, "provider-config", c.ProviderConfigPath, "cloud provider configuration file")
-	flags.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "address to listen for metrics/stats requests")
+	flags.BoolVar(&c.RotateServerCertificates, "rotate-server-certificates", c.RotateServerCertificates, "request the kubelet API serving certificate from the API server through a certificate signing request, and renew it before it expires")
+	flags.StringVar(&c.CertDirectory, "cert-dir", c.CertDirectory, "directory in which the requested serving certificates are stored")
+	flags.StringVar(&c.ClientCAFile, "client-ca-file", c.ClientCAFile, "authenticate kubelet API requests with a client certificate signed by one of the CAs in this file")
+	flags.BoolVar(&c.AuthenticationTokenWebhook, "authentication-token-webhook", c.AuthenticationTokenWebhook, "authenticate kubelet API requests with a bearer token through token reviews")
+	flags.DurationVar(&c.AuthenticationTokenWebhookCacheTTL, "authentication-token-webhook-cache-ttl", c.AuthenticationTokenWebhookCacheTTL, "how long to cache token reviews")
+	flags.BoolVar(&c.AnonymousAuth, "anonymous-auth", c.AnonymousAuth, "let kubelet API requests without credentials through as system:anonymous when authentication or authorization is enabled")
+	flags.StringVar(&c.AuthorizationMode, "authorization-mode", c.AuthorizationMode, fmt.Sprintf("authorization mode of kubelet API requests (%s or %s), %s uses subject access reviews", AuthorizationModeAlwaysAllow, AuthorizationModeWebhook, AuthorizationModeWebhook))
+	flags.DurationVar(&c.AuthorizationWebhookCacheAuthorizedTTL, "authorization-webhook-cache-authorized-ttl", c.AuthorizationWebhookCacheAuthorizedTTL, "how long to cache allowed subject access reviews")
+	flags.DurationVar(&c.AuthorizationWebhookCacheUnauthorizedTTL, "authorization-webhook-cache-unauthorized-ttl", c.AuthorizationWebhookCacheUnauthorizedTTL, "how long to cache denied subject access reviews")
+	flags.StringVar(&c.ExecAuditLogPath, "exec-audit-log", c.ExecAuditLogPath, "file to which the exec and attach sessions are appended as lines of JSON, recording who ran what in which container")
+	flags.BoolVar(&c.ExecAuditTranscripts, "exec-audit-transcripts", c.ExecAuditTranscripts, "record the terminal of the exec and attach sessions which have a tty in the exec audit log")
+	flags.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "address to listen for prometheus metrics (/metrics) and stats (/stats/summary) requests")
 
 	flags.StringVar(&c.TaintKey, "taint", c.TaintKey, "Set node taint key")
 	flags.BoolVar(&c.DisableTaint, "disable-taint", c.DisableTaint, "disable the virtual-kubelet node taint")
@@ -73,6 +85,14 @@ func installFlags(flags *pflag.FlagSet, c *Opts) {
 
 	flags.IntVar(&c.PodSyncWorkers, "pod-sync-workers", c.PodSyncWorkers, `set the number of pod synchronization workers`)
 	flags.BoolVar(&c.EnableNodeLease, "enable-node-lease", c.EnableNodeLease, `use node leases (1.13) for node heartbeats`)
+	flags.BoolVar(&c.EnableLeaderElection, "enable-leader-election", c.EnableLeaderElection, `only manage the node while holding a lease, so that several replicas can run in active/passive mode`)
+	flags.StringVar(&c.LeaderElectionNamespace, "leader-election-namespace", c.LeaderElectionNamespace, `namespace of the lease used for leader election`)
+	flags.BoolVar(&c.EnableGracefulShutdown, "enable-graceful-shutdown", c.EnableGracefulShutdown, `cordon the node and mark it as not ready on exit`)
+	flags.BoolVar(&c.ShutdownEvictPods, "shutdown-evict-pods", c.ShutdownEvictPods, `evict the pods of the node on graceful shutdown, respecting their disruption budgets`)
+	flags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, `how long to wait for the evicted pods to terminate on graceful shutdown`)
+	flags.BoolVar(&c.ShutdownDeleteNode, "shutdown-delete-node", c.ShutdownDeleteNode, `delete the node and its lease on graceful shutdown`)
+	flags.IntVar(&c.CircuitBreakerThreshold, "circuit-breaker-threshold", c.CircuitBreakerThreshold, `number of consecutive failed provider calls after which the node is marked as not ready, zero disables it`)
+	flags.DurationVar(&c.ProviderCallTimeout, "provider-call-timeout", c.ProviderCallTimeout, `maximum duration of the calls made to the provider by the pod controller, 0 means no timeout`)
 
 	flags.StringSliceVar(&c.TraceExporters, "trace-exporter", c.TraceExporters, fmt.Sprintf("sets the tracing exporter to use, available exporters: %s", AvailableTraceExporters()))
 	flags.StringVar(&c.TraceConfig.ServiceName, "trace-service-name", c.TraceConfig.ServiceName, "sets the name of the service used to register with the trace exporter")
@@ -17,6 +17,7 @@ package root
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
@@ -25,9 +26,18 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/virtual-kubelet/virtual-kubelet/cmd/virtual-kubelet/internal/provider"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node"
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/node/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	certificatesclient "k8s.io/client-go/kubernetes/typed/certificates/v1beta1"
+	"k8s.io/client-go/util/cert"
 )
 
 // AcceptedCiphers is the list of accepted TLS ciphers, with known weak ciphers elided
@@ -44,25 +54,71 @@ var AcceptedCiphers = []uint16{
 	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 }
 
-func loadTLSConfig(certPath, keyPath string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-	if err != nil {
-		return nil, errors.Wrap(err, "error loading tls certs")
-	}
-
+func newTLSConfig(getCertificate getCertificateFunc) *tls.Config {
 	return &tls.Config{
-		Certificates:             []tls.Certificate{cert},
+		GetCertificate:           getCertificate,
 		MinVersion:               tls.VersionTLS12,
 		PreferServerCipherSuites: true,
 		CipherSuites:             AcceptedCiphers,
-	}, nil
+	}
 }
 
-func setupHTTPServer(ctx context.Context, p provider.Provider, cfg *apiServerConfig, getPodsFromKubernetes api.PodListerFunc) (_ func(), retErr error) {
+// closerFunc adapts a function to io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// nodeAPI is the kubelet API of one of the nodes managed by the process.
+type nodeAPI struct {
+	name                  string
+	port                  int32
+	addresses             []corev1.NodeAddress
+	p                     provider.Provider
+	getPodsFromKubernetes api.PodListerFunc
+	// instrumented wraps p, so that the calls served by the API are traced and recorded as those of the pod controller.
+	instrumented *node.InstrumentedPodLifecycleHandler
+}
+
+// podMetricsRoutes returns the stats summary routes of the node.
+func (n nodeAPI) podMetricsRoutes() api.PodMetricsConfig {
+	return api.PodMetricsConfig{
+		GetStatsSummary: n.instrumented.StatsSummaryHandler(),
+	}
+}
+
+// nodeRouter routes the requests made to the kubelet API to the node owning the port they were received on.
+type nodeRouter map[int]http.Handler
+
+func (r nodeRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		if h, ok := r[addr.Port]; ok {
+			h.ServeHTTP(w, req)
+			return
+		}
+	}
+	http.NotFound(w, req)
+}
+
+// setupHTTPServer serves the kubelet API of the given nodes, and the metrics of the process.
+//
+// Each node is served on its own port, through a single server which routes requests by port. With multiple nodes,
+// the stats summary of each node is served on its port alongside the other kubelet API routes, rather than on the
+// metrics address. With a single node, the stats summary served on the metrics address is subject to the same
+// authentication and authorization as the kubelet API; since that address is served over plain HTTP, requests can
+// only be authenticated there with a bearer token.
+//
+// The serving certificate of each node is either requested from the API server (see Opts.RotateServerCertificates),
+// or read from the files set through the APISERVER_CERT_LOCATION and APISERVER_KEY_LOCATION environment variables.
+//
+// Requests are authenticated and authorized as done by the kubelet when enabled, see getAPIConfig.
+func setupHTTPServer(ctx context.Context, cfg *apiServerConfig, nodes []nodeAPI) (_ func(), retErr error) {
 	var closers []io.Closer
 	cancel := func() {
-		for _, c := range closers {
-			c.Close()
+		// Close in reverse order, so that e.g. the exec audit log outlives the server writing to it.
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i].Close()
 		}
 	}
 	defer func() {
@@ -71,45 +127,121 @@ func setupHTTPServer(ctx context.Context, p provider.Provider, cfg *apiServerCon
 		}
 	}()
 
-	if cfg.CertPath == "" || cfg.KeyPath == "" {
+	if !cfg.RotateCertificates && (cfg.CertPath == "" || cfg.KeyPath == "") {
 		log.G(ctx).
 			WithField("certPath", cfg.CertPath).
 			WithField("keyPath", cfg.KeyPath).
-			Error("TLS certificates not provided, not setting up pod http server")
+			Error("TLS certificates not provided and certificate rotation not enabled, not setting up pod http server")
 	} else {
-		tlsCfg, err := loadTLSConfig(cfg.CertPath, cfg.KeyPath)
-		if err != nil {
-			return nil, err
+		var files *certificateFiles
+		if !cfg.RotateCertificates {
+			var err error
+			files, err = newCertificateFiles(cfg.CertPath, cfg.KeyPath)
+			if err != nil {
+				return nil, err
+			}
 		}
-		l, err := tls.Listen("tcp", cfg.Addr, tlsCfg)
-		if err != nil {
-			return nil, errors.Wrap(err, "error setting up listener for pod http server")
+
+		var auditSink api.ExecAuditSink
+		if cfg.ExecAuditLogPath != "" {
+			f, err := os.OpenFile(cfg.ExecAuditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				return nil, errors.Wrap(err, "error opening exec audit log")
+			}
+			closers = append(closers, f)
+			auditSink = api.NewJSONExecAuditSink(f)
 		}
 
-		mux := http.NewServeMux()
+		router := make(nodeRouter, len(nodes))
+		listeners := make([]net.Listener, 0, len(nodes))
+		defer func() {
+			if retErr != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+			}
+		}()
+		for _, n := range nodes {
+			var getCertificate getCertificateFunc
+			if files != nil {
+				getCertificate = files.GetCertificate
+			} else {
+				m, err := newServingCertificateManager(cfg.CSRClient, cfg.CertDirectory, n.name, n.addresses)
+				if err != nil {
+					return nil, errors.Wrapf(err, "error setting up serving certificate of node %s", n.name)
+				}
+				m.Start()
+				closers = append(closers, closerFunc(func() error {
+					m.Stop()
+					return nil
+				}))
+				getCertificate = managerCertificate(m)
+			}
 
-		podRoutes := api.PodHandlerConfig{
-			RunInContainer:        p.RunInContainer,
-			GetContainerLogs:      p.GetContainerLogs,
-			GetPodsFromKubernetes: getPodsFromKubernetes,
-			GetPods:               p.GetPods,
-			StreamIdleTimeout:     cfg.StreamIdleTimeout,
-			StreamCreationTimeout: cfg.StreamCreationTimeout,
-		}
+			tlsConfig := newTLSConfig(getCertificate)
+			if cfg.ClientCAs != nil {
+				// Client certificates are verified by the authenticator, so that requests made with a bearer token
+				// or anonymously are still accepted.
+				tlsConfig.ClientAuth = tls.RequestClientCert
+			}
+			l, err := tls.Listen("tcp", fmt.Sprintf(":%d", n.port), tlsConfig)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error setting up listener for pod http server of node %s", n.name)
+			}
+			listeners = append(listeners, l)
+
+			mux := http.NewServeMux()
 
-		api.AttachPodRoutes(podRoutes, mux, true)
+			podRoutes := api.PodHandlerConfig{
+				RunInContainer:        n.instrumented.ContainerExecHandler(),
+				GetContainerLogs:      n.instrumented.ContainerLogsHandler(),
+				GetPodsFromKubernetes: n.getPodsFromKubernetes,
+				GetPods:               n.instrumented.GetPods,
+				StreamIdleTimeout:     cfg.StreamIdleTimeout,
+				StreamCreationTimeout: cfg.StreamCreationTimeout,
+				ExecAuditSink:         auditSink,
+				RecordExecTranscripts: cfg.ExecAuditTranscripts,
+			}
+			if a, ok := n.p.(provider.ContainerAttacher); ok {
+				podRoutes.AttachToContainer = a.AttachToContainer
+			}
+			if pf, ok := n.p.(provider.PortForwarder); ok {
+				podRoutes.PortForward = pf.PortForward
+			}
 
+			api.AttachPodRoutes(podRoutes, mux, true)
+			if len(nodes) > 1 {
+				api.AttachPodMetricsRoutes(n.podMetricsRoutes(), mux)
+			}
+			h, err := cfg.authHandler(mux, n.name)
+			if err != nil {
+				return nil, err
+			}
+			router[int(n.port)] = h
+		}
+
+		var handler http.Handler = router
+		if len(nodes) == 1 {
+			handler = router[int(nodes[0].port)]
+		}
 		s := &http.Server{
-			Handler:   mux,
-			TLSConfig: tlsCfg,
+			Handler: handler,
+		}
+		for _, l := range listeners {
+			go serveHTTP(ctx, s, l, "pods")
 		}
-		go serveHTTP(ctx, s, l, "pods")
 		closers = append(closers, s)
 	}
 
 	if cfg.MetricsAddr == "" {
 		log.G(ctx).Info("Pod metrics server not setup due to empty metrics address")
 	} else {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+		if err := metrics.Register(registry); err != nil {
+			return nil, errors.Wrap(err, "could not register metrics")
+		}
+
 		l, err := net.Listen("tcp", cfg.MetricsAddr)
 		if err != nil {
 			return nil, errors.Wrap(err, "could not setup listener for pod metrics http server")
@@ -117,14 +249,18 @@ func setupHTTPServer(ctx context.Context, p provider.Provider, cfg *apiServerCon
 
 		mux := http.NewServeMux()
 
-		var summaryHandlerFunc api.PodStatsSummaryHandlerFunc
-		if mp, ok := p.(provider.PodMetricsProvider); ok {
-			summaryHandlerFunc = mp.GetStatsSummary
-		}
-		podMetricsRoutes := api.PodMetricsConfig{
-			GetStatsSummary: summaryHandlerFunc,
+		if len(nodes) == 1 {
+			statsMux := http.NewServeMux()
+			api.AttachPodMetricsRoutes(nodes[0].podMetricsRoutes(), statsMux)
+			h, err := cfg.authHandler(statsMux, nodes[0].name)
+			if err != nil {
+				l.Close()
+				return nil, err
+			}
+			mux.Handle("/", h)
 		}
-		api.AttachPodMetricsRoutes(podMetricsRoutes, mux)
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
 		s := &http.Server{
 			Handler: mux,
 		}
@@ -146,25 +282,110 @@ func serveHTTP(ctx context.Context, s *http.Server, l net.Listener, name string)
 	l.Close()
 }
 
+// authHandler wraps the handler of the kubelet API of the given node with api.AuthHandler, if authentication or
+// authorization is enabled.
+func (cfg *apiServerConfig) authHandler(h http.Handler, nodeName string) (http.Handler, error) {
+	if !cfg.EnableAuth {
+		return h, nil
+	}
+	h, err := api.AuthHandler(h, api.AuthConfig{
+		NodeName:       nodeName,
+		Authenticator:  cfg.Authenticator,
+		AllowAnonymous: cfg.AllowAnonymous,
+		Authorizer:     cfg.Authorizer,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error setting up authentication of node %s", nodeName)
+	}
+	return h, nil
+}
+
 type apiServerConfig struct {
 	CertPath              string
 	KeyPath               string
-	Addr                  string
+	RotateCertificates    bool
+	CertDirectory         string
+	CSRClient             certificatesclient.CertificateSigningRequestInterface
 	MetricsAddr           string
 	StreamIdleTimeout     time.Duration
 	StreamCreationTimeout time.Duration
+
+	// EnableAuth wraps the kubelet API of each node with api.AuthHandler.
+	EnableAuth     bool
+	ClientCAs      *x509.CertPool
+	Authenticator  api.Authenticator
+	AllowAnonymous bool
+	Authorizer     api.Authorizer
+
+	ExecAuditLogPath     string
+	ExecAuditTranscripts bool
 }
 
-func getAPIConfig(c Opts) (*apiServerConfig, error) {
+func getAPIConfig(c Opts, client kubernetes.Interface) (*apiServerConfig, error) {
 	config := apiServerConfig{
 		CertPath: os.Getenv("APISERVER_CERT_LOCATION"),
 		KeyPath:  os.Getenv("APISERVER_KEY_LOCATION"),
 	}
 
-	config.Addr = fmt.Sprintf(":%d", c.ListenPort)
+	if c.RotateServerCertificates {
+		config.RotateCertificates = true
+		config.CertDirectory = c.CertDirectory
+		config.CSRClient = client.CertificatesV1beta1().CertificateSigningRequests()
+	}
+
 	config.MetricsAddr = c.MetricsAddr
 	config.StreamIdleTimeout = c.StreamIdleTimeout
 	config.StreamCreationTimeout = c.StreamCreationTimeout
+	config.ExecAuditLogPath = c.ExecAuditLogPath
+	config.ExecAuditTranscripts = c.ExecAuditTranscripts
+
+	if err := setAPIAuthConfig(&config, c, client); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
+
+// setAPIAuthConfig sets up the authentication and authorization of the kubelet API requests from the options.
+// Requests are only checked if client certificates or bearer tokens are authenticated, or if they are authorized
+// through the API server. Otherwise, all the requests are allowed.
+func setAPIAuthConfig(config *apiServerConfig, c Opts, client kubernetes.Interface) error {
+	var authenticators api.UnionAuthenticator
+	if c.ClientCAFile != "" {
+		pool, err := cert.NewPool(c.ClientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "error loading client CA file")
+		}
+		config.ClientCAs = pool
+		authenticators = append(authenticators, api.NewX509Authenticator(pool))
+	}
+	if c.AuthenticationTokenWebhook {
+		authenticators = append(authenticators, api.NewTokenReviewAuthenticator(client.AuthenticationV1().TokenReviews(), c.AuthenticationTokenWebhookCacheTTL))
+	}
+
+	switch c.AuthorizationMode {
+	case AuthorizationModeAlwaysAllow:
+	case AuthorizationModeWebhook:
+		config.Authorizer = api.NewSubjectAccessReviewAuthorizer(
+			client.AuthorizationV1().SubjectAccessReviews(),
+			c.AuthorizationWebhookCacheAuthorizedTTL,
+			c.AuthorizationWebhookCacheUnauthorizedTTL,
+		)
+	default:
+		return errdefs.InvalidInputf("unknown authorization mode %q, must be %s or %s", c.AuthorizationMode, AuthorizationModeAlwaysAllow, AuthorizationModeWebhook)
+	}
+
+	if len(authenticators) == 0 && config.Authorizer == nil {
+		return nil
+	}
+	if len(authenticators) == 0 && !c.AnonymousAuth {
+		// Every request would be rejected as unauthenticated.
+		return errdefs.InvalidInputf("authorization mode %s requires a client CA file, token webhook authentication or anonymous authentication", c.AuthorizationMode)
+	}
+	config.EnableAuth = true
+	config.AllowAnonymous = c.AnonymousAuth
+	if len(authenticators) > 0 {
+		config.Authenticator = authenticators
+	}
+	return nil
+}
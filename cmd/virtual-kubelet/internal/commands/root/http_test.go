@@ -0,0 +1,46 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package root
+
+import (
+	"testing"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSetAPIAuthConfig(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	var config apiServerConfig
+	assert.NilError(t, setAPIAuthConfig(&config, Opts{AuthorizationMode: AuthorizationModeAlwaysAllow}, client))
+	assert.Check(t, !config.EnableAuth)
+
+	// Without any way to authenticate requests, the webhook authorizer would reject all of them.
+	config = apiServerConfig{}
+	err := setAPIAuthConfig(&config, Opts{AuthorizationMode: AuthorizationModeWebhook}, client)
+	assert.Check(t, errdefs.IsInvalidInput(err), err)
+
+	config = apiServerConfig{}
+	assert.NilError(t, setAPIAuthConfig(&config, Opts{AuthorizationMode: AuthorizationModeWebhook, AnonymousAuth: true}, client))
+	assert.Check(t, config.EnableAuth)
+	assert.Check(t, config.AllowAnonymous)
+
+	config = apiServerConfig{}
+	assert.NilError(t, setAPIAuthConfig(&config, Opts{AuthorizationMode: AuthorizationModeWebhook, AuthenticationTokenWebhook: true}, client))
+	assert.Check(t, config.EnableAuth)
+	assert.Check(t, config.Authenticator != nil)
+}
@@ -0,0 +1,366 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package root
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/cmd/virtual-kubelet/internal/provider"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/internal/manager"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node"
+	coordv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+)
+
+// NodesConfig is the format of the file passed to --nodes-config, which lists the nodes managed by a single
+// virtual-kubelet process.
+type NodesConfig struct {
+	Nodes []NodeConfig `json:"nodes"`
+}
+
+// NodeConfig is the configuration of one of the nodes listed in the nodes config file.
+type NodeConfig struct {
+	// Name is the name of the node.
+	Name string `json:"name"`
+	// ProviderConfigPath is the path to the provider configuration of the node.
+	// If unset, the path passed to --provider-config is used.
+	ProviderConfigPath string `json:"providerConfig,omitempty"`
+	// ListenPort is the port on which the kubelet API of the node is served, which is reported in the node's daemon
+	// endpoints. Requests are routed to the node they are received for by port, so each node must have its own.
+	// If unset, the port passed to --port is used for the first node, incremented by one for each following node.
+	ListenPort int32 `json:"port,omitempty"`
+}
+
+// loadNodeConfigs returns the configuration of the nodes to manage: those listed in the nodes config file if one is
+// set, or the single node configured by the command line flags otherwise.
+func loadNodeConfigs(c Opts) ([]NodeConfig, error) {
+	if c.NodesConfigPath == "" {
+		return []NodeConfig{{Name: c.NodeName, ProviderConfigPath: c.ProviderConfigPath, ListenPort: c.ListenPort}}, nil
+	}
+
+	data, err := ioutil.ReadFile(c.NodesConfigPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading nodes config")
+	}
+	var cfg NodesConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errdefs.AsInvalidInput(errors.Wrap(err, "error parsing nodes config"))
+	}
+	return setNodeConfigDefaults(c, cfg.Nodes)
+}
+
+// setNodeConfigDefaults sets the defaults of the given node configs, and validates them.
+func setNodeConfigDefaults(c Opts, nodes []NodeConfig) ([]NodeConfig, error) {
+	if len(nodes) == 0 {
+		return nil, errdefs.InvalidInput("nodes config does not list any node")
+	}
+
+	names := make(map[string]bool, len(nodes))
+	ports := make(map[int32]string, len(nodes))
+	for i := range nodes {
+		n := &nodes[i]
+		if n.Name == "" {
+			return nil, errdefs.InvalidInputf("node %d in nodes config has no name", i)
+		}
+		if names[n.Name] {
+			return nil, errdefs.InvalidInputf("node %q is listed more than once in nodes config", n.Name)
+		}
+		names[n.Name] = true
+
+		if n.ProviderConfigPath == "" {
+			n.ProviderConfigPath = c.ProviderConfigPath
+		}
+		if n.ListenPort == 0 {
+			n.ListenPort = c.ListenPort + int32(i)
+		}
+		if other, ok := ports[n.ListenPort]; ok {
+			return nil, errdefs.InvalidInputf("nodes %q and %q cannot both listen on port %d", other, n.Name, n.ListenPort)
+		}
+		ports[n.ListenPort] = n.Name
+	}
+	return nodes, nil
+}
+
+// virtualNode is one of the nodes managed by the process, with its own provider, controllers and pod informer.
+type virtualNode struct {
+	name     string
+	port     int32
+	client   kubernetes.Interface
+	p        provider.Provider
+	rm       *manager.ResourceManager
+	informer kubeinformers.SharedInformerFactory
+	runner   *node.NodeController
+	pc       *node.PodController
+	breaker  *node.CircuitBreaker
+}
+
+// newVirtualNode sets up the given node. The secrets, configmaps and services informers of scmInformerFactory are
+// shared by all the nodes, while each node has its own pod informer, which only watches the pods scheduled to it.
+// Both must be started before running the node.
+func newVirtualNode(ctx context.Context, c Opts, cfg NodeConfig, identity string, s *provider.Store, client kubernetes.Interface, scmInformerFactory kubeinformers.SharedInformerFactory, eb record.EventBroadcaster, taint *corev1.Taint) (*virtualNode, error) {
+	// Create a shared informer factory for Kubernetes pods in the current namespace (if specified) and scheduled to the current node.
+	podInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(
+		client,
+		c.InformerResyncPeriod,
+		kubeinformers.WithNamespace(c.KubeNamespace),
+		kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", cfg.Name).String()
+		}))
+	podInformer := podInformerFactory.Core().V1().Pods()
+
+	secretInformer := scmInformerFactory.Core().V1().Secrets()
+	configMapInformer := scmInformerFactory.Core().V1().ConfigMaps()
+	serviceInformer := scmInformerFactory.Core().V1().Services()
+
+	rm, err := manager.NewResourceManager(podInformer.Lister(), secretInformer.Lister(), configMapInformer.Lister(), serviceInformer.Lister())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create resource manager")
+	}
+
+	p, err := s.NewProvider(c.Provider, provider.InitConfig{
+		ConfigPath:        cfg.ProviderConfigPath,
+		NodeName:          cfg.Name,
+		OperatingSystem:   c.OperatingSystem,
+		ResourceManager:   rm,
+		DaemonPort:        cfg.ListenPort,
+		InternalIP:        os.Getenv("VKUBELET_POD_IP"),
+		KubeClusterDomain: c.KubeClusterDomain,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The lease API version (v1 or v1beta1) is discovered when the node controller runs.
+	var leaseClient kubernetes.Interface
+	if c.EnableNodeLease {
+		leaseClient = client
+	}
+
+	pNode := NodeFromProvider(ctx, cfg.Name, taint, p, c.Version)
+
+	var (
+		nodeProvider node.NodeProvider = node.NaiveNodeProvider{}
+		breaker      *node.CircuitBreaker
+		nodeRunner   *node.NodeController
+	)
+	// Providers which implement NodeProvider report the health and status of the node themselves.
+	if np, ok := p.(node.NodeProvider); ok {
+		nodeProvider = np
+	}
+	if c.CircuitBreakerThreshold > 0 {
+		breaker, err = node.NewCircuitBreaker(node.CircuitBreakerConfig{
+			PodProvider:      p,
+			NodeProvider:     nodeProvider,
+			GetNode:          func() *corev1.Node { return nodeRunner.Node() },
+			FailureThreshold: c.CircuitBreakerThreshold,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "error setting up circuit breaker")
+		}
+		nodeProvider = breaker
+	}
+
+	nodeRunner, err = node.NewNodeController(
+		nodeProvider,
+		pNode,
+		client.CoreV1().Nodes(),
+		// The node lease is held on behalf of this process rather than of the node, so that a second process managing
+		// the same node by mistake waits for it to be released instead of renewing it too (see virtualNode.run).
+		node.WithNodeEnableLease(leaseClient, &coordv1.Lease{Spec: coordv1.LeaseSpec{HolderIdentity: &identity}}),
+		node.WithNodeStatusUpdateErrorHandler(func(ctx context.Context, err error) error {
+			if !k8serrors.IsNotFound(err) {
+				return err
+			}
+
+			log.G(ctx).Debug("node not found")
+			newNode := pNode.DeepCopy()
+			newNode.ResourceVersion = ""
+			_, err = client.CoreV1().Nodes().Create(newNode)
+			if err != nil {
+				return err
+			}
+			log.G(ctx).Debug("created new node")
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "error setting up node controller")
+	}
+
+	pc, err := node.NewPodController(node.PodControllerConfig{
+		PodClient:           client.CoreV1(),
+		PodInformer:         podInformer,
+		EventRecorder:       eb.NewRecorder(scheme.Scheme, corev1.EventSource{Component: path.Join(pNode.Name, "pod-controller")}),
+		Provider:            p,
+		SecretInformer:      secretInformer,
+		ConfigMapInformer:   configMapInformer,
+		ServiceInformer:     serviceInformer,
+		GetNode:             nodeRunner.Node,
+		NodeName:            cfg.Name,
+		CircuitBreaker:      breaker,
+		ProviderCallTimeout: c.ProviderCallTimeout,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error setting up pod controller")
+	}
+
+	return &virtualNode{
+		name:     cfg.Name,
+		port:     cfg.ListenPort,
+		client:   client,
+		p:        p,
+		rm:       rm,
+		informer: podInformerFactory,
+		runner:   nodeRunner,
+		pc:       pc,
+		breaker:  breaker,
+	}, nil
+}
+
+// run runs the controllers of the node, and waits for them to stop.
+//
+// The pod controller is only started once the node controller holds the node lease, so that a second process managing
+// the same node does not sync its pods until the lease is released.
+//
+// The controllers are stopped right away when the context is cancelled, such as when the leadership is lost. When the
+// shutdown channel is closed instead, the node is shut down gracefully first: it is drained while the controllers are
+// still running, and the pod controller is stopped once it has processed the items left in its work queues. The node
+// controller is stopped last, releasing the node lease, and the node is then marked as not ready (and optionally
+// deleted), so that the node controller does not override the status.
+func (n *virtualNode) run(ctx context.Context, shutdown <-chan struct{}, c Opts) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	nodeCtx, stopNode := context.WithCancel(ctx)
+	defer stopNode()
+
+	if n.breaker != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.breaker.Run(ctx)
+		}()
+	}
+
+	nodeDone := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(nodeDone)
+		if err := n.runner.Run(nodeCtx); err != nil {
+			log.G(ctx).Fatal(err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-shutdown:
+		// The node was never registered by this process, e.g. because its lease is held by another process.
+		return nil
+	case <-n.runner.Ready():
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := n.pc.Run(ctx, c.PodSyncWorkers); err != nil && errors.Cause(err) != context.Canceled {
+			log.G(ctx).Fatal(err)
+		}
+	}()
+
+	if c.StartupTimeout > 0 {
+		ctx, cancel := context.WithTimeout(ctx, c.StartupTimeout)
+		log.G(ctx).Info("Waiting for pod controller / VK to be ready")
+		select {
+		case <-ctx.Done():
+			cancel()
+			return ctx.Err()
+		case <-shutdown:
+			cancel()
+			return nil
+		case <-n.pc.Ready():
+		}
+		cancel()
+		if err := n.pc.Err(); err != nil {
+			return err
+		}
+	}
+
+	log.G(ctx).Info("Initialized")
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-shutdown:
+	}
+
+	log.G(ctx).Info("Shutting down node")
+	err := node.DrainNode(ctx, node.DrainConfig{
+		Client:    n.client,
+		NodeName:  n.name,
+		Namespace: c.KubeNamespace,
+		EvictPods: c.ShutdownEvictPods,
+		Timeout:   c.ShutdownTimeout,
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).Error("Error draining node")
+	}
+
+	n.pc.Shutdown()
+	select {
+	case <-n.pc.Done():
+	case <-ctx.Done():
+		return nil
+	}
+
+	stopNode()
+	<-nodeDone
+	if err := n.runner.Shutdown(ctx, c.ShutdownDeleteNode); err != nil {
+		log.G(ctx).WithError(err).Error("Error shutting down node")
+	}
+	return nil
+}
+
+// api returns the kubelet API of the node.
+func (n *virtualNode) api() nodeAPI {
+	return nodeAPI{
+		name:      n.name,
+		port:      n.port,
+		addresses: n.runner.Node().Status.Addresses,
+		p:         n.p,
+		getPodsFromKubernetes: func(context.Context) ([]*corev1.Pod, error) {
+			return n.rm.GetPods(), nil
+		},
+		// The API is not subject to the circuit breaker, which only guards the calls made by the pod controller.
+		instrumented: node.InstrumentPodLifecycleHandler(n.p, node.WithNodeName(n.name)),
+	}
+}
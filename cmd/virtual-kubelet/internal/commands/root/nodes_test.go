@@ -0,0 +1,88 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package root
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSetNodeConfigDefaults(t *testing.T) {
+	c := Opts{ProviderConfigPath: "/etc/vk/provider.json", ListenPort: 10250}
+
+	nodes, err := setNodeConfigDefaults(c, []NodeConfig{
+		{Name: "vk-0"},
+		{Name: "vk-1", ProviderConfigPath: "/etc/vk/vk-1.json"},
+		{Name: "vk-2", ListenPort: 11000},
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(nodes, []NodeConfig{
+		{Name: "vk-0", ProviderConfigPath: "/etc/vk/provider.json", ListenPort: 10250},
+		{Name: "vk-1", ProviderConfigPath: "/etc/vk/vk-1.json", ListenPort: 10251},
+		{Name: "vk-2", ProviderConfigPath: "/etc/vk/provider.json", ListenPort: 11000},
+	}))
+
+	for _, tc := range []struct {
+		name  string
+		nodes []NodeConfig
+		err   string
+	}{
+		{name: "empty", err: "does not list any node"},
+		{name: "no name", nodes: []NodeConfig{{}}, err: "has no name"},
+		{name: "duplicate name", nodes: []NodeConfig{{Name: "vk-0"}, {Name: "vk-0"}}, err: "more than once"},
+		{name: "duplicate port", nodes: []NodeConfig{{Name: "vk-0"}, {Name: "vk-1", ListenPort: 10250}}, err: "port 10250"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := setNodeConfigDefaults(c, tc.nodes)
+			assert.Check(t, is.ErrorContains(err, tc.err))
+			assert.Check(t, errdefs.IsInvalidInput(err))
+		})
+	}
+}
+
+func TestNodeRouter(t *testing.T) {
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Write([]byte(name)) // nolint:errcheck
+		})
+	}
+	router := nodeRouter{10250: handler("vk-0"), 10251: handler("vk-1")}
+
+	for _, tc := range []struct {
+		port   int
+		status int
+		body   string
+	}{
+		{port: 10250, status: http.StatusOK, body: "vk-0"},
+		{port: 10251, status: http.StatusOK, body: "vk-1"},
+		{port: 10252, status: http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/pods", nil)
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{Port: tc.port}))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Check(t, is.Equal(w.Code, tc.status), "port %d", tc.port)
+		if tc.body != "" {
+			assert.Check(t, is.Equal(w.Body.String(), tc.body), "port %d", tc.port)
+		}
+	}
+}
@@ -22,6 +22,8 @@ import (
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/node"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -40,6 +42,11 @@ const (
 	DefaultTaintKey              = "virtual-kubelet.io/provider"
 	DefaultStreamIdleTimeout     = 30 * time.Second
 	DefaultStreamCreationTimeout = 30 * time.Second
+	DefaultCertDirectory         = "/var/lib/virtual-kubelet/pki"
+
+	AuthorizationModeAlwaysAllow = "AlwaysAllow"
+	AuthorizationModeWebhook     = "Webhook"
+	DefaultAuthorizationMode     = AuthorizationModeAlwaysAllow
 )
 
 // Opts stores all the options for configuring the root virtual-kubelet command.
@@ -61,6 +68,10 @@ type Opts struct {
 	// Node name to use when creating a node in Kubernetes
 	NodeName string
 
+	// Path to a file listing the nodes to manage, overriding NodeName.
+	// See NodesConfig for the format of the file.
+	NodesConfigPath string
+
 	// Operating system to run pods for
 	OperatingSystem string
 
@@ -80,6 +91,31 @@ type Opts struct {
 	// Use node leases when supported by Kubernetes (instead of node status updates)
 	EnableNodeLease bool
 
+	// Only run the pod and node controllers while holding a lease, so that several replicas can manage the same node
+	// in active/passive mode. When multiple nodes are managed, a single lease named after NodeName covers all of them.
+	EnableLeaderElection bool
+	// Namespace of the lease used for leader election.
+	LeaderElectionNamespace string
+
+	// Number of consecutive failed provider calls after which the node is reported as not ready and pods stop being
+	// synced to the provider, until it responds to pings and lists its pods again. Zero, the default, disables the
+	// circuit breaker.
+	CircuitBreakerThreshold int
+
+	// Maximum duration of the calls made to the provider by the pod controller, other than streaming ones such as exec
+	// and logs. Zero means no timeout.
+	ProviderCallTimeout time.Duration
+
+	// Shut the nodes down gracefully on exit: cordon them, evict their pods if ShutdownEvictPods is set, and mark them
+	// as not ready, before stopping the controllers.
+	EnableGracefulShutdown bool
+	// Evict the pods of the nodes on shutdown, respecting their disruption budgets.
+	ShutdownEvictPods bool
+	// ShutdownTimeout is how long to wait for the evicted pods to be terminated by the provider on shutdown.
+	ShutdownTimeout time.Duration
+	// Delete the nodes and their leases on shutdown.
+	ShutdownDeleteNode bool
+
 	TraceExporters  []string
 	TraceSampleRate string
 	TraceConfig     TracingExporterOptions
@@ -92,6 +128,33 @@ type Opts struct {
 	// StreamCreationTimeout is the maximum time for streaming connection
 	StreamCreationTimeout time.Duration
 
+	// Request the serving certificate of the kubelet API from the API server, instead of reading it from the files
+	// set through APISERVER_CERT_LOCATION and APISERVER_KEY_LOCATION, and renew it before it expires.
+	RotateServerCertificates bool
+	// Directory in which the requested serving certificates and their keys are stored.
+	CertDirectory string
+
+	// Path to a file of CA certificates used to authenticate the client certificates of the kubelet API requests.
+	ClientCAFile string
+	// Authenticate the bearer tokens of the kubelet API requests through token reviews.
+	AuthenticationTokenWebhook bool
+	// How long the token reviews are cached.
+	AuthenticationTokenWebhookCacheTTL time.Duration
+	// Let the kubelet API requests which carry no credentials through as the "system:anonymous" user, when
+	// authentication or authorization is enabled.
+	AnonymousAuth bool
+	// Authorization mode of the kubelet API requests, either AlwaysAllow or Webhook. Webhook authorizes requests
+	// through subject access reviews.
+	AuthorizationMode string
+	// How long the allowed and denied subject access reviews are cached.
+	AuthorizationWebhookCacheAuthorizedTTL   time.Duration
+	AuthorizationWebhookCacheUnauthorizedTTL time.Duration
+
+	// Path to a file to which the exec and attach sessions of the kubelet API are appended, as lines of JSON.
+	ExecAuditLogPath string
+	// Record the terminal of the exec and attach sessions which have a TTY in the audit log.
+	ExecAuditTranscripts bool
+
 	Version string
 }
 
@@ -118,6 +181,14 @@ func SetDefaultOpts(c *Opts) error {
 		c.PodSyncWorkers = DefaultPodSyncWorkers
 	}
 
+	if c.LeaderElectionNamespace == "" {
+		c.LeaderElectionNamespace = corev1.NamespaceNodeLease
+	}
+
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = node.DefaultDrainTimeout
+	}
+
 	if c.TraceConfig.ServiceName == "" {
 		c.TraceConfig.ServiceName = DefaultNodeName
 	}
@@ -163,9 +234,29 @@ func SetDefaultOpts(c *Opts) error {
 		c.StreamIdleTimeout = DefaultStreamIdleTimeout
 	}
 
+	if c.CertDirectory == "" {
+		c.CertDirectory = DefaultCertDirectory
+	}
+
 	if c.StreamCreationTimeout == 0 {
 		c.StreamCreationTimeout = DefaultStreamCreationTimeout
 	}
 
+	if c.AuthenticationTokenWebhookCacheTTL == 0 {
+		c.AuthenticationTokenWebhookCacheTTL = api.DefaultTokenReviewCacheTTL
+	}
+
+	if c.AuthorizationMode == "" {
+		c.AuthorizationMode = DefaultAuthorizationMode
+	}
+
+	if c.AuthorizationWebhookCacheAuthorizedTTL == 0 {
+		c.AuthorizationWebhookCacheAuthorizedTTL = api.DefaultSubjectAccessReviewAllowedTTL
+	}
+
+	if c.AuthorizationWebhookCacheUnauthorizedTTL == 0 {
+		c.AuthorizationWebhookCacheUnauthorizedTTL = api.DefaultSubjectAccessReviewDeniedTTL
+	}
+
 	return nil
 }
@@ -17,23 +17,18 @@ package root
 import (
 	"context"
 	"os"
-	"path"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/virtual-kubelet/virtual-kubelet/cmd/virtual-kubelet/internal/provider"
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
-	"github.com/virtual-kubelet/virtual-kubelet/internal/manager"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	"github.com/virtual-kubelet/virtual-kubelet/node"
+	"github.com/virtual-kubelet/virtual-kubelet/node/metrics"
 	corev1 "k8s.io/api/core/v1"
-	k8serrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/uuid"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -59,8 +54,18 @@ This allows users to schedule kubernetes workloads on nodes that aren't running
 }
 
 func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
-	ctx, cancel := context.WithCancel(ctx)
+	// The nodes are shut down once the passed in context is cancelled. With graceful shutdown, the informers,
+	// controllers and API server keep running in the meantime, so they are only stopped once the nodes are shut down.
+	shutdown := ctx.Done()
+	ctx, cancel := context.WithCancel(log.WithLogger(context.Background(), log.G(ctx)))
 	defer cancel()
+	if !c.EnableGracefulShutdown {
+		go func() {
+			<-shutdown
+			cancel()
+		}()
+		shutdown = nil
+	}
 
 	if ok := provider.ValidOperatingSystems[c.OperatingSystem]; !ok {
 		return errdefs.InvalidInputf("operating system %q is not supported", c.OperatingSystem)
@@ -70,6 +75,10 @@ func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
 		return errdefs.InvalidInput("pod sync workers must be greater than 0")
 	}
 
+	if !s.Exists(c.Provider) {
+		return errdefs.NotFoundf("provider %q not found", c.Provider)
+	}
+
 	var taint *corev1.Taint
 	if !c.DisableTaint {
 		var err error
@@ -84,29 +93,16 @@ func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
 		return err
 	}
 
-	// Create a shared informer factory for Kubernetes pods in the current namespace (if specified) and scheduled to the current node.
-	podInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(
-		client,
-		c.InformerResyncPeriod,
-		kubeinformers.WithNamespace(c.KubeNamespace),
-		kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
-			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", c.NodeName).String()
-		}))
-	podInformer := podInformerFactory.Core().V1().Pods()
-
-	// Create another shared informer factory for Kubernetes secrets and configmaps (not subject to any selectors).
-	scmInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(client, c.InformerResyncPeriod)
-	// Create a secret informer and a config map informer so we can pass their listers to the resource manager.
-	secretInformer := scmInformerFactory.Core().V1().Secrets()
-	configMapInformer := scmInformerFactory.Core().V1().ConfigMaps()
-	serviceInformer := scmInformerFactory.Core().V1().Services()
-
-	rm, err := manager.NewResourceManager(podInformer.Lister(), secretInformer.Lister(), configMapInformer.Lister(), serviceInformer.Lister())
+	nodeConfigs, err := loadNodeConfigs(c)
 	if err != nil {
-		return errors.Wrap(err, "could not create resource manager")
+		return err
 	}
 
-	apiConfig, err := getAPIConfig(c)
+	// Create a shared informer factory for Kubernetes secrets and configmaps (not subject to any selectors).
+	// It is shared by all the nodes managed by the process.
+	scmInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(client, c.InformerResyncPeriod)
+
+	apiConfig, err := getAPIConfig(c, client)
 	if err != nil {
 		return err
 	}
@@ -115,123 +111,119 @@ func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
 		return err
 	}
 
-	initConfig := provider.InitConfig{
-		ConfigPath:        c.ProviderConfigPath,
-		NodeName:          c.NodeName,
-		OperatingSystem:   c.OperatingSystem,
-		ResourceManager:   rm,
-		DaemonPort:        int32(c.ListenPort),
-		InternalIP:        os.Getenv("VKUBELET_POD_IP"),
-		KubeClusterDomain: c.KubeClusterDomain,
-	}
-
-	pInit := s.Get(c.Provider)
-	if pInit == nil {
-		return errors.Errorf("provider %q not found", c.Provider)
-	}
-
-	p, err := pInit(initConfig)
-	if err != nil {
-		return errors.Wrapf(err, "error initializing provider %s", c.Provider)
-	}
-
 	ctx = log.WithLogger(ctx, log.G(ctx).WithFields(log.Fields{
 		"provider":         c.Provider,
 		"operatingSystem":  c.OperatingSystem,
-		"node":             c.NodeName,
 		"watchedNamespace": c.KubeNamespace,
 	}))
 
-	var leaseClient v1beta1.LeaseInterface
-	if c.EnableNodeLease {
-		leaseClient = client.CoordinationV1beta1().Leases(corev1.NamespaceNodeLease)
-	}
-
-	pNode := NodeFromProvider(ctx, c.NodeName, taint, p, c.Version)
-	nodeRunner, err := node.NewNodeController(
-		node.NaiveNodeProvider{},
-		pNode,
-		client.CoreV1().Nodes(),
-		node.WithNodeEnableLeaseV1Beta1(leaseClient, nil),
-		node.WithNodeStatusUpdateErrorHandler(func(ctx context.Context, err error) error {
-			if !k8serrors.IsNotFound(err) {
-				return err
-			}
-
-			log.G(ctx).Debug("node not found")
-			newNode := pNode.DeepCopy()
-			newNode.ResourceVersion = ""
-			_, err = client.CoreV1().Nodes().Create(newNode)
-			if err != nil {
-				return err
-			}
-			log.G(ctx).Debug("created new node")
-			return nil
-		}),
-	)
-	if err != nil {
-		log.G(ctx).Fatal(err)
-	}
-
 	eb := record.NewBroadcaster()
 	eb.StartLogging(log.G(ctx).Infof)
 	eb.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: client.CoreV1().Events(c.KubeNamespace)})
 
-	pc, err := node.NewPodController(node.PodControllerConfig{
-		PodClient:         client.CoreV1(),
-		PodInformer:       podInformer,
-		EventRecorder:     eb.NewRecorder(scheme.Scheme, corev1.EventSource{Component: path.Join(pNode.Name, "pod-controller")}),
-		Provider:          p,
-		SecretInformer:    secretInformer,
-		ConfigMapInformer: configMapInformer,
-		ServiceInformer:   serviceInformer,
-	})
+	// The work queue metrics must be set up before the pod controllers create their queues.
+	metrics.RegisterWorkqueueMetrics()
+
+	identity, err := processIdentity()
 	if err != nil {
-		return errors.Wrap(err, "error setting up pod controller")
+		return err
+	}
+
+	nodes := make([]*virtualNode, 0, len(nodeConfigs))
+	apis := make([]nodeAPI, 0, len(nodeConfigs))
+	for _, cfg := range nodeConfigs {
+		ctx := log.WithLogger(ctx, log.G(ctx).WithField("node", cfg.Name))
+		n, err := newVirtualNode(ctx, c, cfg, identity, s, client, scmInformerFactory, eb, taint)
+		if err != nil {
+			return errors.Wrapf(err, "error setting up node %s", cfg.Name)
+		}
+		nodes = append(nodes, n)
+		apis = append(apis, n.api())
 	}
 
-	go podInformerFactory.Start(ctx.Done())
+	// The informers are started regardless of leader election, so that standbys are ready to take over.
 	go scmInformerFactory.Start(ctx.Done())
+	for _, n := range nodes {
+		go n.informer.Start(ctx.Done())
+	}
 
-	cancelHTTP, err := setupHTTPServer(ctx, p, apiConfig, func(context.Context) ([]*corev1.Pod, error) {
-		return rm.GetPods(), nil
-	})
+	cancelHTTP, err := setupHTTPServer(ctx, apiConfig, apis)
 	if err != nil {
 		return err
 	}
 	defer cancelHTTP()
 
-	go func() {
-		if err := pc.Run(ctx, c.PodSyncWorkers); err != nil && errors.Cause(err) != context.Canceled {
-			log.G(ctx).Fatal(err)
+	// runControllers runs the controllers of all the nodes until the context is cancelled, and waits for them to stop.
+	// If any node fails to start, the other nodes are stopped.
+	runControllers := func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		errs := make(chan error, len(nodes))
+		for _, n := range nodes {
+			go func(n *virtualNode) {
+				errs <- n.run(log.WithLogger(ctx, log.G(ctx).WithField("node", n.name)), shutdown, c)
+			}(n)
 		}
-	}()
 
-	if c.StartupTimeout > 0 {
-		ctx, cancel := context.WithTimeout(ctx, c.StartupTimeout)
-		log.G(ctx).Info("Waiting for pod controller / VK to be ready")
-		select {
-		case <-ctx.Done():
-			cancel()
-			return ctx.Err()
-		case <-pc.Ready():
-		}
-		cancel()
-		if err := pc.Err(); err != nil {
-			return err
+		var retErr error
+		for range nodes {
+			if err := <-errs; err != nil && retErr == nil {
+				retErr = err
+				cancel()
+			}
 		}
+		return retErr
 	}
 
-	go func() {
-		if err := nodeRunner.Run(ctx); err != nil {
-			log.G(ctx).Fatal(err)
-		}
-	}()
+	if !c.EnableLeaderElection {
+		return runControllers(ctx)
+	}
 
-	log.G(ctx).Info("Initialized")
+	leading := make(chan struct{})
+	if shutdown != nil {
+		// Standbys have no nodes to shut down, so they exit right away.
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-shutdown:
+				select {
+				case <-leading:
+				default:
+					cancel()
+				}
+			}
+		}()
+	}
+
+	var runErr error
+	err = node.RunWithLeaderElection(ctx, node.LeaderElectionConfig{
+		Client:    client.CoordinationV1(),
+		Namespace: c.LeaderElectionNamespace,
+		Name:      "virtual-kubelet-" + c.NodeName,
+		Identity:  identity,
+	}, func(ctx context.Context) {
+		close(leading)
+		runErr = runControllers(ctx)
+		// Unless the leadership was lost, the nodes were shut down or failed: step down.
+		if ctx.Err() == nil {
+			cancel()
+		}
+	})
+	if runErr != nil {
+		return runErr
+	}
+	return err
+}
 
-	<-ctx.Done()
-	return nil
+// processIdentity returns an identity which is unique to this process, made of the hostname and a random suffix. It
+// is used as the leader election identity and as the holder of the node leases.
+func processIdentity() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", errors.Wrap(err, "error getting hostname for the process identity")
+	}
+	return hostname + "_" + string(uuid.NewUUID()), nil
 }
 
 func newClient(configPath string) (*kubernetes.Clientset, error) {
@@ -8,10 +8,12 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node"
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
 	v1 "k8s.io/api/core/v1"
@@ -41,6 +43,8 @@ var (
 )
 */
 
+var _ node.NodeProvider = (*MockProvider)(nil)
+
 // MockProvider implements the virtual-kubelet provider interface and stores pods in memory.
 type MockProvider struct { // nolint:golint
 	nodeName           string
@@ -51,6 +55,12 @@ type MockProvider struct { // nolint:golint
 	config             MockConfig
 	startTime          time.Time
 	notifier           func(*v1.Pod)
+
+	// nodeMu protects the node as configured by ConfigureNode and its conditions, which change over time according
+	// to the configured NodeConditionChanges.
+	nodeMu     sync.Mutex
+	node       *v1.Node
+	conditions []v1.NodeCondition
 }
 
 // MockConfig contains a mock virtual-kubelet's configurable parameters.
@@ -58,6 +68,40 @@ type MockConfig struct { //nolint:golint
 	CPU    string `json:"cpu,omitempty"`
 	Memory string `json:"memory,omitempty"`
 	Pods   string `json:"pods,omitempty"`
+
+	// NodeConditionChanges are changes of the node's conditions, which are reported through NotifyNodeStatus.
+	NodeConditionChanges []NodeConditionChange `json:"nodeConditionChanges,omitempty"`
+}
+
+// NodeConditionChange is a change of one of the node's conditions, which is applied once a given time has elapsed
+// since the node controller started.
+type NodeConditionChange struct {
+	// After is the time after which the change is applied, as a duration string such as "30s".
+	After   string               `json:"after"`
+	Type    v1.NodeConditionType `json:"type"`
+	Status  v1.ConditionStatus   `json:"status"`
+	Reason  string               `json:"reason,omitempty"`
+	Message string               `json:"message,omitempty"`
+}
+
+// validate checks that the change can be applied.
+func (c NodeConditionChange) validate() error {
+	after, err := time.ParseDuration(c.After)
+	if err != nil {
+		return fmt.Errorf("Invalid node condition change delay %q: %v", c.After, err)
+	}
+	if after < 0 {
+		return fmt.Errorf("Invalid node condition change delay %q: cannot be negative", c.After)
+	}
+	if c.Type == "" {
+		return fmt.Errorf("Missing node condition type")
+	}
+	switch c.Status {
+	case v1.ConditionTrue, v1.ConditionFalse, v1.ConditionUnknown:
+	default:
+		return fmt.Errorf("Invalid node condition status %q", c.Status)
+	}
+	return nil
 }
 
 // NewMockProviderMockConfig creates a new MockV0Provider. Mock legacy provider does not implement the new asynchronous podnotifier interface
@@ -72,6 +116,11 @@ func NewMockProviderMockConfig(config MockConfig, nodeName, operatingSystem stri
 	if config.Pods == "" {
 		config.Pods = defaultPodCapacity
 	}
+	for _, c := range config.NodeConditionChanges {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+	}
 	provider := MockProvider{
 		nodeName:           nodeName,
 		operatingSystem:    operatingSystem,
@@ -80,6 +129,7 @@ func NewMockProviderMockConfig(config MockConfig, nodeName, operatingSystem stri
 		pods:               make(map[string]*v1.Pod),
 		config:             config,
 		startTime:          time.Now(),
+		conditions:         defaultNodeConditions(),
 	}
 
 	return &provider, nil
@@ -344,6 +394,78 @@ func (p *MockProvider) ConfigureNode(ctx context.Context, n *v1.Node) {
 	n.Status.NodeInfo.OperatingSystem = os
 	n.Status.NodeInfo.Architecture = "amd64"
 	n.ObjectMeta.Labels["alpha.service-controller.kubernetes.io/exclude-balancer"] = "true"
+
+	p.nodeMu.Lock()
+	p.node = n.DeepCopy()
+	p.nodeMu.Unlock()
+}
+
+// Ping implements node.NodeProvider. The mock provider is always reachable.
+func (p *MockProvider) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// NotifyNodeStatus implements node.NodeProvider. The configured node condition changes are applied in the background
+// once their time has elapsed, and the node's status is reported to the callback after each of them.
+func (p *MockProvider) NotifyNodeStatus(ctx context.Context, cb func(*v1.Node)) {
+	for _, c := range p.config.NodeConditionChanges {
+		// The delay was validated when loading the configuration.
+		after, _ := time.ParseDuration(c.After)
+		go func(c NodeConditionChange) {
+			t := time.NewTimer(after)
+			defer t.Stop()
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+
+			log.G(ctx).WithField("type", c.Type).WithField("status", c.Status).Info("Changing node condition")
+			if n := p.setNodeCondition(c); n != nil {
+				cb(n)
+			}
+		}(c)
+	}
+}
+
+// setNodeCondition applies the given change to the node's conditions, and returns the updated node. The returned node
+// is nil if the node was not configured yet.
+func (p *MockProvider) setNodeCondition(c NodeConditionChange) *v1.Node {
+	p.nodeMu.Lock()
+	defer p.nodeMu.Unlock()
+
+	now := metav1.Now()
+	condition := v1.NodeCondition{
+		Type:               c.Type,
+		Status:             c.Status,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             c.Reason,
+		Message:            c.Message,
+	}
+	found := false
+	for i := range p.conditions {
+		if p.conditions[i].Type != c.Type {
+			continue
+		}
+		if p.conditions[i].Status == c.Status {
+			condition.LastTransitionTime = p.conditions[i].LastTransitionTime
+		}
+		p.conditions[i] = condition
+		found = true
+	}
+	if !found {
+		p.conditions = append(p.conditions, condition)
+	}
+
+	if p.node == nil {
+		return nil
+	}
+	n := p.node.DeepCopy()
+	n.Status.Conditions = make([]v1.NodeCondition, len(p.conditions))
+	copy(n.Status.Conditions, p.conditions)
+	p.node = n.DeepCopy()
+	return n
 }
 
 // Capacity returns a resource list containing the capacity limits.
@@ -358,7 +480,15 @@ func (p *MockProvider) capacity() v1.ResourceList {
 // NodeConditions returns a list of conditions (Ready, OutOfDisk, etc), for updates to the node status
 // within Kubernetes.
 func (p *MockProvider) nodeConditions() []v1.NodeCondition {
-	// TODO: Make this configurable
+	p.nodeMu.Lock()
+	defer p.nodeMu.Unlock()
+	conditions := make([]v1.NodeCondition, len(p.conditions))
+	copy(conditions, p.conditions)
+	return conditions
+}
+
+// defaultNodeConditions returns the conditions of the node before any of the configured changes is applied.
+func defaultNodeConditions() []v1.NodeCondition {
 	return []v1.NodeCondition{
 		{
 			Type:               "Ready",
@@ -1,5 +1,16 @@
 package mock
 
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
 // We can guarantee the right interfaces are implemented inside of by putting casts in place. We must do the verification
 // that a given type *does not* implement a given interface in this test.
 // Cannot implement this due to:  https://github.com/virtual-kubelet/virtual-kubelet/issues/632
@@ -10,3 +21,43 @@ func TestMockLegacyInterface(t *testing.T) {
 	assert.Assert(t, !ok)
 }
 */
+
+func TestMockNodeConditionChanges(t *testing.T) {
+	_, err := NewMockProviderMockConfig(MockConfig{
+		NodeConditionChanges: []NodeConditionChange{{After: "soon", Type: v1.NodeReady, Status: v1.ConditionFalse}},
+	}, "vk", "Linux", "127.0.0.1", 10250)
+	assert.Check(t, is.ErrorContains(err, "Invalid node condition change delay"))
+
+	p, err := NewMockProviderMockConfig(MockConfig{
+		NodeConditionChanges: []NodeConditionChange{{After: "0s", Type: v1.NodeReady, Status: v1.ConditionFalse, Reason: "MockNotReady"}},
+	}, "vk", "Linux", "127.0.0.1", 10250)
+	assert.NilError(t, err)
+
+	n := &v1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{}}}
+	n.Status.NodeInfo.KubeletVersion = "v1.15.2"
+	p.ConfigureNode(context.Background(), n)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan *v1.Node, 1)
+	p.NotifyNodeStatus(ctx, func(n *v1.Node) {
+		updates <- n
+	})
+
+	select {
+	case n = <-updates:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the node status update")
+	}
+	assert.Check(t, is.Equal(n.Status.NodeInfo.KubeletVersion, "v1.15.2"))
+	var ready *v1.NodeCondition
+	for i := range n.Status.Conditions {
+		if n.Status.Conditions[i].Type == v1.NodeReady {
+			ready = &n.Status.Conditions[i]
+		}
+	}
+	assert.Assert(t, ready != nil)
+	assert.Check(t, is.Equal(ready.Status, v1.ConditionFalse))
+	assert.Check(t, is.Equal(ready.Reason, "MockNotReady"))
+	assert.Check(t, is.DeepEqual(p.nodeConditions(), n.Status.Conditions))
+}
@@ -34,3 +34,15 @@ type Provider interface {
 type PodMetricsProvider interface {
 	GetStatsSummary(context.Context) (*stats.Summary, error)
 }
+
+// ContainerAttacher is an optional interface that providers can implement to support attaching to the main process
+// of a container, as done by "kubectl attach"
+type ContainerAttacher interface {
+	AttachToContainer(ctx context.Context, namespace, podName, containerName string, attach api.AttachIO) error
+}
+
+// PortForwarder is an optional interface that providers can implement to support forwarding connections to the ports
+// of a pod, as done by "kubectl port-forward"
+type PortForwarder interface {
+	PortForward(ctx context.Context, namespace, podName string, port int32, stream io.ReadWriteCloser) error
+}
@@ -3,6 +3,7 @@ package provider
 import (
 	"sync"
 
+	"github.com/pkg/errors"
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/internal/manager"
 )
@@ -39,6 +40,20 @@ func (s *Store) Get(name string) InitFunc {
 	return f
 }
 
+// NewProvider initializes a new instance of the provider registered under the given name.
+// Each call returns a separate instance, so that a provider can be used for several nodes.
+func (s *Store) NewProvider(name string, cfg InitConfig) (Provider, error) {
+	f := s.Get(name)
+	if f == nil {
+		return nil, errdefs.NotFoundf("provider %q not found", name)
+	}
+	p, err := f(cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error initializing provider %s", name)
+	}
+	return p, nil
+}
+
 // List lists all the registered providers
 func (s *Store) List() []string {
 	s.mu.Lock()
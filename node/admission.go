@@ -0,0 +1,279 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	v1helper "k8s.io/kubernetes/pkg/apis/core/v1/helper"
+)
+
+const (
+	// The reasons with which pods are rejected by the built-in admission checks, or when an admit handler fails. These
+	// are the same as the kubelet's.
+	podAdmitReasonOutOfPods            = "OutOfpods"
+	podAdmitReasonOutOfResourcePrefix  = "OutOf"
+	podAdmitReasonNodeSelectorMismatch = "MatchNodeSelector"
+	podAdmitReasonTaintsNotTolerated   = "PodToleratesNodeTaints"
+	podAdmitReasonUnexpectedError      = "UnexpectedAdmissionError"
+)
+
+// PodAdmitAttributes holds the information used to decide whether a pod is admitted.
+type PodAdmitAttributes struct {
+	// Pod is the pod being admitted.
+	Pod *corev1.Pod
+	// OtherPods are the pods which were already admitted, and are not done running.
+	OtherPods []*corev1.Pod
+	// Node is the node the pods are running on. It is nil if PodControllerConfig.GetNode is unset.
+	Node *corev1.Node
+}
+
+// PodAdmitResult is the result of the admission of a pod.
+type PodAdmitResult struct {
+	// Admit is whether the pod is admitted.
+	Admit bool
+	// Reason is a brief CamelCase reason of why the pod was rejected. It is set as the reason of the pod's status.
+	Reason string
+	// Message is a human readable message of why the pod was rejected.
+	Message string
+}
+
+// PodAdmitHandler decides whether pods are admitted on the node, before they are created in the provider.
+// Pods which are rejected are marked as failed, and are not created in the provider.
+type PodAdmitHandler interface {
+	Admit(ctx context.Context, attrs *PodAdmitAttributes) PodAdmitResult
+}
+
+// PodAdmitHandlerFunc is a function which implements PodAdmitHandler.
+type PodAdmitHandlerFunc func(ctx context.Context, attrs *PodAdmitAttributes) PodAdmitResult
+
+// Admit implements PodAdmitHandler.
+func (f PodAdmitHandlerFunc) Admit(ctx context.Context, attrs *PodAdmitAttributes) PodAdmitResult {
+	return f(ctx, attrs)
+}
+
+// admitPodOnNode is the built-in admit handler, which checks that the pod fits on the node and may run on it.
+// Based on GeneralPredicates in pkg/scheduler/algorithm/predicates/predicates.go and the kubelet's predicate admit
+// handler in pkg/kubelet/lifecycle/predicate.go.
+func admitPodOnNode(ctx context.Context, attrs *PodAdmitAttributes) PodAdmitResult {
+	node := attrs.Node
+	if node == nil {
+		return PodAdmitResult{Admit: true}
+	}
+	pod := attrs.Pod
+
+	if result := admitPodResources(pod, attrs.OtherPods, node.Status.Allocatable); !result.Admit {
+		return result
+	}
+
+	nodeLabels := labels.Set(node.Labels)
+	if !labels.SelectorFromSet(pod.Spec.NodeSelector).Matches(nodeLabels) {
+		return PodAdmitResult{Reason: podAdmitReasonNodeSelectorMismatch, Message: "Predicate MatchNodeSelector failed"}
+	}
+	if affinity := pod.Spec.Affinity; affinity != nil && affinity.NodeAffinity != nil {
+		if required := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution; required != nil {
+			nodeFields := fields.Set{"metadata.name": node.Name}
+			if !v1helper.MatchNodeSelectorTerms(required.NodeSelectorTerms, nodeLabels, nodeFields) {
+				return PodAdmitResult{Reason: podAdmitReasonNodeSelectorMismatch, Message: "Predicate MatchNodeSelector failed"}
+			}
+		}
+	}
+
+	// As done by the kubelet, only NoExecute taints are checked: NoSchedule taints are left to the scheduler, so that
+	// pods bound to the node directly can still run on it.
+	noExecute := func(t *corev1.Taint) bool { return t.Effect == corev1.TaintEffectNoExecute }
+	if !v1helper.TolerationsTolerateTaintsWithFilter(pod.Spec.Tolerations, node.Spec.Taints, noExecute) {
+		return PodAdmitResult{Reason: podAdmitReasonTaintsNotTolerated, Message: "Predicate PodToleratesNodeTaints failed"}
+	}
+
+	return PodAdmitResult{Admit: true}
+}
+
+// admitPodResources checks that the node has enough allocatable resources left for the pod, as well as room for one
+// more pod. Only the resources which the node reports as allocatable are checked.
+func admitPodResources(pod *corev1.Pod, otherPods []*corev1.Pod, allocatable corev1.ResourceList) PodAdmitResult {
+	if maxPods, ok := allocatable[corev1.ResourcePods]; ok && int64(len(otherPods)+1) > maxPods.Value() {
+		return PodAdmitResult{
+			Reason:  podAdmitReasonOutOfPods,
+			Message: fmt.Sprintf("Node didn't have enough resource: pods, requested: 1, used: %d, capacity: %d", len(otherPods), maxPods.Value()),
+		}
+	}
+
+	requested := podRequests(pod)
+	used := corev1.ResourceList{}
+	for _, p := range otherPods {
+		for name, q := range podRequests(p) {
+			addQuantity(used, name, q)
+		}
+	}
+
+	names := make([]string, 0, len(requested))
+	for name := range requested {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		name := corev1.ResourceName(n)
+		capacity, ok := allocatable[name]
+		if !ok || name == corev1.ResourcePods {
+			continue
+		}
+		request := requested[name]
+		if request.IsZero() {
+			continue
+		}
+		inUse, ok := used[name]
+		if !ok {
+			inUse = *resource.NewQuantity(0, request.Format)
+		}
+		total := inUse.DeepCopy()
+		total.Add(request)
+		if total.Cmp(capacity) > 0 {
+			return PodAdmitResult{
+				Reason: podAdmitReasonOutOfResourcePrefix + n,
+				Message: fmt.Sprintf("Node didn't have enough resource: %s, requested: %s, used: %s, capacity: %s",
+					n, quantityString(name, request), quantityString(name, inUse), quantityString(name, capacity)),
+			}
+		}
+	}
+	return PodAdmitResult{Admit: true}
+}
+
+func quantityString(name corev1.ResourceName, q resource.Quantity) string {
+	if name == corev1.ResourceCPU {
+		return fmt.Sprintf("%d", q.MilliValue())
+	}
+	return fmt.Sprintf("%d", q.Value())
+}
+
+func addQuantity(list corev1.ResourceList, name corev1.ResourceName, q resource.Quantity) {
+	total, ok := list[name]
+	if !ok {
+		list[name] = q.DeepCopy()
+		return
+	}
+	total.Add(q)
+	list[name] = total
+}
+
+// podRequests returns the resources requested by the pod, which are the largest of the sum of its containers'
+// requests and of the requests of each of its init containers, since those are run one after the other.
+// Based on GetResourceRequest in pkg/scheduler/nodeinfo/node_info.go.
+func podRequests(pod *corev1.Pod) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	for _, c := range pod.Spec.Containers {
+		for name, q := range c.Resources.Requests {
+			addQuantity(requests, name, q)
+		}
+	}
+	for _, c := range pod.Spec.InitContainers {
+		for name, q := range c.Resources.Requests {
+			if total, ok := requests[name]; !ok || q.Cmp(total) > 0 {
+				requests[name] = q.DeepCopy()
+			}
+		}
+	}
+	return requests
+}
+
+// admitPod runs the admit handlers against a pod which is not known to the provider yet.
+// Pods are admitted one at a time, so that each is checked against the pods admitted before it.
+func (pc *PodController) admitPod(ctx context.Context, pod *corev1.Pod, kPod *knownPod, node *corev1.Node) PodAdmitResult {
+	ctx, span := trace.StartSpan(ctx, "admitPod")
+	defer span.End()
+
+	pc.admitMu.Lock()
+	defer pc.admitMu.Unlock()
+
+	attrs := &PodAdmitAttributes{Pod: pod, OtherPods: pc.admittedPods(pod), Node: node}
+	for _, h := range pc.admitHandlers {
+		if result := h.Admit(ctx, attrs); !result.Admit {
+			log.G(ctx).WithFields(log.Fields{
+				"reason":  result.Reason,
+				"message": result.Message,
+			}).Info("Pod was rejected")
+			return result
+		}
+	}
+
+	setAdmitted(kPod, pod)
+	return PodAdmitResult{Admit: true}
+}
+
+// setAdmitted records that the pod was admitted, so that it is accounted for when admitting other pods.
+func setAdmitted(kPod *knownPod, pod *corev1.Pod) {
+	if kPod == nil {
+		return
+	}
+	kPod.Lock()
+	defer kPod.Unlock()
+	if kPod.admittedPod == nil {
+		kPod.admittedPod = pod.DeepCopy()
+	}
+}
+
+// admittedPods returns the pods, other than the given one, which were admitted and are not done running.
+func (pc *PodController) admittedPods(pod *corev1.Pod) []*corev1.Pod {
+	var pods []*corev1.Pod
+	pc.knownPods.Range(func(_, obj interface{}) bool {
+		kPod := obj.(*knownPod)
+		kPod.Lock()
+		p := kPod.admittedPod
+		if p != nil && kPod.lastPodUsed != nil {
+			p = kPod.lastPodUsed
+		}
+		if providerPod := kPod.lastPodStatusReceivedFromProvider; p != nil && providerPod != nil {
+			p = p.DeepCopy()
+			p.Status = providerPod.Status
+		}
+		kPod.Unlock()
+		if p == nil || (p.Namespace == pod.Namespace && p.Name == pod.Name) {
+			return true
+		}
+		if p.Status.Phase == corev1.PodSucceeded || p.Status.Phase == corev1.PodFailed {
+			return true
+		}
+		pods = append(pods, p)
+		return true
+	})
+	return pods
+}
+
+// rejectPod marks a pod which was not admitted as failed.
+func (pc *PodController) rejectPod(ctx context.Context, pod *corev1.Pod, result PodAdmitResult) error {
+	pc.recorder.Event(pod, corev1.EventTypeWarning, result.Reason, result.Message)
+
+	// The status is patched against the pod from Kubernetes, as the given pod may have been amended for the provider.
+	if p, err := pc.podsLister.Pods(pod.Namespace).Get(pod.Name); err == nil {
+		pod = p
+	}
+	status := pod.Status.DeepCopy()
+	status.Phase = corev1.PodFailed
+	status.Reason = result.Reason
+	status.Message = "Pod " + result.Message
+	if err := pc.patchPodStatus(ctx, pod, status); err != nil {
+		return pkgerrors.Wrap(err, "error while updating the status of the rejected pod in kubernetes")
+	}
+	return nil
+}
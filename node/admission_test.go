@@ -0,0 +1,195 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newPodRequesting(name, cpu, memory string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       newPodSpec(),
+	}
+	pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(cpu),
+		corev1.ResourceMemory: resource.MustParse(memory),
+	}
+	return pod
+}
+
+func TestAdmitPodResources(t *testing.T) {
+	allocatable := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("2"),
+		corev1.ResourceMemory: resource.MustParse("4Gi"),
+		corev1.ResourcePods:   resource.MustParse("2"),
+	}
+	running := newPodRequesting("running", "1500m", "1Gi")
+
+	testCases := []struct {
+		name      string
+		pod       *corev1.Pod
+		otherPods []*corev1.Pod
+		reason    string
+	}{
+		{
+			name:      "fits",
+			pod:       newPodRequesting("nginx", "500m", "3Gi"),
+			otherPods: []*corev1.Pod{running},
+		},
+		{
+			name:      "out of cpu",
+			pod:       newPodRequesting("nginx", "600m", "1Gi"),
+			otherPods: []*corev1.Pod{running},
+			reason:    "OutOfcpu",
+		},
+		{
+			name:      "out of memory",
+			pod:       newPodRequesting("nginx", "100m", "3500Mi"),
+			otherPods: []*corev1.Pod{running},
+			reason:    "OutOfmemory",
+		},
+		{
+			name:      "out of pods",
+			pod:       newPodRequesting("nginx", "0", "0"),
+			otherPods: []*corev1.Pod{running, newPodRequesting("other", "0", "0")},
+			reason:    "OutOfpods",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := admitPodResources(tc.pod, tc.otherPods, allocatable)
+			assert.Check(t, is.Equal(result.Admit, tc.reason == ""))
+			assert.Check(t, is.Equal(result.Reason, tc.reason))
+		})
+	}
+}
+
+func TestPodRequestsIncludeInitContainers(t *testing.T) {
+	pod := newPodRequesting("nginx", "500m", "1Gi")
+	pod.Spec.InitContainers = []corev1.Container{
+		{Name: "init", Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1"),
+			corev1.ResourceMemory: resource.MustParse("512Mi"),
+		}}},
+	}
+
+	requests := podRequests(pod)
+	cpu, memory := requests[corev1.ResourceCPU], requests[corev1.ResourceMemory]
+	assert.Check(t, is.Equal(cpu.MilliValue(), int64(1000)))
+	assert.Check(t, is.Equal(memory.Value(), int64(1024*1024*1024)))
+}
+
+func TestAdmitPodOnNode(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "vk", Labels: map[string]string{"type": "virtual-kubelet"}},
+		Spec: corev1.NodeSpec{Taints: []corev1.Taint{
+			{Key: "virtual-kubelet.io/provider", Value: "mock", Effect: corev1.TaintEffectNoSchedule},
+			{Key: "dedicated", Value: "batch", Effect: corev1.TaintEffectNoExecute},
+		}},
+	}
+	tolerateNoExecute := []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "batch", Effect: corev1.TaintEffectNoExecute}}
+
+	testCases := []struct {
+		name   string
+		modify func(*corev1.Pod)
+		reason string
+	}{
+		{
+			name: "admitted",
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.NodeSelector = map[string]string{"type": "virtual-kubelet"}
+			},
+		},
+		{
+			name: "node selector mismatch",
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.NodeSelector = map[string]string{"type": "gpu"}
+			},
+			reason: podAdmitReasonNodeSelectorMismatch,
+		},
+		{
+			name: "node affinity mismatch",
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"other"}}}},
+					}},
+				}}
+			},
+			reason: podAdmitReasonNodeSelectorMismatch,
+		},
+		{
+			name: "untolerated taint",
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Tolerations = nil
+			},
+			reason: podAdmitReasonTaintsNotTolerated,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: newPodSpec()}
+			pod.Spec.Tolerations = tolerateNoExecute
+			tc.modify(pod)
+
+			result := admitPodOnNode(context.Background(), &PodAdmitAttributes{Pod: pod, Node: node})
+			assert.Check(t, is.Equal(result.Admit, tc.reason == ""))
+			assert.Check(t, is.Equal(result.Reason, tc.reason))
+		})
+	}
+}
+
+func TestRejectedPodIsNotCreated(t *testing.T) {
+	tc := newTestController(func(cfg *PodControllerConfig, _ *mockProviderAsync) {
+		cfg.GetNode = func() *corev1.Node {
+			return &corev1.Node{Status: corev1.NodeStatus{Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:  resource.MustParse("1"),
+				corev1.ResourcePods: resource.MustParse("10"),
+			}}}
+		}
+	})
+	ctx := context.Background()
+	key := "default/nginx"
+
+	pod := newPodRequesting("nginx", "2", "1Gi")
+	_, err := tc.client.CoreV1().Pods(pod.Namespace).Create(pod)
+	assert.NilError(t, err)
+	tc.knownPods.Store(key, &knownPod{})
+
+	assert.NilError(t, tc.createOrUpdatePod(ctx, pod))
+	assert.Check(t, is.Equal(tc.mock.creates.read(), 0))
+
+	updated, err := tc.client.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(updated.Status.Phase, corev1.PodFailed))
+	assert.Check(t, is.Equal(updated.Status.Reason, "OutOfcpu"))
+
+	// A pod which fits is created, and accounted for when admitting the next pods.
+	tc.admitHandlers = append(tc.admitHandlers, PodAdmitHandlerFunc(func(ctx context.Context, attrs *PodAdmitAttributes) PodAdmitResult {
+		if len(attrs.OtherPods) > 0 {
+			return PodAdmitResult{Reason: "OnlyOne", Message: "only one pod may run"}
+		}
+		return PodAdmitResult{Admit: true}
+	}))
+	pod = newPodRequesting("nginx", "500m", "1Gi")
+	assert.NilError(t, tc.createOrUpdatePod(ctx, pod))
+	assert.Check(t, is.Equal(tc.mock.creates.read(), 1))
+
+	other := newPodRequesting("other", "100m", "1Gi")
+	_, err = tc.client.CoreV1().Pods(other.Namespace).Create(other)
+	assert.NilError(t, err)
+	tc.knownPods.Store("default/other", &knownPod{})
+	assert.NilError(t, tc.createOrUpdatePod(ctx, other))
+	assert.Check(t, is.Equal(tc.mock.creates.read(), 1))
+	updated, err = tc.client.CoreV1().Pods(other.Namespace).Get(other.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(updated.Status.Reason, "OnlyOne"))
+}
@@ -0,0 +1,211 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+)
+
+// maxTranscriptSize is the maximum number of bytes recorded in each direction of a session transcript.
+const maxTranscriptSize = 1 << 20
+
+// ExecSession describes an exec or attach session, as recorded by an ExecAuditSink.
+type ExecSession struct {
+	// User is the user who made the request, if it was authenticated, see AuthHandler.
+	User      *UserInfo `json:"user,omitempty"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	// Command is the command which was executed. It is empty for attach sessions.
+	Command []string  `json:"command,omitempty"`
+	TTY     bool      `json:"tty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	// ExitCode is the exit code of the command: 0 if the handler succeeded, the status reported by its error if it
+	// has an ExitStatus method, and -1 otherwise.
+	ExitCode int `json:"exitCode"`
+	// Error is the error returned by the handler, if any.
+	Error string `json:"error,omitempty"`
+	// Transcript is the recording of the terminal, if transcripts are enabled and the session has a TTY.
+	Transcript *ExecTranscript `json:"transcript,omitempty"`
+}
+
+// ExecTranscript is the recording of the terminal of a session.
+type ExecTranscript struct {
+	// Input is what the user typed.
+	Input []byte `json:"input,omitempty"`
+	// Output is what the terminal displayed.
+	Output []byte `json:"output,omitempty"`
+	// Truncated is set if either direction exceeded the maximum size of transcripts, 1MiB.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ExecAuditSink records the exec and attach sessions served by the pod API.
+type ExecAuditSink interface {
+	// RecordExecSession is called once the session has ended. The context is the one of the session, which may be
+	// done already.
+	RecordExecSession(ctx context.Context, s ExecSession)
+}
+
+// ExecAuditSinkFunc adapts a function to ExecAuditSink.
+type ExecAuditSinkFunc func(ctx context.Context, s ExecSession)
+
+// RecordExecSession implements ExecAuditSink.
+func (f ExecAuditSinkFunc) RecordExecSession(ctx context.Context, s ExecSession) {
+	f(ctx, s)
+}
+
+type jsonExecAuditSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONExecAuditSink creates a sink writing each session to w as a line of JSON.
+// Errors are logged, and do not affect the sessions.
+func NewJSONExecAuditSink(w io.Writer) ExecAuditSink {
+	return &jsonExecAuditSink{enc: json.NewEncoder(w)}
+}
+
+func (s *jsonExecAuditSink) RecordExecSession(ctx context.Context, session ExecSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.enc.Encode(session); err != nil {
+		log.G(ctx).WithError(err).Error("Error writing exec session to audit log")
+	}
+}
+
+// execAuditor runs the sessions of a request, and records them to its sink.
+type execAuditor struct {
+	sink        ExecAuditSink
+	transcripts bool
+	// session holds the details of the request, which are the same for all its sessions.
+	session ExecSession
+}
+
+// run runs the session through f, and records it if there is a sink.
+func (a *execAuditor) run(ctx context.Context, cmd []string, eio *execIO, f func(AttachIO) error) error {
+	if a.sink == nil {
+		return f(eio)
+	}
+
+	s := a.session
+	s.Command = cmd
+	s.TTY = eio.tty
+
+	var t *transcript
+	if a.transcripts && eio.tty {
+		t = &transcript{}
+		eio = t.record(eio)
+	}
+
+	s.Start = time.Now()
+	err := f(eio)
+	s.End = time.Now()
+
+	s.ExitCode = exitCode(err)
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if t != nil {
+		s.Transcript = t.get()
+	}
+	a.sink.RecordExecSession(ctx, s)
+	return err
+}
+
+// exitCode returns the exit code of the command matching the error returned by the handler.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(interface{ ExitStatus() int }); ok {
+		return e.ExitStatus()
+	}
+	return -1
+}
+
+// transcript records the streams of a session.
+type transcript struct {
+	input  limitedBuffer
+	output limitedBuffer
+}
+
+// record returns streams which copy the input and output of the session to the transcript. With a TTY, stderr is
+// merged into stdout, so there is no error stream to record.
+func (t *transcript) record(eio *execIO) *execIO {
+	recorded := *eio
+	if eio.stdin != nil {
+		recorded.stdin = io.TeeReader(eio.stdin, &t.input)
+	}
+	if eio.stdout != nil {
+		recorded.stdout = &teeWriteCloser{WriteCloser: eio.stdout, w: &t.output}
+	}
+	return &recorded
+}
+
+func (t *transcript) get() *ExecTranscript {
+	input, inputTruncated := t.input.get()
+	output, outputTruncated := t.output.get()
+	return &ExecTranscript{Input: input, Output: output, Truncated: inputTruncated || outputTruncated}
+}
+
+// limitedBuffer keeps the first maxTranscriptSize bytes written to it. It is safe for concurrent use, since the
+// streams may still be in use by the provider once the session is recorded.
+type limitedBuffer struct {
+	mu        sync.Mutex
+	b         []byte
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+	if left := maxTranscriptSize - len(b.b); n > left {
+		p = p[:left]
+		b.truncated = true
+	}
+	b.b = append(b.b, p...)
+	return n, nil
+}
+
+func (b *limitedBuffer) get() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]byte(nil), b.b...), b.truncated
+}
+
+// teeWriteCloser copies what is written to the stream to w.
+type teeWriteCloser struct {
+	io.WriteCloser
+	w io.Writer
+}
+
+func (t *teeWriteCloser) Write(p []byte) (int, error) {
+	n, err := t.WriteCloser.Write(p)
+	if n > 0 {
+		t.w.Write(p[:n]) //nolint:errcheck
+	}
+	return n, err
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type exitError int
+
+func (e exitError) Error() string {
+	return "command terminated with non-zero exit code"
+}
+
+func (e exitError) ExitStatus() int {
+	return int(e)
+}
+
+func TestExecAuditor(t *testing.T) {
+	var sessions []ExecSession
+	a := &execAuditor{
+		sink: ExecAuditSinkFunc(func(_ context.Context, s ExecSession) {
+			sessions = append(sessions, s)
+		}),
+		transcripts: true,
+		session:     ExecSession{User: &UserInfo{Name: "admin"}, Namespace: "default", Pod: "pod", Container: "container"},
+	}
+
+	var stdout bytes.Buffer
+	eio := &execIO{tty: true, stdin: strings.NewReader("exit 3\n"), stdout: nopWriteCloser{&stdout}}
+	err := a.run(context.Background(), []string{"sh"}, eio, func(attach AttachIO) error {
+		in, err := ioutil.ReadAll(attach.Stdin())
+		assert.NilError(t, err)
+		_, err = attach.Stdout().Write(append([]byte("$ "), in...))
+		assert.NilError(t, err)
+		return exitError(3)
+	})
+	assert.Check(t, is.Equal(err, exitError(3)))
+	assert.Check(t, is.Equal(stdout.String(), "$ exit 3\n"), "the streams must be passed through")
+
+	assert.Assert(t, is.Len(sessions, 1))
+	s := sessions[0]
+	assert.Check(t, is.Equal(s.User.Name, "admin"))
+	assert.Check(t, is.DeepEqual(s.Command, []string{"sh"}))
+	assert.Check(t, s.TTY)
+	assert.Check(t, !s.End.Before(s.Start))
+	assert.Check(t, is.Equal(s.ExitCode, 3))
+	assert.Check(t, is.Equal(s.Error, "command terminated with non-zero exit code"))
+	assert.Assert(t, s.Transcript != nil)
+	assert.Check(t, is.Equal(string(s.Transcript.Input), "exit 3\n"))
+	assert.Check(t, is.Equal(string(s.Transcript.Output), "$ exit 3\n"))
+	assert.Check(t, !s.Transcript.Truncated)
+
+	// Transcripts are only recorded for sessions with a TTY.
+	eio = &execIO{stdout: nopWriteCloser{ioutil.Discard}}
+	err = a.run(context.Background(), []string{"ls"}, eio, func(AttachIO) error {
+		return errors.New("no such container")
+	})
+	assert.Check(t, is.ErrorContains(err, "no such container"))
+	assert.Assert(t, is.Len(sessions, 2))
+	assert.Check(t, is.Equal(sessions[1].ExitCode, -1))
+	assert.Check(t, sessions[1].Transcript == nil)
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	var b limitedBuffer
+	n, err := b.Write(make([]byte, maxTranscriptSize-1))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(n, maxTranscriptSize-1))
+
+	n, err = b.Write([]byte("ab"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(n, 2), "writes must not fail once the buffer is full")
+
+	data, truncated := b.get()
+	assert.Check(t, is.Len(data, maxTranscriptSize))
+	assert.Check(t, truncated)
+}
+
+func TestJSONExecAuditSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewJSONExecAuditSink(&out)
+	sink.RecordExecSession(context.Background(), ExecSession{Namespace: "default", Pod: "pod", Container: "container", Command: []string{"ls"}})
+	sink.RecordExecSession(context.Background(), ExecSession{Namespace: "default", Pod: "pod", Container: "container", ExitCode: 1})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Assert(t, is.Len(lines, 2))
+	var s ExecSession
+	assert.NilError(t, json.Unmarshal([]byte(lines[0]), &s))
+	assert.Check(t, is.DeepEqual(s.Command, []string{"ls"}))
+	assert.NilError(t, json.Unmarshal([]byte(lines[1]), &s))
+	assert.Check(t, is.Equal(s.ExitCode, 1))
+}
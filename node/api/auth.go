@@ -0,0 +1,420 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+	authenticationclient "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	authorizationclient "k8s.io/client-go/kubernetes/typed/authorization/v1"
+)
+
+// The default durations for which the decisions of the API server are cached, which are the same as the kubelet's.
+const (
+	DefaultTokenReviewCacheTTL           = 2 * time.Minute
+	DefaultSubjectAccessReviewAllowedTTL = 5 * time.Minute
+	DefaultSubjectAccessReviewDeniedTTL  = 30 * time.Second
+)
+
+// authCacheSize is the maximum number of decisions cached by the token review authenticator and the subject access
+// review authorizer.
+const authCacheSize = 4096
+
+// UserInfo describes the user who made a request to the kubelet API.
+type UserInfo struct {
+	Name   string              `json:"username"`
+	UID    string              `json:"uid,omitempty"`
+	Groups []string            `json:"groups,omitempty"`
+	Extra  map[string][]string `json:"extra,omitempty"`
+}
+
+// anonymousUser is the user of the requests which carry no credentials, when anonymous requests are allowed.
+var anonymousUser = UserInfo{Name: "system:anonymous", Groups: []string{"system:unauthenticated"}}
+
+type userKey struct{}
+
+// WithUser returns a context carrying the user who made the request.
+func WithUser(ctx context.Context, user *UserInfo) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFrom returns the user carried by the context, which is set on the requests authenticated by AuthHandler.
+func UserFrom(ctx context.Context) (*UserInfo, bool) {
+	user, ok := ctx.Value(userKey{}).(*UserInfo)
+	return user, ok
+}
+
+// Authenticator authenticates the requests made to the kubelet API.
+type Authenticator interface {
+	// AuthenticateRequest returns the user who made the request. ok is false if the request carries no credentials
+	// which the authenticator can check, and an error is returned if they are invalid.
+	AuthenticateRequest(req *http.Request) (user *UserInfo, ok bool, err error)
+}
+
+// AuthorizationAttributes describes an action on the node, as checked by an Authorizer.
+type AuthorizationAttributes struct {
+	User *UserInfo
+	// Verb is the API verb matching the method of the request, e.g. "get" or "create".
+	Verb string
+	// Subresource is the subresource of the node which the request acts upon, e.g. "proxy" or "stats".
+	Subresource string
+	// NodeName is the name of the node.
+	NodeName string
+}
+
+// Authorizer authorizes the requests made to the kubelet API.
+type Authorizer interface {
+	// Authorize returns whether the action is allowed, and the reason why if it is not.
+	Authorize(ctx context.Context, attrs AuthorizationAttributes) (allowed bool, reason string, err error)
+}
+
+// UnionAuthenticator authenticates requests with the first of its authenticators which can check their credentials.
+type UnionAuthenticator []Authenticator
+
+// AuthenticateRequest implements Authenticator.
+// Requests are rejected if their credentials are invalid for all the authenticators which checked them.
+func (u UnionAuthenticator) AuthenticateRequest(req *http.Request) (*UserInfo, bool, error) {
+	var errs []string
+	for _, a := range u {
+		user, ok, err := a.AuthenticateRequest(req)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if ok {
+			return user, true, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, false, errors.New(strings.Join(errs, ", "))
+	}
+	return nil, false, nil
+}
+
+// X509Authenticator authenticates requests with the client certificate they were made with, as the user named after
+// the certificate's common name, in the groups named after its organizations.
+type X509Authenticator struct {
+	roots *x509.CertPool
+}
+
+// NewX509Authenticator creates an authenticator accepting the client certificates signed by the given CAs.
+// The TLS config of the server must request client certificates, see tls.RequestClientCert.
+func NewX509Authenticator(roots *x509.CertPool) *X509Authenticator {
+	return &X509Authenticator{roots: roots}
+}
+
+// AuthenticateRequest implements Authenticator.
+func (a *X509Authenticator) AuthenticateRequest(req *http.Request) (*UserInfo, bool, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil, false, nil
+	}
+
+	certs := req.TLS.PeerCertificates
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, false, errors.Wrap(err, "error verifying client certificate")
+	}
+	if certs[0].Subject.CommonName == "" {
+		return nil, false, errors.New("client certificate has no common name")
+	}
+	return &UserInfo{Name: certs[0].Subject.CommonName, Groups: certs[0].Subject.Organization}, true, nil
+}
+
+// TokenReviewAuthenticator authenticates requests with the bearer token they carry, which is checked by the API
+// server through token reviews. Reviews are cached by token.
+type TokenReviewAuthenticator struct {
+	client authenticationclient.TokenReviewInterface
+	ttl    time.Duration
+	cache  *cache.LRUExpireCache
+}
+
+// NewTokenReviewAuthenticator creates an authenticator checking bearer tokens with the given client.
+// The results of the token reviews are cached for ttl. If ttl is zero, DefaultTokenReviewCacheTTL is used.
+func NewTokenReviewAuthenticator(client authenticationclient.TokenReviewInterface, ttl time.Duration) *TokenReviewAuthenticator {
+	if ttl == 0 {
+		ttl = DefaultTokenReviewCacheTTL
+	}
+	return &TokenReviewAuthenticator{client: client, ttl: ttl, cache: cache.NewLRUExpireCache(authCacheSize)}
+}
+
+type tokenReviewResult struct {
+	user *UserInfo
+	err  error
+}
+
+// AuthenticateRequest implements Authenticator.
+func (a *TokenReviewAuthenticator) AuthenticateRequest(req *http.Request) (*UserInfo, bool, error) {
+	auth := strings.TrimSpace(req.Header.Get("Authorization"))
+	parts := strings.SplitN(auth, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return nil, false, nil
+	}
+	token := strings.TrimSpace(parts[1])
+	if token == "" {
+		return nil, false, nil
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if r, ok := a.cache.Get(key); ok {
+		r := r.(tokenReviewResult)
+		return r.user, r.err == nil, r.err
+	}
+
+	review, err := a.client.Create(&authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		// Failed reviews are not cached, so that they are retried on the next request.
+		return nil, false, errors.Wrap(err, "error reviewing token")
+	}
+
+	var r tokenReviewResult
+	switch {
+	case review.Status.Error != "":
+		r.err = errors.Errorf("invalid token: %s", review.Status.Error)
+	case !review.Status.Authenticated:
+		r.err = errors.New("invalid token")
+	default:
+		r.user = &UserInfo{
+			Name:   review.Status.User.Username,
+			UID:    review.Status.User.UID,
+			Groups: review.Status.User.Groups,
+		}
+		if len(review.Status.User.Extra) > 0 {
+			r.user.Extra = make(map[string][]string, len(review.Status.User.Extra))
+			for k, v := range review.Status.User.Extra {
+				r.user.Extra[k] = v
+			}
+		}
+	}
+	a.cache.Add(key, r, a.ttl)
+	return r.user, r.err == nil, r.err
+}
+
+// SubjectAccessReviewAuthorizer authorizes requests through subject access reviews made to the API server. Allowed
+// and denied decisions are cached for different durations.
+type SubjectAccessReviewAuthorizer struct {
+	client     authorizationclient.SubjectAccessReviewInterface
+	allowedTTL time.Duration
+	deniedTTL  time.Duration
+	cache      *cache.LRUExpireCache
+}
+
+// NewSubjectAccessReviewAuthorizer creates an authorizer checking requests with the given client.
+// Allowed decisions are cached for allowedTTL, and denied decisions for deniedTTL. If either is zero,
+// DefaultSubjectAccessReviewAllowedTTL or DefaultSubjectAccessReviewDeniedTTL is used respectively.
+func NewSubjectAccessReviewAuthorizer(client authorizationclient.SubjectAccessReviewInterface, allowedTTL, deniedTTL time.Duration) *SubjectAccessReviewAuthorizer {
+	if allowedTTL == 0 {
+		allowedTTL = DefaultSubjectAccessReviewAllowedTTL
+	}
+	if deniedTTL == 0 {
+		deniedTTL = DefaultSubjectAccessReviewDeniedTTL
+	}
+	return &SubjectAccessReviewAuthorizer{
+		client:     client,
+		allowedTTL: allowedTTL,
+		deniedTTL:  deniedTTL,
+		cache:      cache.NewLRUExpireCache(authCacheSize),
+	}
+}
+
+type subjectAccessReviewResult struct {
+	allowed bool
+	reason  string
+}
+
+// Authorize implements Authorizer.
+func (a *SubjectAccessReviewAuthorizer) Authorize(ctx context.Context, attrs AuthorizationAttributes) (bool, string, error) {
+	spec := authorizationv1.SubjectAccessReviewSpec{
+		User:   attrs.User.Name,
+		UID:    attrs.User.UID,
+		Groups: attrs.User.Groups,
+		ResourceAttributes: &authorizationv1.ResourceAttributes{
+			Verb:        attrs.Verb,
+			Version:     "v1",
+			Resource:    "nodes",
+			Subresource: attrs.Subresource,
+			Name:        attrs.NodeName,
+		},
+	}
+	if len(attrs.User.Extra) > 0 {
+		spec.Extra = make(map[string]authorizationv1.ExtraValue, len(attrs.User.Extra))
+		for k, v := range attrs.User.Extra {
+			spec.Extra[k] = v
+		}
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return false, "", errors.Wrap(err, "error computing cache key of subject access review")
+	}
+	key := string(data)
+	if r, ok := a.cache.Get(key); ok {
+		r := r.(subjectAccessReviewResult)
+		return r.allowed, r.reason, nil
+	}
+
+	review, err := a.client.Create(&authorizationv1.SubjectAccessReview{Spec: spec})
+	if err != nil {
+		return false, "", errors.Wrap(err, "error reviewing subject access")
+	}
+
+	r := subjectAccessReviewResult{allowed: review.Status.Allowed && !review.Status.Denied, reason: review.Status.Reason}
+	ttl := a.deniedTTL
+	if r.allowed {
+		ttl = a.allowedTTL
+	}
+	a.cache.Add(key, r, ttl)
+	return r.allowed, r.reason, nil
+}
+
+// AuthConfig is used to configure the authentication and authorization of the requests made to the kubelet API, see
+// AuthHandler.
+type AuthConfig struct {
+	// NodeName is the name of the node the requests are made to. It is the name of the node resource in the
+	// authorization attributes.
+	// This field is required.
+	NodeName string
+
+	// Authenticator authenticates the requests. If unset, no request is authenticated.
+	Authenticator Authenticator
+	// AllowAnonymous lets the requests which carry no credentials through, as the "system:anonymous" user in the
+	// "system:unauthenticated" group. They are then authorized as any other request.
+	AllowAnonymous bool
+
+	// Authorizer authorizes the requests. If unset, all the authenticated requests are allowed.
+	Authorizer Authorizer
+}
+
+// AuthHandler wraps the handler of the kubelet API, so that requests are authenticated and authorized as done by the
+// kubelet.
+//
+// Requests are authorized as actions on a subresource of the node, depending on their path: "stats" for /stats,
+// "metrics" for /metrics, "log" for /logs, "spec" for /spec, and "proxy" for everything else, including exec and
+// container logs. The verb is derived from the method of the request, e.g. "get" for GET and "create" for POST.
+//
+// The authenticated user is added to the context of the request, see UserFrom.
+func AuthHandler(h http.Handler, cfg AuthConfig) (http.Handler, error) {
+	if cfg.NodeName == "" {
+		return nil, errdefs.InvalidInput("missing node name")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		var (
+			user *UserInfo
+			ok   bool
+			err  error
+		)
+		if cfg.Authenticator != nil {
+			user, ok, err = cfg.Authenticator.AuthenticateRequest(req)
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).Debug("Unable to authenticate the request")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !ok {
+			if !cfg.AllowAnonymous {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			anonymous := anonymousUser
+			user = &anonymous
+		}
+
+		if cfg.Authorizer != nil {
+			attrs := requestAuthorizationAttributes(req, user, cfg.NodeName)
+			allowed, reason, err := cfg.Authorizer.Authorize(ctx, attrs)
+			if err != nil {
+				log.G(ctx).WithError(err).Error("Error authorizing request")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				log.G(ctx).WithField("user", user.Name).WithField("reason", reason).Debug("Request forbidden")
+				msg := fmt.Sprintf("Forbidden (user=%s, verb=%s, resource=nodes, subresource=%s)", user.Name, attrs.Verb, attrs.Subresource)
+				http.Error(w, msg, http.StatusForbidden)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, req.WithContext(WithUser(ctx, user)))
+	}), nil
+}
+
+// requestAuthorizationAttributes returns the attributes of the action the request performs on the node, as done by
+// the kubelet.
+func requestAuthorizationAttributes(req *http.Request, user *UserInfo, nodeName string) AuthorizationAttributes {
+	attrs := AuthorizationAttributes{User: user, NodeName: nodeName, Subresource: "proxy"}
+
+	switch req.Method {
+	case http.MethodPost:
+		attrs.Verb = "create"
+	case http.MethodGet, http.MethodHead:
+		attrs.Verb = "get"
+	case http.MethodPut:
+		attrs.Verb = "update"
+	case http.MethodPatch:
+		attrs.Verb = "patch"
+	case http.MethodDelete:
+		attrs.Verb = "delete"
+	}
+
+	for _, r := range []struct {
+		path        string
+		subresource string
+	}{
+		{path: "/stats", subresource: "stats"},
+		{path: "/metrics", subresource: "metrics"},
+		{path: "/logs", subresource: "log"},
+		{path: "/spec", subresource: "spec"},
+	} {
+		if isSubpath(req.URL.Path, r.path) {
+			attrs.Subresource = r.subresource
+			break
+		}
+	}
+	return attrs
+}
+
+// isSubpath returns whether p is the given path, or one of its sub paths.
+func isSubpath(p, path string) bool {
+	return p == path || strings.HasPrefix(p, path+"/")
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newAuthTestClient returns a client whose token reviews accept the "good" token, and whose subject access reviews
+// only allow the "admin" user. The reviews made through it are recorded.
+func newAuthTestClient() (*fake.Clientset, *[]authorizationv1.ResourceAttributes, *int) {
+	c := fake.NewSimpleClientset()
+	var (
+		sars         []authorizationv1.ResourceAttributes
+		tokenReviews int
+	)
+	c.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		tokenReviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "good" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "admin", Groups: []string{"system:masters"}}
+		}
+		return true, review, nil
+	})
+	c.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		sars = append(sars, *review.Spec.ResourceAttributes)
+		review.Status.Allowed = review.Spec.User == "admin"
+		if !review.Status.Allowed {
+			review.Status.Reason = "not an admin"
+		}
+		return true, review, nil
+	})
+	return c, &sars, &tokenReviews
+}
+
+func TestAuthHandler(t *testing.T) {
+	c, sars, tokenReviews := newAuthTestClient()
+
+	var served *UserInfo
+	h, err := AuthHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		served, _ = UserFrom(req.Context())
+	}), AuthConfig{
+		NodeName:       "vk",
+		Authenticator:  UnionAuthenticator{NewTokenReviewAuthenticator(c.AuthenticationV1().TokenReviews(), 0)},
+		AllowAnonymous: true,
+		Authorizer:     NewSubjectAccessReviewAuthorizer(c.AuthorizationV1().SubjectAccessReviews(), 0, 0),
+	})
+	assert.NilError(t, err)
+
+	do := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	served = nil
+	assert.Check(t, is.Equal(do(http.MethodPost, "/exec/default/pod/container", "good"), http.StatusOK))
+	assert.Assert(t, served != nil)
+	assert.Check(t, is.Equal(served.Name, "admin"))
+
+	assert.Check(t, is.Equal(do(http.MethodGet, "/containerLogs/default/pod/container", "good"), http.StatusOK))
+	assert.Check(t, is.Equal(do(http.MethodGet, "/stats/summary", "good"), http.StatusOK))
+	assert.Check(t, is.Equal(do(http.MethodGet, "/logs/", "good"), http.StatusOK))
+	assert.Check(t, is.Equal(do(http.MethodGet, "/stats/summary", "good"), http.StatusOK))
+	assert.Check(t, is.Equal(*tokenReviews, 1), "token reviews must be cached")
+	assert.Check(t, is.DeepEqual(*sars, []authorizationv1.ResourceAttributes{
+		{Verb: "create", Version: "v1", Resource: "nodes", Subresource: "proxy", Name: "vk"},
+		{Verb: "get", Version: "v1", Resource: "nodes", Subresource: "proxy", Name: "vk"},
+		{Verb: "get", Version: "v1", Resource: "nodes", Subresource: "stats", Name: "vk"},
+		{Verb: "get", Version: "v1", Resource: "nodes", Subresource: "log", Name: "vk"},
+	}), "subject access reviews must be cached")
+
+	assert.Check(t, is.Equal(do(http.MethodGet, "/runningpods/", "bad"), http.StatusUnauthorized))
+	assert.Check(t, is.Equal(do(http.MethodGet, "/runningpods/", ""), http.StatusForbidden))
+	assert.Check(t, is.Equal((*sars)[len(*sars)-1].Subresource, "proxy"))
+}
+
+func TestAuthHandlerAnonymous(t *testing.T) {
+	h, err := AuthHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), AuthConfig{NodeName: "vk"})
+	assert.NilError(t, err)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/runningpods/", nil))
+	assert.Check(t, is.Equal(w.Code, http.StatusUnauthorized))
+
+	_, err = AuthHandler(h, AuthConfig{})
+	assert.Check(t, is.ErrorContains(err, "missing node name"))
+}
+
+func TestRequestAuthorizationAttributes(t *testing.T) {
+	for _, tc := range []struct {
+		method      string
+		path        string
+		verb        string
+		subresource string
+	}{
+		{method: http.MethodGet, path: "/stats", verb: "get", subresource: "stats"},
+		{method: http.MethodGet, path: "/stats/summary", verb: "get", subresource: "stats"},
+		{method: http.MethodGet, path: "/statsz", verb: "get", subresource: "proxy"},
+		{method: http.MethodHead, path: "/metrics", verb: "get", subresource: "metrics"},
+		{method: http.MethodGet, path: "/logs/syslog", verb: "get", subresource: "log"},
+		{method: http.MethodGet, path: "/spec/", verb: "get", subresource: "spec"},
+		{method: http.MethodPost, path: "/exec/ns/pod/c", verb: "create", subresource: "proxy"},
+		{method: http.MethodGet, path: "/containerLogs/ns/pod/c", verb: "get", subresource: "proxy"},
+		{method: http.MethodDelete, path: "/runningpods/", verb: "delete", subresource: "proxy"},
+	} {
+		attrs := requestAuthorizationAttributes(httptest.NewRequest(tc.method, tc.path, nil), &anonymousUser, "vk")
+		assert.Check(t, is.Equal(attrs.Verb, tc.verb), tc.path)
+		assert.Check(t, is.Equal(attrs.Subresource, tc.subresource), tc.path)
+		assert.Check(t, is.Equal(attrs.NodeName, "vk"), tc.path)
+	}
+}
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	return cert, key
+}
+
+func TestX509Authenticator(t *testing.T) {
+	now := time.Now()
+	ca, caKey := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	newClientCert := func(usage x509.ExtKeyUsage) *x509.Certificate {
+		cert, _ := newTestCertificate(t, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "apiserver", Organization: []string{"system:masters"}},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}, ca, caKey)
+		return cert
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	a := NewX509Authenticator(roots)
+
+	req := httptest.NewRequest(http.MethodGet, "/runningpods/", nil)
+	_, ok, err := a.AuthenticateRequest(req)
+	assert.NilError(t, err)
+	assert.Check(t, !ok, "requests without client certificates must be left to other authenticators")
+
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{newClientCert(x509.ExtKeyUsageClientAuth)}}
+	user, ok, err := a.AuthenticateRequest(req)
+	assert.NilError(t, err)
+	assert.Check(t, ok)
+	assert.Check(t, is.DeepEqual(user, &UserInfo{Name: "apiserver", Groups: []string{"system:masters"}}))
+
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{newClientCert(x509.ExtKeyUsageServerAuth)}}
+	_, _, err = a.AuthenticateRequest(req)
+	assert.Check(t, is.ErrorContains(err, "error verifying client certificate"))
+
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{ca}}
+	_, _, err = NewX509Authenticator(x509.NewCertPool()).AuthenticateRequest(req)
+	assert.Check(t, is.ErrorContains(err, "error verifying client certificate"))
+}
@@ -15,8 +15,10 @@
 package api
 
 import (
+	"bufio"
 	"context"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -34,6 +36,10 @@ import (
 // container in a pod.
 type ContainerExecHandlerFunc func(ctx context.Context, namespace, podName, containerName string, cmd []string, attach AttachIO) error
 
+// ContainerAttachHandlerFunc defines the handler function used for attaching to
+// the main process of a container in a pod.
+type ContainerAttachHandlerFunc func(ctx context.Context, namespace, podName, containerName string, attach AttachIO) error
+
 // AttachIO is used to pass in streams to attach to a container process
 type AttachIO interface {
 	Stdin() io.Reader
@@ -59,6 +65,10 @@ type ContainerExecHandlerConfig struct {
 	StreamIdleTimeout time.Duration
 	// StreamCreationTimeout is the maximum time for streaming connection
 	StreamCreationTimeout time.Duration
+	// AuditSink records the sessions once they end, if set.
+	AuditSink ExecAuditSink
+	// RecordTranscripts records the terminal of the sessions which have a TTY in the audit sink.
+	RecordTranscripts bool
 }
 
 // ContainerExecHandlerOption configures a ContainerExecHandlerConfig
@@ -79,7 +89,40 @@ func WithExecStreamCreationTimeout(dur time.Duration) ContainerExecHandlerOption
 	}
 }
 
+// WithExecAuditSink sets the sink recording the exec sessions
+func WithExecAuditSink(sink ExecAuditSink) ContainerExecHandlerOption {
+	return func(cfg *ContainerExecHandlerConfig) {
+		cfg.AuditSink = sink
+	}
+}
+
+// WithExecTranscripts makes the audit sink record the terminal of the exec sessions which have a TTY, e.g. for
+// compliance. Transcripts may contain secrets typed by users, so they should be stored accordingly.
+func WithExecTranscripts(record bool) ContainerExecHandlerOption {
+	return func(cfg *ContainerExecHandlerConfig) {
+		cfg.RecordTranscripts = record
+	}
+}
+
+// newAuditor creates the auditor of the sessions of a request.
+func (cfg *ContainerExecHandlerConfig) newAuditor(req *http.Request, namespace, pod, container string) *execAuditor {
+	a := &execAuditor{
+		sink:        cfg.AuditSink,
+		transcripts: cfg.RecordTranscripts,
+		session:     ExecSession{Namespace: namespace, Pod: pod, Container: container},
+	}
+	if user, ok := UserFrom(req.Context()); ok {
+		a.session.User = user
+	}
+	return a
+}
+
 // HandleContainerExec makes an http handler func from a Provider which execs a command in a pod's container
+//
+// The context passed to the provider is derived from the request, so it carries its logger and trace, and it is
+// cancelled once the streaming connection is closed, e.g. when the client disconnects or the stream idle timeout
+// expires.
+//
 // Note that this handler currently depends on gorrilla/mux to get url parts as variables.
 // TODO(@cpuguy83): don't force gorilla/mux on consumers of this function
 func HandleContainerExec(h ContainerExecHandlerFunc, opts ...ContainerExecHandlerOption) http.HandlerFunc {
@@ -108,12 +151,19 @@ func HandleContainerExec(h ContainerExecHandlerFunc, opts ...ContainerExecHandle
 			return errdefs.AsInvalidInput(err)
 		}
 
-		ctx, cancel := context.WithCancel(context.TODO())
+		ctx, cancel := context.WithCancel(req.Context())
 		defer cancel()
 
-		exec := &containerExecContext{ctx: ctx, h: h, pod: pod, namespace: namespace, container: container}
+		exec := &containerExecContext{
+			ctx:       ctx,
+			h:         h,
+			pod:       pod,
+			namespace: namespace,
+			container: container,
+			auditor:   cfg.newAuditor(req, namespace, pod, container),
+		}
 		remotecommand.ServeExec(
-			w,
+			cancelOnClose(w, cancel),
 			req,
 			exec,
 			"",
@@ -130,6 +180,60 @@ func HandleContainerExec(h ContainerExecHandlerFunc, opts ...ContainerExecHandle
 	})
 }
 
+// HandleContainerAttach makes an http handler func from a Provider which attaches to the main process of a pod's
+// container, as done by "kubectl attach".
+// Options are shared with HandleContainerExec.
+// Note that this handler currently depends on gorrilla/mux to get url parts as variables.
+func HandleContainerAttach(h ContainerAttachHandlerFunc, opts ...ContainerExecHandlerOption) http.HandlerFunc {
+	if h == nil {
+		return NotImplemented
+	}
+
+	var cfg ContainerExecHandlerConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+	return handleError(func(w http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+
+		namespace := vars["namespace"]
+		pod := vars["pod"]
+		container := vars["container"]
+
+		supportedStreamProtocols := strings.Split(req.Header.Get("X-Stream-Protocol-Version"), ",")
+
+		streamOpts, err := getExecOptions(req)
+		if err != nil {
+			return errdefs.AsInvalidInput(err)
+		}
+
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+
+		attach := &containerAttachContext{
+			ctx:       ctx,
+			h:         h,
+			pod:       pod,
+			namespace: namespace,
+			auditor:   cfg.newAuditor(req, namespace, pod, container),
+		}
+		remotecommand.ServeAttach(
+			cancelOnClose(w, cancel),
+			req,
+			attach,
+			"",
+			"",
+			container,
+			streamOpts,
+			cfg.StreamIdleTimeout,
+			cfg.StreamCreationTimeout,
+			supportedStreamProtocols,
+		)
+
+		return nil
+	})
+}
+
 func getExecOptions(req *http.Request) (*remotecommand.Options, error) {
 	tty := req.FormValue(api.ExecTTYParam) == "1"
 	stdin := req.FormValue(api.ExecStdinParam) == "1"
@@ -155,12 +259,76 @@ type containerExecContext struct {
 	h                         ContainerExecHandlerFunc
 	namespace, pod, container string
 	ctx                       context.Context
+	auditor                   *execAuditor
 }
 
 // ExecInContainer Implements remotecommand.Executor
 // This is called by remotecommand.ServeExec
 func (c *containerExecContext) ExecInContainer(name string, uid types.UID, container string, cmd []string, in io.Reader, out, err io.WriteCloser, tty bool, resize <-chan remoteutils.TerminalSize, timeout time.Duration) error {
 
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	eio := newExecIO(ctx, in, out, err, tty, resize)
+	return c.auditor.run(ctx, cmd, eio, func(attach AttachIO) error {
+		return c.h(ctx, c.namespace, c.pod, c.container, cmd, attach)
+	})
+}
+
+type containerAttachContext struct {
+	h              ContainerAttachHandlerFunc
+	namespace, pod string
+	ctx            context.Context
+	auditor        *execAuditor
+}
+
+// AttachContainer Implements remotecommand.Attacher
+// This is called by remotecommand.ServeAttach
+func (c *containerAttachContext) AttachContainer(name string, uid types.UID, container string, in io.Reader, out, err io.WriteCloser, tty bool, resize <-chan remoteutils.TerminalSize) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	eio := newExecIO(ctx, in, out, err, tty, resize)
+	return c.auditor.run(ctx, nil, eio, func(attach AttachIO) error {
+		return c.h(ctx, c.namespace, c.pod, container, attach)
+	})
+}
+
+// cancelOnClose wraps the response writer of a streaming request, so that cancel is called once the connection
+// hijacked by the stream protocol is closed.
+func cancelOnClose(w http.ResponseWriter, cancel context.CancelFunc) http.ResponseWriter {
+	if _, ok := w.(http.Hijacker); !ok {
+		return w
+	}
+	return &cancelOnCloseWriter{ResponseWriter: w, cancel: cancel}
+}
+
+type cancelOnCloseWriter struct {
+	http.ResponseWriter
+	cancel context.CancelFunc
+}
+
+func (w *cancelOnCloseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cancelOnCloseConn{Conn: conn, cancel: w.cancel}, rw, nil
+}
+
+type cancelOnCloseConn struct {
+	net.Conn
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnCloseConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// newExecIO creates the streams passed to the provider. With a tty, the resize events of the client are forwarded
+// until ctx is done.
+func newExecIO(ctx context.Context, in io.Reader, out, err io.WriteCloser, tty bool, resize <-chan remoteutils.TerminalSize) *execIO {
 	eio := &execIO{
 		tty:    tty,
 		stdin:  in,
@@ -170,12 +338,6 @@ func (c *containerExecContext) ExecInContainer(name string, uid types.UID, conta
 
 	if tty {
 		eio.chResize = make(chan TermSize)
-	}
-
-	ctx, cancel := context.WithCancel(c.ctx)
-	defer cancel()
-
-	if tty {
 		go func() {
 			send := func(s remoteutils.TerminalSize) bool {
 				select {
@@ -199,7 +361,7 @@ func (c *containerExecContext) ExecInContainer(name string, uid types.UID, conta
 		}()
 	}
 
-	return c.h(c.ctx, c.namespace, c.pod, c.container, cmd, eio)
+	return eio
 }
 
 type execIO struct {
@@ -26,6 +26,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"k8s.io/apiserver/pkg/util/wsstream"
 )
 
 // ContainerLogsHandlerFunc is used in place of backend implementations for getting container logs
@@ -102,6 +103,9 @@ func parseLogOptions(q url.Values) (opts ContainerLogOpts, err error) {
 }
 
 // HandleContainerLogs creates an http handler function from a provider to serve logs from a pod
+//
+// Logs are streamed over a WebSocket when the request is a WebSocket upgrade, using the "binary.k8s.io" or
+// "base64.binary.k8s.io" subprotocols as done by the API server, so that browser-based consoles can follow them.
 func HandleContainerLogs(h ContainerLogsHandlerFunc) http.HandlerFunc {
 	if h == nil {
 		return NotImplemented
@@ -131,6 +135,14 @@ func HandleContainerLogs(h ContainerLogsHandlerFunc) http.HandlerFunc {
 
 		defer logs.Close()
 
+		if wsstream.IsWebSocketRequest(req) {
+			r := wsstream.NewReader(logs, true, wsstream.NewDefaultReaderProtocols())
+			if err := r.Copy(w, req); err != nil {
+				log.G(ctx).WithError(err).Debug("Error streaming logs over websocket")
+			}
+			return nil
+		}
+
 		req.Header.Set("Transfer-Encoding", "chunked")
 
 		if _, ok := w.(writeFlusher); !ok {
@@ -0,0 +1,91 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/kubernetes/pkg/kubelet/server/portforward"
+)
+
+// PortForwardHandlerFunc defines the handler function used for forwarding a
+// port of a pod.
+//
+// The stream carries the data of a single connection to the port, it is
+// called once for each connection made by the client. The stream is closed
+// by the caller once the handler returns.
+type PortForwardHandlerFunc func(ctx context.Context, namespace, podName string, port int32, stream io.ReadWriteCloser) error
+
+// HandlePortForward makes an http handler func from a Provider which forwards connections to the ports of a pod,
+// as done by "kubectl port-forward".
+// Options are shared with HandleContainerExec, except for auditing which only applies to exec and attach sessions.
+// Like for exec, the context passed to the provider is cancelled once the streaming connection is closed.
+// Note that this handler currently depends on gorrilla/mux to get url parts as variables.
+func HandlePortForward(h PortForwardHandlerFunc, opts ...ContainerExecHandlerOption) http.HandlerFunc {
+	if h == nil {
+		return NotImplemented
+	}
+
+	var cfg ContainerExecHandlerConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+	return handleError(func(w http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+
+		namespace := vars["namespace"]
+		pod := vars["pod"]
+
+		portForwardOpts, err := portforward.NewV4Options(req)
+		if err != nil {
+			return errdefs.AsInvalidInput(err)
+		}
+
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+
+		pf := &portForwardContext{ctx: ctx, h: h, namespace: namespace, pod: pod}
+		portforward.ServePortForward(
+			cancelOnClose(w, cancel),
+			req,
+			pf,
+			pod,
+			"",
+			portForwardOpts,
+			cfg.StreamIdleTimeout,
+			cfg.StreamCreationTimeout,
+			portforward.SupportedProtocols,
+		)
+
+		return nil
+	})
+}
+
+type portForwardContext struct {
+	h              PortForwardHandlerFunc
+	namespace, pod string
+	ctx            context.Context
+}
+
+// PortForward Implements portforward.PortForwarder
+// This is called by portforward.ServePortForward
+func (c *portForwardContext) PortForward(name string, uid types.UID, port int32, stream io.ReadWriteCloser) error {
+	return c.h(c.ctx, c.namespace, c.pod, port, stream)
+}
@@ -36,12 +36,20 @@ type ServeMux interface {
 type PodHandlerConfig struct {
 	RunInContainer   ContainerExecHandlerFunc
 	GetContainerLogs ContainerLogsHandlerFunc
+	// AttachToContainer is optional, attach requests are answered with http.StatusNotImplemented if it is not set
+	AttachToContainer ContainerAttachHandlerFunc
+	// PortForward is optional, port forward requests are answered with http.StatusNotImplemented if it is not set
+	PortForward PortForwardHandlerFunc
 	// GetPods is meant to enumerate the pods that the provider knows about
 	GetPods PodListerFunc
 	// GetPodsFromKubernetes is meant to enumerate the pods that the node is meant to be running
 	GetPodsFromKubernetes PodListerFunc
 	StreamIdleTimeout     time.Duration
 	StreamCreationTimeout time.Duration
+	// ExecAuditSink is optional, it records the exec and attach sessions if set
+	ExecAuditSink ExecAuditSink
+	// RecordExecTranscripts records the terminal of the exec and attach sessions in ExecAuditSink
+	RecordExecTranscripts bool
 }
 
 // PodHandler creates an http handler for interacting with pods/containers.
@@ -62,6 +70,26 @@ func PodHandler(p PodHandlerConfig, debug bool) http.Handler {
 			p.RunInContainer,
 			WithExecStreamCreationTimeout(p.StreamCreationTimeout),
 			WithExecStreamIdleTimeout(p.StreamIdleTimeout),
+			WithExecAuditSink(p.ExecAuditSink),
+			WithExecTranscripts(p.RecordExecTranscripts),
+		),
+	).Methods("POST", "GET")
+	r.HandleFunc(
+		"/attach/{namespace}/{pod}/{container}",
+		HandleContainerAttach(
+			p.AttachToContainer,
+			WithExecStreamCreationTimeout(p.StreamCreationTimeout),
+			WithExecStreamIdleTimeout(p.StreamIdleTimeout),
+			WithExecAuditSink(p.ExecAuditSink),
+			WithExecTranscripts(p.RecordExecTranscripts),
+		),
+	).Methods("POST", "GET")
+	r.HandleFunc(
+		"/portForward/{namespace}/{pod}",
+		HandlePortForward(
+			p.PortForward,
+			WithExecStreamCreationTimeout(p.StreamCreationTimeout),
+			WithExecStreamIdleTimeout(p.StreamIdleTimeout),
 		),
 	).Methods("POST", "GET")
 	r.NotFoundHandler = http.HandlerFunc(NotFound)
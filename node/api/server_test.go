@@ -0,0 +1,27 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestPodHandlerOptionalRoutes(t *testing.T) {
+	h := PodHandler(PodHandlerConfig{}, false)
+
+	for _, path := range []string{
+		"/attach/default/pod/container",
+		"/portForward/default/pod",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		assert.Check(t, is.Equal(w.Code, http.StatusNotImplemented), path)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/portForward/default", nil))
+	assert.Check(t, is.Equal(w.Code, http.StatusNotFound))
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func dialTestWebSocket(t *testing.T, s *httptest.Server, path, protocol string) *websocket.Conn {
+	cfg, err := websocket.NewConfig("ws"+strings.TrimPrefix(s.URL, "http")+path, s.URL)
+	assert.NilError(t, err)
+	cfg.Protocol = []string{protocol}
+	ws, err := websocket.DialConfig(cfg)
+	assert.NilError(t, err)
+	ws.SetDeadline(time.Now().Add(10 * time.Second)) //nolint:errcheck
+	return ws
+}
+
+func TestContainerAttachWebSocket(t *testing.T) {
+	s := httptest.NewServer(PodHandler(PodHandlerConfig{
+		AttachToContainer: func(ctx context.Context, namespace, podName, containerName string, attach AttachIO) error {
+			size := <-attach.Resize()
+			_, err := fmt.Fprintf(attach.Stdout(), "%s/%s/%s tty=%t %dx%d", namespace, podName, containerName, attach.TTY(), size.Width, size.Height)
+			return err
+		},
+	}, false))
+	defer s.Close()
+
+	ws := dialTestWebSocket(t, s, "/attach/default/pod/container?tty=1&stdout=1", "v4.channel.k8s.io")
+	defer ws.Close()
+
+	// The first byte of each message is the channel: 1 is stdout, 4 is resize.
+	assert.NilError(t, websocket.Message.Send(ws, append([]byte{4}, `{"Width":80,"Height":24}`...)))
+
+	var stdout string
+	for stdout == "" {
+		var msg []byte
+		assert.NilError(t, websocket.Message.Receive(ws, &msg))
+		if len(msg) > 1 && msg[0] == 1 {
+			stdout = string(msg[1:])
+		}
+	}
+	assert.Check(t, is.Equal(stdout, "default/pod/container tty=true 80x24"))
+}
+
+func TestPortForwardWebSocket(t *testing.T) {
+	s := httptest.NewServer(PodHandler(PodHandlerConfig{
+		PortForward: func(ctx context.Context, namespace, podName string, port int32, stream io.ReadWriteCloser) error {
+			_, err := fmt.Fprintf(stream, "%s/%s:%d", namespace, podName, port)
+			return err
+		},
+	}, false))
+	defer s.Close()
+
+	ws := dialTestWebSocket(t, s, "/portForward/default/pod?port=8080", "v4.channel.k8s.io")
+	defer ws.Close()
+
+	// Each port has a data and an error channel (0 and 1 for the first port). The first message on each of them is
+	// the port number, as a little-endian uint16.
+	var port uint16
+	var data string
+	for data == "" {
+		var msg []byte
+		assert.NilError(t, websocket.Message.Receive(ws, &msg))
+		if len(msg) < 1 || msg[0] != 0 {
+			continue
+		}
+		if port == 0 {
+			assert.Assert(t, is.Len(msg, 3))
+			port = binary.LittleEndian.Uint16(msg[1:])
+			continue
+		}
+		data = string(msg[1:])
+	}
+	assert.Check(t, is.Equal(port, uint16(8080)))
+	assert.Check(t, is.Equal(data, "default/pod:8080"))
+}
+
+func TestContainerLogsWebSocket(t *testing.T) {
+	s := httptest.NewServer(PodHandler(PodHandlerConfig{
+		GetContainerLogs: func(ctx context.Context, namespace, podName, containerName string, opts ContainerLogOpts) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(fmt.Sprintf("%s/%s/%s follow=%t", namespace, podName, containerName, opts.Follow))), nil
+		},
+	}, false))
+	defer s.Close()
+
+	ws := dialTestWebSocket(t, s, "/containerLogs/default/pod/container?follow=true", "binary.k8s.io")
+	defer ws.Close()
+
+	var logs []byte
+	assert.NilError(t, websocket.Message.Receive(ws, &logs))
+	assert.Check(t, is.Equal(string(logs), "default/pod/container follow=true"))
+}
+
+func TestContainerExecCancelledOnClose(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	s := httptest.NewServer(PodHandler(PodHandlerConfig{
+		RunInContainer: func(ctx context.Context, namespace, podName, containerName string, cmd []string, attach AttachIO) error {
+			close(started)
+			<-ctx.Done()
+			close(cancelled)
+			return ctx.Err()
+		},
+	}, false))
+	defer s.Close()
+
+	ws := dialTestWebSocket(t, s, "/exec/default/pod/container?command=sh&stdout=1", "v4.channel.k8s.io")
+	<-started
+	assert.NilError(t, ws.Close())
+
+	select {
+	case <-cancelled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the exec context must be cancelled once the client disconnects")
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DefaultCircuitBreakerFailureThreshold is the default number of consecutive failed provider calls after which
+	// the circuit breaker trips.
+	DefaultCircuitBreakerFailureThreshold = 5
+	// DefaultCircuitBreakerRecoveryBackOff is the default initial delay between the probes of the provider while the
+	// circuit breaker is open.
+	DefaultCircuitBreakerRecoveryBackOff = time.Second
+	// DefaultCircuitBreakerRecoveryMaxBackOff is the default maximum delay between the probes of the provider while
+	// the circuit breaker is open.
+	DefaultCircuitBreakerRecoveryMaxBackOff = time.Minute
+
+	nodeConditionReasonProviderUnavailable = "ProviderUnavailable"
+)
+
+// errCircuitOpen is returned instead of calling the provider while the circuit breaker is open.
+var errCircuitOpen = pkgerrors.New("the provider is unavailable: circuit breaker is open")
+
+// CircuitBreakerConfig is used to configure a new CircuitBreaker.
+type CircuitBreakerConfig struct {
+	// PodProvider is the pod provider probed while the circuit breaker is open, by listing its pods, to decide when
+	// it recovers. It must be the provider itself rather than the handler instrumented with the circuit breaker, whose
+	// calls fail right away while it is open.
+	// This field is required.
+	PodProvider PodLifecycleHandler
+
+	// NodeProvider is the node provider wrapped by the circuit breaker.
+	// If unset, NaiveNodeProvider is used.
+	NodeProvider NodeProvider
+
+	// GetNode returns the node whose status is updated when the circuit breaker trips and recovers, typically
+	// NodeController.Node.
+	// This field is required.
+	GetNode func() *corev1.Node
+
+	// FailureThreshold is the number of consecutive failed provider calls after which the circuit breaker trips.
+	// If unset, DefaultCircuitBreakerFailureThreshold is used.
+	FailureThreshold int
+
+	// RecoveryBackOff is the initial delay between the probes of the provider while the circuit breaker is open. The
+	// delay doubles after each failed probe, up to RecoveryMaxBackOff.
+	// If unset, DefaultCircuitBreakerRecoveryBackOff and DefaultCircuitBreakerRecoveryMaxBackOff are used.
+	RecoveryBackOff    time.Duration
+	RecoveryMaxBackOff time.Duration
+}
+
+// CircuitBreaker stops the pod controller from calling the provider while it is unavailable.
+//
+// The circuit breaker trips once a number of consecutive calls to the provider have failed. While it is open, the
+// pod controller stops processing its work queues, calls to the provider fail right away, and the node is reported as
+// NotReady (which in turn causes Kubernetes to taint it with node.kubernetes.io/not-ready:NoExecute, so that its pods
+// are evicted after their toleration period). While it is open, the circuit breaker probes the provider with an
+// exponential back-off, by pinging the node provider and listing the pods of the pod provider, and recovers as soon
+// as both succeed again. The node provider alone does not decide recovery, as most node providers (such as
+// NaiveNodeProvider) always respond to pings.
+//
+// Errors which do not mean that the provider is unavailable, such as not found or invalid input errors, do not count
+// as failures.
+//
+// CircuitBreaker implements NodeProvider, wrapping the node provider of the node: it must be passed to the
+// NodeController, as well as to the PodController through PodControllerConfig.CircuitBreaker. Run must be called for
+// the node status to be updated, and for the provider to be probed while the circuit breaker is open.
+type CircuitBreaker struct {
+	pods               PodLifecycleHandler
+	p                  NodeProvider
+	getNode            func() *corev1.Node
+	threshold          int
+	recoveryBackOff    time.Duration
+	recoveryMaxBackOff time.Duration
+
+	mu       sync.Mutex
+	failures int
+	lastErr  error
+	// recovered is closed when the circuit breaker recovers. It is nil while the circuit breaker is closed.
+	recovered chan struct{}
+	// ready is the Ready condition of the node before the circuit breaker tripped, or the last one reported by the
+	// wrapped node provider since.
+	ready *corev1.NodeCondition
+	// nodeStatus is the callback passed to NotifyNodeStatus.
+	nodeStatus func(*corev1.Node)
+	// changed is signalled when the circuit breaker trips or recovers.
+	changed chan struct{}
+}
+
+// NewCircuitBreaker creates a new circuit breaker.
+func NewCircuitBreaker(cfg CircuitBreakerConfig) (*CircuitBreaker, error) {
+	if cfg.PodProvider == nil {
+		return nil, errdefs.InvalidInput("missing pod provider")
+	}
+	if cfg.GetNode == nil {
+		return nil, errdefs.InvalidInput("missing node getter")
+	}
+	if cfg.FailureThreshold < 0 {
+		return nil, errdefs.InvalidInput("failure threshold cannot be negative")
+	}
+	if cfg.RecoveryBackOff < 0 || cfg.RecoveryMaxBackOff < 0 {
+		return nil, errdefs.InvalidInput("recovery back-off cannot be negative")
+	}
+	if cfg.NodeProvider == nil {
+		cfg.NodeProvider = NaiveNodeProvider{}
+	}
+	if cfg.FailureThreshold == 0 {
+		cfg.FailureThreshold = DefaultCircuitBreakerFailureThreshold
+	}
+	if cfg.RecoveryBackOff == 0 {
+		cfg.RecoveryBackOff = DefaultCircuitBreakerRecoveryBackOff
+	}
+	if cfg.RecoveryMaxBackOff == 0 {
+		cfg.RecoveryMaxBackOff = DefaultCircuitBreakerRecoveryMaxBackOff
+	}
+
+	return &CircuitBreaker{
+		pods:               cfg.PodProvider,
+		p:                  cfg.NodeProvider,
+		getNode:            cfg.GetNode,
+		threshold:          cfg.FailureThreshold,
+		recoveryBackOff:    cfg.RecoveryBackOff,
+		recoveryMaxBackOff: cfg.RecoveryMaxBackOff,
+		changed:            make(chan struct{}, 1),
+	}, nil
+}
+
+// Ping pings the wrapped node provider.
+func (b *CircuitBreaker) Ping(ctx context.Context) error {
+	return b.p.Ping(ctx)
+}
+
+// NotifyNodeStatus passes the node status updates of the wrapped node provider on to the callback, with the node
+// reported as NotReady while the circuit breaker is open.
+func (b *CircuitBreaker) NotifyNodeStatus(ctx context.Context, cb func(*corev1.Node)) {
+	b.mu.Lock()
+	b.nodeStatus = cb
+	b.mu.Unlock()
+
+	b.p.NotifyNodeStatus(ctx, func(node *corev1.Node) {
+		b.mu.Lock()
+		if b.recovered != nil {
+			node = node.DeepCopy()
+			if c := findNodeCondition(&node.Status, corev1.NodeReady); c != nil {
+				b.ready = c.DeepCopy()
+			}
+			b.setNotReady(&node.Status)
+		}
+		b.mu.Unlock()
+		cb(node)
+	})
+}
+
+// Open returns whether the circuit breaker is open.
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.recovered != nil
+}
+
+// Run updates the status of the node when the circuit breaker trips or recovers, and probes the provider while it is
+// open, until the context is cancelled.
+func (b *CircuitBreaker) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	var backOff time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.changed:
+			b.notifyNodeStatus(ctx)
+			if b.Open() && backOff == 0 {
+				backOff = b.recoveryBackOff
+				timer.Reset(backOff)
+			}
+		case <-timer.C:
+			if err := b.probe(ctx); err != nil {
+				log.G(ctx).WithError(err).Debug("Provider is still unavailable")
+			}
+			if !b.Open() {
+				backOff = 0
+				continue
+			}
+			backOff *= 2
+			if backOff > b.recoveryMaxBackOff {
+				backOff = b.recoveryMaxBackOff
+			}
+			timer.Reset(backOff)
+		}
+	}
+}
+
+// record records the result of a call to the provider, and trips the circuit breaker once the failure threshold is
+// reached. It is a no-op on a nil circuit breaker.
+func (b *CircuitBreaker) record(ctx context.Context, err error) {
+	if b == nil {
+		return
+	}
+	failed := err != nil && err != errCircuitOpen && !errdefs.IsNotFound(err) && !errdefs.IsInvalidInput(err) &&
+		pkgerrors.Cause(err) != context.Canceled
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	if b.failures < b.threshold || b.recovered != nil {
+		return
+	}
+
+	log.G(ctx).WithError(err).Warnf("Provider failed %d consecutive calls, tripping circuit breaker", b.failures)
+	b.recovered = make(chan struct{})
+	// The Ready condition may not have been restored yet if the circuit breaker recovered only just now.
+	if node := b.getNode(); node != nil && b.ready == nil {
+		if c := findNodeCondition(&node.Status, corev1.NodeReady); c != nil {
+			b.ready = c.DeepCopy()
+		}
+	}
+	b.signal()
+}
+
+// probe checks whether the provider is available again, by pinging the node provider and listing the pods of the
+// pod provider, and closes the circuit breaker if both succeed.
+func (b *CircuitBreaker) probe(ctx context.Context) error {
+	if err := b.p.Ping(ctx); err != nil {
+		return pkgerrors.Wrap(err, "error pinging node provider")
+	}
+	if _, err := b.pods.GetPods(ctx); err != nil {
+		return pkgerrors.Wrap(err, "error listing pods")
+	}
+	b.recover(ctx)
+	return nil
+}
+
+// recover closes the circuit breaker if it is open.
+func (b *CircuitBreaker) recover(ctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.recovered == nil {
+		return
+	}
+	log.G(ctx).Info("Provider is available again, closing circuit breaker")
+	close(b.recovered)
+	b.recovered = nil
+	b.failures = 0
+	b.lastErr = nil
+	b.signal()
+}
+
+// allow returns an error if calls to the provider must not be made because the circuit breaker is open. It always
+// allows calls on a nil circuit breaker.
+func (b *CircuitBreaker) allow() error {
+	if b == nil || !b.Open() {
+		return nil
+	}
+	return errCircuitOpen
+}
+
+// wait blocks while the circuit breaker is open. It returns false if the context is cancelled before the circuit
+// breaker recovers. It returns true right away on a nil circuit breaker.
+func (b *CircuitBreaker) wait(ctx context.Context) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	recovered := b.recovered
+	b.mu.Unlock()
+	if recovered == nil {
+		return true
+	}
+
+	log.G(ctx).Debug("Circuit breaker is open, waiting for the provider to recover")
+	select {
+	case <-ctx.Done():
+		return false
+	case <-recovered:
+		return true
+	}
+}
+
+// signal signals that the circuit breaker tripped or recovered. b.mu must be held.
+func (b *CircuitBreaker) signal() {
+	select {
+	case b.changed <- struct{}{}:
+	default:
+	}
+}
+
+// notifyNodeStatus reports the current status of the node to the NotifyNodeStatus callback.
+func (b *CircuitBreaker) notifyNodeStatus(ctx context.Context) {
+	b.mu.Lock()
+	cb := b.nodeStatus
+	node := b.getNode()
+	if cb == nil || node == nil {
+		b.mu.Unlock()
+		return
+	}
+	node = node.DeepCopy()
+	switch {
+	case b.recovered != nil:
+		b.setNotReady(&node.Status)
+	case b.ready != nil:
+		ready := *b.ready
+		ready.LastTransitionTime = metav1.Now()
+		setNodeCondition(&node.Status, ready)
+		b.ready = nil
+	default:
+		// The node had no Ready condition before the circuit breaker tripped.
+		removeNodeCondition(&node.Status, corev1.NodeReady)
+	}
+	b.mu.Unlock()
+
+	log.G(ctx).WithField("open", b.Open()).Debug("Updating node status after circuit breaker change")
+	cb(node)
+}
+
+// setNotReady sets the Ready condition of the node status to false. b.mu must be held.
+func (b *CircuitBreaker) setNotReady(status *corev1.NodeStatus) {
+	now := metav1.Now()
+	setNodeCondition(status, corev1.NodeCondition{
+		Type:               corev1.NodeReady,
+		Status:             corev1.ConditionFalse,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             nodeConditionReasonProviderUnavailable,
+		Message:            fmt.Sprintf("The provider is unavailable: %v", b.lastErr),
+	})
+}
+
+func findNodeCondition(status *corev1.NodeStatus, conditionType corev1.NodeConditionType) *corev1.NodeCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func removeNodeCondition(status *corev1.NodeStatus, conditionType corev1.NodeConditionType) {
+	conditions := status.Conditions[:0]
+	for _, c := range status.Conditions {
+		if c.Type != conditionType {
+			conditions = append(conditions, c)
+		}
+	}
+	status.Conditions = conditions
+}
+
+// setNodeCondition sets the given condition in the node status, keeping its transition time if its status is
+// unchanged.
+func setNodeCondition(status *corev1.NodeStatus, condition corev1.NodeCondition) {
+	c := findNodeCondition(status, condition.Type)
+	if c == nil {
+		status.Conditions = append(status.Conditions, condition)
+		return
+	}
+	if c.Status == condition.Status {
+		condition.LastTransitionTime = c.LastTransitionTime
+	}
+	*c = condition
+}
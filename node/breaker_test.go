@@ -0,0 +1,147 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// unavailablePodProvider is a pod provider whose calls to GetPods fail while it is unavailable.
+type unavailablePodProvider struct {
+	*mockProvider
+	mu  sync.Mutex
+	err error
+}
+
+func (p *unavailablePodProvider) setErr(err error) {
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+}
+
+func (p *unavailablePodProvider) GetPods(ctx context.Context) ([]*corev1.Pod, error) {
+	p.mu.Lock()
+	err := p.err
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return p.mockProvider.GetPods(ctx)
+}
+
+func newTestCircuitBreaker(t *testing.T, node *corev1.Node, p PodLifecycleHandler) *CircuitBreaker {
+	b, err := NewCircuitBreaker(CircuitBreakerConfig{
+		PodProvider:      p,
+		GetNode:          func() *corev1.Node { return node },
+		FailureThreshold: 2,
+		RecoveryBackOff:  time.Millisecond,
+	})
+	assert.NilError(t, err)
+	return b
+}
+
+func TestCircuitBreakerTrips(t *testing.T) {
+	ctx := context.Background()
+	p := &unavailablePodProvider{mockProvider: newSyncMockProvider()}
+	b := newTestCircuitBreaker(t, &corev1.Node{}, p)
+
+	b.record(ctx, errors.New("failed"))
+	b.record(ctx, nil)
+	b.record(ctx, errors.New("failed"))
+	assert.Check(t, !b.Open(), "a successful call must reset the failure count")
+
+	// Errors which do not mean that the provider is unavailable are not failures.
+	b.record(ctx, errdefs.NotFound("not found"))
+	b.record(ctx, errdefs.InvalidInput("invalid"))
+	b.record(ctx, context.Canceled)
+	assert.Check(t, !b.Open())
+
+	b.record(ctx, errors.New("failed"))
+	b.record(ctx, errors.New("failed"))
+	assert.Check(t, b.Open())
+	assert.Check(t, is.Equal(b.allow(), errCircuitOpen))
+
+	h := InstrumentPodLifecycleHandler(newSyncMockProvider(), WithCircuitBreaker(b))
+	_, err := h.GetPods(ctx)
+	assert.Check(t, is.Equal(err, errCircuitOpen))
+
+	waited := make(chan bool)
+	go func() {
+		waited <- b.wait(ctx)
+	}()
+	// The node provider responding to pings is not enough for the circuit breaker to recover.
+	p.setErr(errors.New("unavailable"))
+	assert.NilError(t, b.Ping(ctx))
+	assert.Check(t, is.ErrorContains(b.probe(ctx), "unavailable"))
+	assert.Check(t, b.Open())
+
+	p.setErr(nil)
+	assert.NilError(t, b.probe(ctx))
+	assert.Check(t, !b.Open())
+	assert.Check(t, <-waited)
+	assert.NilError(t, b.allow())
+}
+
+func TestCircuitBreakerWaitCancelled(t *testing.T) {
+	var b *CircuitBreaker
+	assert.Check(t, b.wait(context.Background()), "a nil circuit breaker must never block")
+	assert.NilError(t, b.allow())
+
+	b = newTestCircuitBreaker(t, &corev1.Node{}, newSyncMockProvider())
+	b.record(context.Background(), errors.New("failed"))
+	b.record(context.Background(), errors.New("failed"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Check(t, !b.wait(ctx))
+}
+
+func TestCircuitBreakerNodeStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ready := corev1.NodeCondition{Type: corev1.NodeReady, Status: corev1.ConditionTrue, Reason: "KubeletReady"}
+	node := &corev1.Node{Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{ready}}}
+	p := &unavailablePodProvider{mockProvider: newSyncMockProvider(), err: errors.New("unavailable")}
+	b := newTestCircuitBreaker(t, node, p)
+
+	updates := make(chan *corev1.Node, 1)
+	b.NotifyNodeStatus(ctx, func(n *corev1.Node) {
+		updates <- n
+	})
+	go b.Run(ctx)
+
+	b.record(ctx, errors.New("failed"))
+	b.record(ctx, errors.New("failed"))
+	n := <-updates
+	c := findNodeCondition(&n.Status, corev1.NodeReady)
+	assert.Assert(t, c != nil)
+	assert.Check(t, is.Equal(c.Status, corev1.ConditionFalse))
+	assert.Check(t, is.Equal(c.Reason, nodeConditionReasonProviderUnavailable))
+	assert.Check(t, is.Contains(c.Message, "failed"))
+	assert.Check(t, is.Equal(findNodeCondition(&node.Status, corev1.NodeReady).Status, corev1.ConditionTrue), "the node must not be mutated")
+
+	// The naive node provider always responds to pings, but the circuit breaker stays open while the pod provider is
+	// unavailable.
+	select {
+	case n = <-updates:
+		t.Fatalf("unexpected node status update while the pod provider is unavailable: %v", n.Status.Conditions)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Check(t, b.Open())
+
+	p.setErr(nil)
+	n = <-updates
+	c = findNodeCondition(&n.Status, corev1.NodeReady)
+	assert.Assert(t, c != nil)
+	assert.Check(t, is.Equal(c.Status, corev1.ConditionTrue))
+	assert.Check(t, is.Equal(c.Reason, ready.Reason))
+	assert.Check(t, !b.Open())
+}
@@ -57,7 +57,13 @@ depending on your configuration.
 For more fine-grained control over the API, see the `node/api` package which
 only implements the HTTP handlers that you can use in whatever way you want.
 
-This uses open-cenesus to implement tracing (but no internal metrics yet) which
-is propagated through the context. This is passed on even to the providers.
+This uses open-cenesus to implement tracing which is propagated through the
+context. This is passed on even to the providers.
+
+The controllers record Prometheus metrics, which are defined in the
+`node/metrics` package. They must be registered with a registry by the caller
+to be exposed, see `metrics.Register`. The metrics of the work queues are only
+recorded if `metrics.RegisterWorkqueueMetrics` is called before the
+controllers are created.
 */
 package node
@@ -0,0 +1,170 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// DefaultDrainTimeout is the default maximum duration for which DrainNode waits for the pods to terminate.
+	DefaultDrainTimeout = time.Minute
+	// DefaultDrainRetryPeriod is the default interval at which DrainNode retries evictions and checks the pods.
+	DefaultDrainRetryPeriod = 5 * time.Second
+
+	// nodeConditionReasonShutdown is the reason of the Ready condition of nodes which are shut down.
+	nodeConditionReasonShutdown = "KubeletShutdown"
+)
+
+// DrainConfig is used to configure how a node is drained, see DrainNode.
+type DrainConfig struct {
+	// Client is used to cordon the node, and to list and evict its pods.
+	// This field is required.
+	Client kubernetes.Interface
+	// NodeName is the name of the node to drain.
+	// This field is required.
+	NodeName string
+	// Namespace restricts the pods which are evicted to a namespace, such as the namespace watched by the pod
+	// controller. If unset, the pods of all namespaces are evicted.
+	Namespace string
+
+	// EvictPods makes DrainNode evict the pods of the node. Otherwise, the node is only cordoned.
+	EvictPods bool
+	// Timeout is the maximum duration for which DrainNode waits for the evicted pods to terminate.
+	// If unset, DefaultDrainTimeout is used.
+	Timeout time.Duration
+	// RetryPeriod is the interval at which evictions refused by the API server, e.g. because of a pod disruption
+	// budget, are retried, and at which the pods left on the node are checked.
+	// If unset, DefaultDrainRetryPeriod is used.
+	RetryPeriod time.Duration
+}
+
+// DrainNode cordons the node, so that no new pods are scheduled to it, and then evicts its pods if EvictPods is set,
+// as done by "kubectl drain".
+//
+// Pods are evicted through the eviction API, which respects their pod disruption budgets, and DrainNode waits for
+// them to be terminated. The pod controller must therefore keep running until DrainNode returns, so that the pods are
+// deleted from the provider. Pods managed by a DaemonSet and pods which have already terminated are left alone.
+//
+// An error is returned if pods are still left on the node once the timeout expires.
+func DrainNode(ctx context.Context, cfg DrainConfig) error {
+	if cfg.Client == nil {
+		return errdefs.InvalidInput("missing client")
+	}
+	if cfg.NodeName == "" {
+		return errdefs.InvalidInput("missing node name")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultDrainTimeout
+	}
+	if cfg.RetryPeriod == 0 {
+		cfg.RetryPeriod = DefaultDrainRetryPeriod
+	}
+
+	if _, err := cfg.Client.CoreV1().Nodes().Patch(cfg.NodeName, types.MergePatchType, []byte(`{"spec":{"unschedulable":true}}`)); err != nil {
+		return pkgerrors.Wrap(err, "error cordoning node")
+	}
+	log.G(ctx).Info("Cordoned node")
+
+	if !cfg.EvictPods {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(cfg.RetryPeriod)
+	defer ticker.Stop()
+
+	var pods []corev1.Pod
+	for {
+		var err error
+		pods, err = listPodsToDrain(cfg)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("Error listing the pods to drain")
+		} else {
+			if len(pods) == 0 {
+				log.G(ctx).Info("Drained node")
+				return nil
+			}
+			for i := range pods {
+				evictPod(ctx, cfg.Client, &pods[i])
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return pkgerrors.Wrapf(ctx.Err(), "%d pods were not terminated while draining node", len(pods))
+		case <-ticker.C:
+		}
+	}
+}
+
+// listPodsToDrain lists the pods of the node which must be evicted, or which are being terminated.
+func listPodsToDrain(cfg DrainConfig) ([]corev1.Pod, error) {
+	list, err := cfg.Client.CoreV1().Pods(cfg.Namespace).List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", cfg.NodeName).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pods := list.Items[:0]
+	for _, pod := range list.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		// DaemonSet pods tolerate the node being unschedulable, so they would be re-created right away.
+		if ref := metav1.GetControllerOf(&pod); ref != nil && ref.Kind == "DaemonSet" {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+// evictPod evicts the pod unless it is already being deleted. Evictions which fail are retried on the next attempt
+// by DrainNode, so errors are only logged.
+func evictPod(ctx context.Context, client kubernetes.Interface, pod *corev1.Pod) {
+	if pod.DeletionTimestamp != nil {
+		return
+	}
+
+	logger := log.G(ctx).WithField("pod", loggablePodName(pod))
+	err := client.PolicyV1beta1().Evictions(pod.Namespace).Evict(&policyv1beta1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+	})
+	switch {
+	case err == nil:
+		logger.Debug("Evicted pod")
+	case errors.IsNotFound(err):
+	case errors.IsTooManyRequests(err):
+		logger.WithError(err).Info("Pod cannot be evicted yet because of its disruption budget")
+	default:
+		logger.WithError(err).Warn("Error evicting pod")
+	}
+}
@@ -0,0 +1,109 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newDrainTestPod(name string, phase corev1.PodPhase, owner string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       corev1.PodSpec{NodeName: "vk"},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+	if owner != "" {
+		controller := true
+		pod.OwnerReferences = []metav1.OwnerReference{{Kind: owner, Name: "owner", Controller: &controller}}
+	}
+	return pod
+}
+
+func TestDrainNode(t *testing.T) {
+	c := testclient.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "vk"}},
+		newDrainTestPod("guarded", corev1.PodRunning, "ReplicaSet"),
+		newDrainTestPod("running", corev1.PodRunning, ""),
+		newDrainTestPod("daemon", corev1.PodRunning, "DaemonSet"),
+		newDrainTestPod("done", corev1.PodSucceeded, ""),
+	)
+
+	// Evictions delete the pods right away, except for the first eviction of the pod guarded by a disruption budget.
+	evictions := make(map[string]int)
+	c.PrependReactor("*", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		var name string
+		switch a := action.(type) {
+		case k8stesting.CreateAction:
+			name = a.GetObject().(*policyv1beta1.Eviction).Name
+		case k8stesting.GetAction:
+			name = a.GetName()
+		}
+		evictions[name]++
+		if name == "guarded" && evictions[name] == 1 {
+			return true, nil, errors.NewTooManyRequests("disruption budget", 0)
+		}
+		return true, nil, c.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("pods"), action.GetNamespace(), name)
+	})
+
+	err := DrainNode(context.Background(), DrainConfig{
+		Client:      c,
+		NodeName:    "vk",
+		EvictPods:   true,
+		RetryPeriod: time.Millisecond,
+	})
+	assert.NilError(t, err)
+
+	node, err := c.CoreV1().Nodes().Get("vk", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, node.Spec.Unschedulable)
+
+	assert.Check(t, is.DeepEqual(evictions, map[string]int{"guarded": 2, "running": 1}))
+	pods, err := c.CoreV1().Pods("default").List(metav1.ListOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(pods.Items, 2), "daemon set pods and terminated pods must be left alone")
+}
+
+func TestDrainNodeTimeout(t *testing.T) {
+	c := testclient.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "vk"}},
+		newDrainTestPod("stuck", corev1.PodRunning, ""),
+	)
+
+	// Without a reactor, evictions do not delete the pods.
+	err := DrainNode(context.Background(), DrainConfig{
+		Client:      c,
+		NodeName:    "vk",
+		EvictPods:   true,
+		Timeout:     10 * time.Millisecond,
+		RetryPeriod: time.Millisecond,
+	})
+	assert.Check(t, is.ErrorContains(err, "1 pods were not terminated"))
+}
+
+func TestDrainNodeCordonOnly(t *testing.T) {
+	c := testclient.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "vk"}},
+		newDrainTestPod("running", corev1.PodRunning, ""),
+	)
+
+	assert.NilError(t, DrainNode(context.Background(), DrainConfig{Client: c, NodeName: "vk"}))
+
+	node, err := c.CoreV1().Nodes().Get("vk", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, node.Spec.Unschedulable)
+	_, err = c.CoreV1().Pods("default").Get("running", metav1.GetOptions{})
+	assert.NilError(t, err)
+}
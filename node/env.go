@@ -17,11 +17,14 @@ package node
 import (
 	"context"
 	"fmt"
+	"math"
 	"sort"
+	"strconv"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
 	apivalidation "k8s.io/apimachinery/pkg/util/validation"
@@ -72,18 +75,21 @@ const (
 var masterServices = sets.NewString("kubernetes")
 
 // populateEnvironmentVariables populates the environment of each container (and init container) in the specified pod.
+// The node the pod is running on is used to resolve resource limits which are not set on a container, and may be nil.
+// podIPs are the IPs assigned to the pod, which are used to resolve references to "status.podIPs". They may be empty,
+// in which case only the pod's primary IP (if any) is used.
 // TODO Make this the single exported function of a "pkg/environment" package in the future.
-func populateEnvironmentVariables(ctx context.Context, pod *corev1.Pod, rm *manager.ResourceManager, recorder record.EventRecorder) error {
+func populateEnvironmentVariables(ctx context.Context, pod *corev1.Pod, node *corev1.Node, podIPs []string, rm *manager.ResourceManager, recorder record.EventRecorder) error {
 
 	// Populate each init container's environment.
 	for idx := range pod.Spec.InitContainers {
-		if err := populateContainerEnvironment(ctx, pod, &pod.Spec.InitContainers[idx], rm, recorder); err != nil {
+		if err := populateContainerEnvironment(ctx, pod, &pod.Spec.InitContainers[idx], node, podIPs, rm, recorder); err != nil {
 			return err
 		}
 	}
 	// Populate each container's environment.
 	for idx := range pod.Spec.Containers {
-		if err := populateContainerEnvironment(ctx, pod, &pod.Spec.Containers[idx], rm, recorder); err != nil {
+		if err := populateContainerEnvironment(ctx, pod, &pod.Spec.Containers[idx], node, podIPs, rm, recorder); err != nil {
 			return err
 		}
 	}
@@ -91,7 +97,7 @@ func populateEnvironmentVariables(ctx context.Context, pod *corev1.Pod, rm *mana
 }
 
 // populateContainerEnvironment populates the environment of a single container in the specified pod.
-func populateContainerEnvironment(ctx context.Context, pod *corev1.Pod, container *corev1.Container, rm *manager.ResourceManager, recorder record.EventRecorder) error {
+func populateContainerEnvironment(ctx context.Context, pod *corev1.Pod, container *corev1.Container, node *corev1.Node, podIPs []string, rm *manager.ResourceManager, recorder record.EventRecorder) error {
 	// Create an "environment map" based on the value of the specified container's ".envFrom" field.
 	tmpEnv, err := makeEnvironmentMapBasedOnEnvFrom(ctx, pod, container, rm, recorder)
 	if err != nil {
@@ -99,7 +105,7 @@ func populateContainerEnvironment(ctx context.Context, pod *corev1.Pod, containe
 	}
 	// Create the final "environment map" for the container using the ".env" and ".envFrom" field
 	// and service environment variables.
-	err = makeEnvironmentMap(ctx, pod, container, rm, recorder, tmpEnv)
+	err = makeEnvironmentMap(ctx, pod, container, node, podIPs, rm, recorder, tmpEnv)
 	if err != nil {
 		return err
 	}
@@ -108,18 +114,58 @@ func populateContainerEnvironment(ctx context.Context, pod *corev1.Pod, containe
 	// This is in accordance with what the Kubelet itself does.
 	// https://github.com/kubernetes/kubernetes/blob/v1.13.1/pkg/kubelet/kubelet_pods.go#L557-L558
 	container.EnvFrom = []corev1.EnvFromSource{}
+	container.Env = tmpEnv.envVars()
 
-	res := make([]corev1.EnvVar, 0)
+	// Expand the "$(VAR)" references in the container's command and arguments using the final environment.
+	// https://github.com/kubernetes/kubernetes/blob/v1.15.2/pkg/kubelet/container/helpers.go#L141-L163
+	mappingFunc := expansion.MappingFuncFor(tmpEnv.values)
+	for i, cmd := range container.Command {
+		container.Command[i] = expansion.Expand(cmd, mappingFunc)
+	}
+	for i, arg := range container.Args {
+		container.Args[i] = expansion.Expand(arg, mappingFunc)
+	}
+
+	return nil
+}
+
+// environment is a set of environment variables which keeps track of the order in which they were defined, so that
+// the resolved environment of a container is the same across syncs.
+type environment struct {
+	// names holds the names of the variables, in the order in which they were (last) defined.
+	names  []string
+	values map[string]string
+}
+
+func newEnvironment() *environment {
+	return &environment{values: make(map[string]string)}
+}
+
+// set defines the given variable.
+// A variable which is defined again is moved to the end of the environment, as later definitions take precedence.
+func (e *environment) set(name, value string) {
+	if _, ok := e.values[name]; ok {
+		for i, n := range e.names {
+			if n == name {
+				e.names = append(e.names[:i], e.names[i+1:]...)
+				break
+			}
+		}
+	}
+	e.names = append(e.names, name)
+	e.values[name] = value
+}
 
-	for key, val := range tmpEnv {
+// envVars returns the variables in the order in which they were defined.
+func (e *environment) envVars() []corev1.EnvVar {
+	res := make([]corev1.EnvVar, 0, len(e.names))
+	for _, name := range e.names {
 		res = append(res, corev1.EnvVar{
-			Name:  key,
-			Value: val,
+			Name:  name,
+			Value: e.values[name],
 		})
 	}
-	container.Env = res
-
-	return nil
+	return res
 }
 
 // getServiceEnvVarMap makes a map[string]string of env vars for services a
@@ -169,10 +215,11 @@ func getServiceEnvVarMap(rm *manager.ResourceManager, ns string, enableServiceLi
 	return m, nil
 }
 
-// makeEnvironmentMapBasedOnEnvFrom returns a map representing the resolved environment of the specified container after being populated from the entries in the ".envFrom" field.
-func makeEnvironmentMapBasedOnEnvFrom(ctx context.Context, pod *corev1.Pod, container *corev1.Container, rm *manager.ResourceManager, recorder record.EventRecorder) (map[string]string, error) {
-	// Create a map to hold the resulting environment.
-	res := make(map[string]string, 0)
+// makeEnvironmentMapBasedOnEnvFrom returns the resolved environment of the specified container after being populated from the entries in the ".envFrom" field.
+// Variables are defined in the order of the ".envFrom" entries, and in the order of their keys for each entry.
+func makeEnvironmentMapBasedOnEnvFrom(ctx context.Context, pod *corev1.Pod, container *corev1.Container, rm *manager.ResourceManager, recorder record.EventRecorder) (*environment, error) {
+	// Create an environment to hold the result.
+	res := newEnvironment()
 	// Iterate over "envFrom" references in order to populate the environment.
 loop:
 	for _, envFrom := range container.EnvFrom {
@@ -212,7 +259,8 @@ loop:
 			// https://github.com/kubernetes/kubernetes/blob/v1.13.1/pkg/kubelet/kubelet_pods.go#L581-L595
 			invalidKeys := make([]string, 0)
 		mKeys:
-			for key, val := range m.Data {
+			for _, key := range sets.StringKeySet(m.Data).List() {
+				val := m.Data[key]
 				// If a prefix has been defined, prepend it to the environment variable's name.
 				if len(envFrom.Prefix) > 0 {
 					key = envFrom.Prefix + key
@@ -224,7 +272,7 @@ loop:
 					continue mKeys
 				}
 				// Add the key and its value to the environment.
-				res[key] = val
+				res.set(key, val)
 			}
 			// Report any invalid keys.
 			if len(invalidKeys) > 0 {
@@ -266,7 +314,8 @@ loop:
 			// https://github.com/kubernetes/kubernetes/blob/v1.13.1/pkg/kubelet/kubelet_pods.go#L581-L595
 			invalidKeys := make([]string, 0)
 		sKeys:
-			for key, val := range s.Data {
+			for _, key := range sets.StringKeySet(s.Data).List() {
+				val := s.Data[key]
 				// If a prefix has been defined, prepend it to the environment variable's name.
 				if len(envFrom.Prefix) > 0 {
 					key = envFrom.Prefix + key
@@ -278,7 +327,7 @@ loop:
 					continue sKeys
 				}
 				// Add the key and its value to the environment.
-				res[key] = string(val)
+				res.set(key, string(val))
 			}
 			// Report any invalid keys.
 			if len(invalidKeys) > 0 {
@@ -291,8 +340,8 @@ loop:
 	return res, nil
 }
 
-// makeEnvironmentMap returns a map representing the resolved environment of the specified container after being populated from the entries in the ".env" and ".envFrom" field.
-func makeEnvironmentMap(ctx context.Context, pod *corev1.Pod, container *corev1.Container, rm *manager.ResourceManager, recorder record.EventRecorder, res map[string]string) error {
+// makeEnvironmentMap completes the resolved environment of the specified container (as populated from the entries in the ".envFrom" field) with the entries in the ".env" field, in declaration order, followed by the service environment variables.
+func makeEnvironmentMap(ctx context.Context, pod *corev1.Pod, container *corev1.Container, node *corev1.Node, podIPs []string, rm *manager.ResourceManager, recorder record.EventRecorder, res *environment) error {
 
 	// TODO If pod.Spec.EnableServiceLinks is nil then fail as per 1.14 kubelet.
 	enableServiceLinks := corev1.DefaultEnableServiceLinks
@@ -312,7 +361,7 @@ func makeEnvironmentMap(ctx context.Context, pod *corev1.Pod, container *corev1.
 	// If the variable's Value is set, expand the `$(var)` references to other
 	// variables in the .Value field; the sources of variables are the declared
 	// variables of the container and the service environment variables.
-	mappingFunc := expansion.MappingFuncFor(res, svcEnv)
+	mappingFunc := expansion.MappingFuncFor(res.values, svcEnv)
 
 	// Iterate over environment variables in order to populate the map.
 loop:
@@ -321,7 +370,7 @@ loop:
 		// Handle values that have been directly provided.
 		case env.Value != "":
 			// Expand variable references
-			res[env.Name] = expansion.Expand(env.Value, mappingFunc)
+			res.set(env.Name, expansion.Expand(env.Value, mappingFunc))
 			continue loop
 		// Handle population from a configmap key.
 		case env.ValueFrom != nil && env.ValueFrom.ConfigMapKeyRef != nil:
@@ -374,7 +423,7 @@ loop:
 				return fmt.Errorf("configmap %q doesn't contain the %q key required by pod %s", vf.Name, vf.Key, pod.Name)
 			}
 			// Populate the environment variable and continue on to the next reference.
-			res[env.Name] = keyValue
+			res.set(env.Name, keyValue)
 			continue loop
 		// Handle population from a secret key.
 		case env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil:
@@ -426,32 +475,38 @@ loop:
 				return fmt.Errorf("secret %q doesn't contain the %q key required by pod %s", vf.Name, vf.Key, pod.Name)
 			}
 			// Populate the environment variable and continue on to the next reference.
-			res[env.Name] = string(keyValue)
+			res.set(env.Name, string(keyValue))
 			continue loop
 		// Handle population from a field (downward API).
 		case env.ValueFrom != nil && env.ValueFrom.FieldRef != nil:
 			// https://github.com/virtual-kubelet/virtual-kubelet/issues/123
 			vf := env.ValueFrom.FieldRef
 
-			runtimeVal, err := podFieldSelectorRuntimeValue(vf, pod)
+			runtimeVal, err := podFieldSelectorRuntimeValue(vf, pod, podIPs)
 			if err != nil {
 				return err
 			}
 
-			res[env.Name] = runtimeVal
+			res.set(env.Name, runtimeVal)
 
 			continue loop
 		// Handle population from a resource request/limit.
 		case env.ValueFrom != nil && env.ValueFrom.ResourceFieldRef != nil:
-			// TODO Implement populating resource requests.
+			runtimeVal, err := containerResourceRuntimeValue(env.ValueFrom.ResourceFieldRef, pod, container, node)
+			if err != nil {
+				return err
+			}
+
+			res.set(env.Name, runtimeVal)
+
 			continue loop
 		}
 	}
 
 	// Append service env vars.
-	for k, v := range svcEnv {
-		if _, present := res[k]; !present {
-			res[k] = v
+	for _, k := range sets.StringKeySet(svcEnv).List() {
+		if _, present := res.values[k]; !present {
+			res.set(k, svcEnv[k])
 		}
 	}
 
@@ -460,7 +515,16 @@ loop:
 
 // podFieldSelectorRuntimeValue returns the runtime value of the given
 // selector for a pod.
-func podFieldSelectorRuntimeValue(fs *corev1.ObjectFieldSelector, pod *corev1.Pod) (string, error) {
+// Fields of the pod's status are only known once the provider has assigned IPs to the pod, and resolve to empty values
+// until then.
+func podFieldSelectorRuntimeValue(fs *corev1.ObjectFieldSelector, pod *corev1.Pod, podIPs []string) (string, error) {
+	// "status.podIPs" is not known to the version of the Kubernetes API we build against, so we resolve it ourselves.
+	if fs.FieldPath == podIPsFieldPath && (fs.APIVersion == "" || fs.APIVersion == "v1") {
+		if len(podIPs) == 0 && pod.Status.PodIP != "" {
+			podIPs = []string{pod.Status.PodIP}
+		}
+		return strings.Join(podIPs, ","), nil
+	}
 	internalFieldPath, _, err := podshelper.ConvertDownwardAPIFieldLabel(fs.APIVersion, fs.FieldPath, "")
 	if err != nil {
 		return "", err
@@ -470,7 +534,109 @@ func podFieldSelectorRuntimeValue(fs *corev1.ObjectFieldSelector, pod *corev1.Po
 		return pod.Spec.NodeName, nil
 	case "spec.serviceAccountName":
 		return pod.Spec.ServiceAccountName, nil
-
+	case "status.hostIP":
+		return pod.Status.HostIP, nil
+	case "status.podIP":
+		return pod.Status.PodIP, nil
 	}
 	return fieldpath.ExtractFieldPathAsString(pod, internalFieldPath)
 }
+
+// containerResourceRuntimeValue returns the value of the provided container resource.
+// Limits which are not set on the container default to the node's allocatable resources, as done by the kubelet.
+// Based on containerResourceRuntimeValue in kubelet_pods.go.
+func containerResourceRuntimeValue(fs *corev1.ResourceFieldSelector, pod *corev1.Pod, container *corev1.Container, node *corev1.Node) (string, error) {
+	if fs.ContainerName != "" {
+		container = findContainer(pod, fs.ContainerName)
+		if container == nil {
+			return "", fmt.Errorf("container %q not found in pod %s/%s", fs.ContainerName, pod.Namespace, pod.Name)
+		}
+	}
+
+	var allocatable corev1.ResourceList
+	if node != nil {
+		allocatable = node.Status.Allocatable
+	}
+	return extractContainerResourceValue(fs, containerWithDefaultLimits(container, allocatable))
+}
+
+// findContainer returns the container (or init container) with the given name in the pod, or nil if there is none.
+func findContainer(pod *corev1.Pod, name string) *corev1.Container {
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == name {
+			return &pod.Spec.Containers[i]
+		}
+	}
+	for i := range pod.Spec.InitContainers {
+		if pod.Spec.InitContainers[i].Name == name {
+			return &pod.Spec.InitContainers[i]
+		}
+	}
+	return nil
+}
+
+// containerWithDefaultLimits returns a copy of the container where the cpu, memory and ephemeral storage limits that
+// are not set are filled in from the given allocatable resources.
+// Based on MergeContainerResourceLimits in pkg/api/v1/resource/helpers.go.
+func containerWithDefaultLimits(container *corev1.Container, allocatable corev1.ResourceList) *corev1.Container {
+	c := container.DeepCopy()
+	if c.Resources.Limits == nil {
+		c.Resources.Limits = make(corev1.ResourceList)
+	}
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourceEphemeralStorage} {
+		if q, exists := c.Resources.Limits[name]; !exists || q.IsZero() {
+			if a, ok := allocatable[name]; ok {
+				c.Resources.Limits[name] = a.DeepCopy()
+			}
+		}
+	}
+	return c
+}
+
+// extractContainerResourceValue extracts the value of the resource selected by fs from the given container.
+// Based on ExtractContainerResourceValue in pkg/api/v1/resource/helpers.go.
+func extractContainerResourceValue(fs *corev1.ResourceFieldSelector, container *corev1.Container) (string, error) {
+	divisor := resource.Quantity{}
+	if divisor.Cmp(fs.Divisor) == 0 {
+		divisor = resource.MustParse("1")
+	} else {
+		divisor = fs.Divisor
+	}
+
+	switch fs.Resource {
+	case "limits.cpu":
+		return convertResourceCPUToString(container.Resources.Limits.Cpu(), divisor)
+	case "limits.memory":
+		return convertResourceQuantityToString(container.Resources.Limits.Memory(), divisor)
+	case "limits.ephemeral-storage":
+		return convertResourceQuantityToString(container.Resources.Limits.StorageEphemeral(), divisor)
+	case "requests.cpu":
+		return convertResourceCPUToString(container.Resources.Requests.Cpu(), divisor)
+	case "requests.memory":
+		return convertResourceQuantityToString(container.Resources.Requests.Memory(), divisor)
+	case "requests.ephemeral-storage":
+		return convertResourceQuantityToString(container.Resources.Requests.StorageEphemeral(), divisor)
+	}
+
+	return "", fmt.Errorf("unsupported container resource: %v", fs.Resource)
+}
+
+// convertResourceCPUToString converts cpu value to the format of divisor and returns
+// ceiling of the value.
+func convertResourceCPUToString(cpu *resource.Quantity, divisor resource.Quantity) (string, error) {
+	if divisor.MilliValue() == 0 {
+		return "", fmt.Errorf("invalid divisor %q", divisor.String())
+	}
+	c := int64(math.Ceil(float64(cpu.MilliValue()) / float64(divisor.MilliValue())))
+	return strconv.FormatInt(c, 10), nil
+}
+
+// convertResourceQuantityToString converts a memory or ephemeral storage value to the format of divisor and returns
+// ceiling of the value.
+func convertResourceQuantityToString(q *resource.Quantity, divisor resource.Quantity) (string, error) {
+	if divisor.Value() == 0 {
+		return "", fmt.Errorf("invalid divisor %q", divisor.String())
+	}
+	v := int64(math.Ceil(float64(q.Value()) / float64(divisor.Value())))
+	return strconv.FormatInt(v, 10), nil
+}
@@ -23,6 +23,7 @@ import (
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	testutil "github.com/virtual-kubelet/virtual-kubelet/internal/test/util"
@@ -215,7 +216,7 @@ func TestPopulatePodWithInitContainersUsingEnv(t *testing.T) {
 	}
 
 	// Populate the pod's environment.
-	err := populateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
 	assert.Check(t, err)
 
 	// Make sure that all the containers' environments contain all the expected keys and values.
@@ -375,7 +376,7 @@ func TestPopulatePodWithInitContainersUsingEnvWithFieldRef(t *testing.T) {
 	}
 
 	// Populate the pod's environment.
-	err := populateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
 	assert.NilError(t, err)
 
 	// Make sure that all the containers' environments contain all the expected keys and values.
@@ -491,7 +492,7 @@ func TestPopulatePodWithInitContainersUsingEnvFrom(t *testing.T) {
 	}
 
 	// Populate the pod's environment.
-	err := populateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
 	assert.Check(t, err)
 
 	// Make sure that all the containers' environments contain all the expected keys and values.
@@ -570,7 +571,7 @@ func TestEnvFromTwoConfigMapsAndOneSecret(t *testing.T) {
 	}
 
 	// Populate the container's environment.
-	err := populateContainerEnvironment(context.Background(), pod, &pod.Spec.Containers[0], rm, er)
+	err := populateContainerEnvironment(context.Background(), pod, &pod.Spec.Containers[0], nil, nil, rm, er)
 	assert.Check(t, err)
 
 	// Make sure that the container's environment contains all the expected keys and values.
@@ -632,7 +633,7 @@ func TestEnvFromConfigMapAndSecretWithInvalidKeys(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := populateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
 	assert.Check(t, err)
 
 	// Make sure that the container's environment has two variables (corresponding to the single valid key in both the configmap and the secret).
@@ -703,7 +704,7 @@ func TestEnvOverridesEnvFrom(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := populateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
 	assert.Check(t, err)
 
 	// Make sure that the container's environment contains all the expected keys and values.
@@ -780,7 +781,7 @@ func TestEnvFromInexistentConfigMaps(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := populateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
 	assert.Check(t, is.ErrorContains(err, ""))
 
 	// Make sure that two events have been recorded with the correct reason and message.
@@ -837,7 +838,7 @@ func TestEnvFromInexistentSecrets(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := populateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
 	assert.Check(t, is.ErrorContains(err, ""))
 
 	// Make sure that two events have been recorded with the correct reason and message.
@@ -890,7 +891,7 @@ func TestEnvReferencingInexistentConfigMapKey(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := populateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
 	assert.Check(t, is.ErrorContains(err, ""))
 
 	// Make sure that two events have been recorded with the correct reason and message.
@@ -940,7 +941,7 @@ func TestEnvReferencingInexistentSecretKey(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := populateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
 	assert.Check(t, is.ErrorContains(err, ""))
 
 	// Make sure that two events have been recorded with the correct reason and message.
@@ -1023,7 +1024,7 @@ func TestServiceEnvVar(t *testing.T) {
 	for _, tc := range testCases {
 		pod.Spec.EnableServiceLinks = tc.enableServiceLinks
 
-		err := populateEnvironmentVariables(context.Background(), pod, rm, er)
+		err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
 		assert.NilError(t, err, "[%s]", tc.name)
 		assert.Check(t, is.DeepEqual(pod.Spec.Containers[0].Env, tc.expectedEnvs, sortOpt))
 	}
@@ -1066,7 +1067,7 @@ func TestComposingEnv(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := populateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
 	assert.Check(t, err)
 
 	// Make sure that the container's environment contains all the expected keys and values.
@@ -1090,3 +1091,250 @@ func TestComposingEnv(t *testing.T) {
 	// Make sure that no events have been recorded.
 	assert.Check(t, is.Len(er.Events, 0))
 }
+
+// TestEnvFromResourceFieldRef tests that env vars referencing container resources are resolved, falling back to the
+// node's allocatable resources for limits that are not set on the container.
+func TestEnvFromResourceFieldRef(t *testing.T) {
+	rm := testutil.FakeResourceManager()
+	er := testutil.FakeEventRecorder(defaultEventRecorderBufferSize)
+
+	resourceFieldRef := func(containerName, res, divisor string) *corev1.EnvVarSource {
+		fs := &corev1.ResourceFieldSelector{ContainerName: containerName, Resource: res}
+		if divisor != "" {
+			fs.Divisor = resource.MustParse(divisor)
+		}
+		return &corev1.EnvVarSource{ResourceFieldRef: fs}
+	}
+
+	node := &corev1.Node{
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("4"),
+				corev1.ResourceMemory: resource.MustParse("8Gi"),
+			},
+		},
+	}
+
+	// Create a pod object having two containers.
+	// The first container's environment references its own resources and those of the second container.
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      "pod-0",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "app",
+					Resources: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{
+							corev1.ResourceCPU: resource.MustParse("500m"),
+						},
+						Requests: corev1.ResourceList{
+							corev1.ResourceMemory: resource.MustParse("64Mi"),
+						},
+					},
+					Env: []corev1.EnvVar{
+						{Name: "MEMORY_REQUEST", ValueFrom: resourceFieldRef("", "requests.memory", "1Mi")},
+						{Name: "CPU_LIMIT", ValueFrom: resourceFieldRef("", "limits.cpu", "")},
+						{Name: "CPU_LIMIT_MILLIS", ValueFrom: resourceFieldRef("", "limits.cpu", "1m")},
+						{Name: "MEMORY_LIMIT", ValueFrom: resourceFieldRef("", "limits.memory", "1Gi")},
+						{Name: "SIDECAR_CPU_REQUEST", ValueFrom: resourceFieldRef("sidecar", "requests.cpu", "1m")},
+					},
+				},
+				{
+					Name: "sidecar",
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceCPU: resource.MustParse("250m"),
+						},
+					},
+				},
+			},
+			EnableServiceLinks: &bFalse,
+		},
+	}
+
+	// Populate the pods's environment.
+	err := populateEnvironmentVariables(context.Background(), pod, node, nil, rm, er)
+	assert.Check(t, err)
+
+	// Make sure that the container's environment contains all the expected keys and values.
+	assert.Check(t, is.DeepEqual(pod.Spec.Containers[0].Env, []corev1.EnvVar{
+		{Name: "MEMORY_REQUEST", Value: "64"},
+		{Name: "CPU_LIMIT", Value: "1"},
+		{Name: "CPU_LIMIT_MILLIS", Value: "500"},
+		{Name: "MEMORY_LIMIT", Value: "8"},
+		{Name: "SIDECAR_CPU_REQUEST", Value: "250"},
+	},
+		sortOpt,
+	))
+
+	// Make sure that no events have been recorded.
+	assert.Check(t, is.Len(er.Events, 0))
+}
+
+// TestEnvFromResourceFieldRefUnknownContainer tests that referencing the resources of a container which does not exist
+// in the pod causes an error.
+func TestEnvFromResourceFieldRefUnknownContainer(t *testing.T) {
+	rm := testutil.FakeResourceManager()
+	er := testutil.FakeEventRecorder(defaultEventRecorderBufferSize)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      "pod-0",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "app",
+					Env: []corev1.EnvVar{
+						{
+							Name: "CPU_LIMIT",
+							ValueFrom: &corev1.EnvVarSource{
+								ResourceFieldRef: &corev1.ResourceFieldSelector{ContainerName: "missing", Resource: "limits.cpu"},
+							},
+						},
+					},
+				},
+			},
+			EnableServiceLinks: &bFalse,
+		},
+	}
+
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
+	assert.Check(t, is.ErrorContains(err, `container "missing" not found`))
+}
+
+// TestEnvOrdering tests that the resolved environment is ordered deterministically: variables coming from ".envFrom"
+// come first (sorted by key for each source), followed by variables from ".env" in declaration order.
+func TestEnvOrdering(t *testing.T) {
+	rm := testutil.FakeResourceManager(configMap3, secret1)
+	er := testutil.FakeEventRecorder(defaultEventRecorderBufferSize)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      "pod-0",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					EnvFrom: []corev1.EnvFromSource{
+						{
+							ConfigMapRef: &corev1.ConfigMapEnvSource{
+								LocalObjectReference: corev1.LocalObjectReference{
+									Name: configMap3.Name,
+								},
+							},
+						},
+						{
+							SecretRef: &corev1.SecretEnvSource{
+								LocalObjectReference: corev1.LocalObjectReference{
+									Name: secret1.Name,
+								},
+							},
+						},
+					},
+					Env: []corev1.EnvVar{
+						{
+							Name:  envVarName3,
+							Value: "$(" + keyBaz + ")",
+						},
+						{
+							// Redefining a variable coming from ".envFrom" moves it to its declaration in ".env".
+							Name:  keyBar,
+							Value: "overridden",
+						},
+						{
+							Name:  envVarName4,
+							Value: "$(" + keyBar + ")",
+						},
+					},
+				},
+			},
+			EnableServiceLinks: &bFalse,
+		},
+	}
+
+	for i := 0; i < 5; i++ {
+		p := pod.DeepCopy()
+		err := populateEnvironmentVariables(context.Background(), p, nil, nil, rm, er)
+		assert.Check(t, err)
+
+		// Make sure that the container's environment is ordered as expected, without relying on sortOpt.
+		assert.Check(t, is.DeepEqual(p.Spec.Containers[0].Env, []corev1.EnvVar{
+			{
+				Name:  keyFoo,
+				Value: "__foo__",
+			},
+			{
+				Name:  keyBaz,
+				Value: "__baz__",
+			},
+			{
+				Name:  envVarName3,
+				Value: "__baz__",
+			},
+			{
+				Name:  keyBar,
+				Value: "overridden",
+			},
+			{
+				Name:  envVarName4,
+				Value: "overridden",
+			},
+		}))
+	}
+
+	// Make sure that no events have been recorded.
+	assert.Check(t, is.Len(er.Events, 0))
+}
+
+// TestCommandAndArgsExpansion tests that "$(VAR)" references in a container's command and arguments are expanded
+// using the container's resolved environment.
+func TestCommandAndArgsExpansion(t *testing.T) {
+	rm := testutil.FakeResourceManager(configMap1)
+	er := testutil.FakeEventRecorder(defaultEventRecorderBufferSize)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      "pod-0",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Command: []string{"/bin/echo", "$(" + envVarName1 + ")"},
+					Args:    []string{"$(" + envVarName2 + ")", "$(UNDEFINED)", "$$(" + envVarName2 + ")"},
+					Env: []corev1.EnvVar{
+						{
+							Name: envVarName1,
+							ValueFrom: &corev1.EnvVarSource{
+								ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: configMap1.Name,
+									},
+									Key: keyFoo,
+								},
+							},
+						},
+						{
+							Name:  envVarName2,
+							Value: envVarValue2,
+						},
+					},
+				},
+			},
+			EnableServiceLinks: &bFalse,
+		},
+	}
+
+	err := populateEnvironmentVariables(context.Background(), pod, nil, nil, rm, er)
+	assert.Check(t, err)
+
+	// Unknown references are left untouched, and "$$" escapes a reference.
+	assert.Check(t, is.DeepEqual(pod.Spec.Containers[0].Command, []string{"/bin/echo", "__foo__"}))
+	assert.Check(t, is.DeepEqual(pod.Spec.Containers[0].Args, []string{envVarValue2, "$(UNDEFINED)", "$(" + envVarName2 + ")"}))
+}
@@ -0,0 +1,414 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"io"
+	"runtime/debug"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/node/metrics"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+)
+
+// containerLogsGetter is implemented by providers which serve the logs of containers.
+type containerLogsGetter interface {
+	GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts) (io.ReadCloser, error)
+}
+
+// statsSummaryProvider is implemented by providers which expose the stats of their pods.
+type statsSummaryProvider interface {
+	GetStatsSummary(context.Context) (*stats.Summary, error)
+}
+
+// InstrumentOpt is used to configure the handler returned by InstrumentPodLifecycleHandler.
+type InstrumentOpt func(*InstrumentedPodLifecycleHandler)
+
+// WithProviderCallTimeout sets the maximum duration of the calls made to the provider. Calls which take longer have
+// their context cancelled.
+// The timeout does not apply to streaming calls (GetContainerLogs and RunInContainer), which last for as long as the
+// client needs, nor to NativeProber and PodAdmitHandler, which are not expected to reach out to the provider's backend.
+// If unset, calls have no timeout other than the one of the caller's context.
+func WithProviderCallTimeout(d time.Duration) InstrumentOpt {
+	return func(h *InstrumentedPodLifecycleHandler) {
+		h.timeout = d
+	}
+}
+
+// WithCircuitBreaker records the results of the calls made to the provider in the given circuit breaker, and makes
+// them fail right away while it is open.
+// Like timeouts, the circuit breaker does not apply to streaming calls, NativeProber and PodAdmitHandler.
+func WithCircuitBreaker(b *CircuitBreaker) InstrumentOpt {
+	return func(h *InstrumentedPodLifecycleHandler) {
+		h.breaker = b
+	}
+}
+
+// WithNodeName sets the name of the node of the provider, with which the provider call metrics are labelled.
+func WithNodeName(name string) InstrumentOpt {
+	return func(h *InstrumentedPodLifecycleHandler) {
+		h.nodeName = name
+	}
+}
+
+// InstrumentPodLifecycleHandler wraps the given handler so that each call made to it is traced, logged and recorded
+// in the provider call metrics (see the node/metrics package). Panics in the handler are recovered from and returned
+// as errors.
+//
+// Handlers which are already instrumented are returned as is, with the given options applied.
+//
+// The PodController instruments its provider, so there is no need to instrument the handler passed to it.
+func InstrumentPodLifecycleHandler(handler PodLifecycleHandler, opts ...InstrumentOpt) *InstrumentedPodLifecycleHandler {
+	h, ok := handler.(*InstrumentedPodLifecycleHandler)
+	if !ok {
+		h = &InstrumentedPodLifecycleHandler{handler: handler}
+	}
+	for _, o := range opts {
+		o(h)
+	}
+	return h
+}
+
+// InstrumentedPodLifecycleHandler is the handler returned by InstrumentPodLifecycleHandler.
+//
+// Besides PodLifecycleHandler, it implements GracefulPodDeleter, falling back to DeletePod if the wrapped handler
+// does not implement it. The other optional interfaces implemented by the wrapped handler are not implemented by the
+// instrumented handler itself: their instrumented implementations are looked up with the accessor named after each
+// interface (such as PodVolumeHandler), which returns nil if the wrapped handler does not implement it. Unwrap
+// returns the wrapped handler.
+type InstrumentedPodLifecycleHandler struct {
+	handler PodLifecycleHandler
+
+	timeout  time.Duration
+	breaker  *CircuitBreaker
+	nodeName string
+}
+
+// Unwrap returns the wrapped handler.
+func (h *InstrumentedPodLifecycleHandler) Unwrap() PodLifecycleHandler {
+	return h.handler
+}
+
+// PodNotifier returns the wrapped handler if it implements PodNotifier, or nil. Notifications are passed on as is,
+// since they are not calls made to the provider.
+func (h *InstrumentedPodLifecycleHandler) PodNotifier() PodNotifier {
+	n, _ := h.handler.(PodNotifier)
+	return n
+}
+
+// PodIPAllocator returns the instrumented PodIPAllocator of the wrapped handler, or nil.
+func (h *InstrumentedPodLifecycleHandler) PodIPAllocator() PodIPAllocator {
+	if a, ok := h.handler.(PodIPAllocator); ok {
+		return instrumentedIPAllocator{h, a}
+	}
+	return nil
+}
+
+// PodVolumeHandler returns the instrumented PodVolumeHandler of the wrapped handler, or nil.
+func (h *InstrumentedPodLifecycleHandler) PodVolumeHandler() PodVolumeHandler {
+	if v, ok := h.handler.(PodVolumeHandler); ok {
+		return instrumentedVolumeHandler{h, v}
+	}
+	return nil
+}
+
+// ContainerRestarter returns the instrumented ContainerRestarter of the wrapped handler, or nil.
+func (h *InstrumentedPodLifecycleHandler) ContainerRestarter() ContainerRestarter {
+	if r, ok := h.handler.(ContainerRestarter); ok {
+		return instrumentedRestarter{h, r}
+	}
+	return nil
+}
+
+// NativeProber returns the instrumented NativeProber of the wrapped handler, or nil.
+func (h *InstrumentedPodLifecycleHandler) NativeProber() NativeProber {
+	if p, ok := h.handler.(NativeProber); ok {
+		return instrumentedProber{h, p}
+	}
+	return nil
+}
+
+// PodAdmitHandler returns the instrumented PodAdmitHandler of the wrapped handler, or nil. Pods are rejected if the
+// handler panics.
+func (h *InstrumentedPodLifecycleHandler) PodAdmitHandler() PodAdmitHandler {
+	if a, ok := h.handler.(PodAdmitHandler); ok {
+		return instrumentedAdmitHandler{h, a}
+	}
+	return nil
+}
+
+// StatsSummaryHandler returns the instrumented GetStatsSummary method of the wrapped handler, or nil if it does not
+// have one.
+func (h *InstrumentedPodLifecycleHandler) StatsSummaryHandler() api.PodStatsSummaryHandlerFunc {
+	if s, ok := h.handler.(statsSummaryProvider); ok {
+		return instrumentedStatsProvider{h, s}.GetStatsSummary
+	}
+	return nil
+}
+
+// ContainerLogsHandler returns the instrumented GetContainerLogs method of the wrapped handler, or nil if it does not
+// have one.
+func (h *InstrumentedPodLifecycleHandler) ContainerLogsHandler() api.ContainerLogsHandlerFunc {
+	if l, ok := h.handler.(containerLogsGetter); ok {
+		return instrumentedLogsGetter{h, l}.GetContainerLogs
+	}
+	return nil
+}
+
+// ContainerExecHandler returns the instrumented RunInContainer method of the wrapped handler, or nil if it does not
+// have one.
+func (h *InstrumentedPodLifecycleHandler) ContainerExecHandler() api.ContainerExecHandlerFunc {
+	if r := h.containerRunner(); r != nil {
+		return r.RunInContainer
+	}
+	return nil
+}
+
+// containerRunner returns the instrumented containerRunner of the wrapped handler, or nil.
+func (h *InstrumentedPodLifecycleHandler) containerRunner() containerRunner {
+	if r, ok := h.handler.(containerRunner); ok {
+		return instrumentedRunner{h, r}
+	}
+	return nil
+}
+
+// call calls f as the given method of the wrapped handler. Only guarded calls are subject to the configured timeout
+// and circuit breaker.
+func (h *InstrumentedPodLifecycleHandler) call(ctx context.Context, method string, fields log.Fields, guarded bool, f func(context.Context) error) (retErr error) {
+	ctx, span := trace.StartSpan(ctx, "provider."+method)
+	defer span.End()
+	ctx = span.WithFields(ctx, fields)
+	ctx = span.WithField(ctx, "method", method)
+
+	if guarded {
+		if err := h.breaker.allow(); err != nil {
+			span.SetStatus(err)
+			return err
+		}
+	}
+	if guarded && h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			retErr = pkgerrors.Errorf("provider panicked in %s: %v", method, r)
+			log.G(ctx).WithField("stack", string(debug.Stack())).Error(retErr)
+		}
+		metrics.ObserveProviderCall(h.nodeName, method, start, retErr)
+		if guarded {
+			h.breaker.record(ctx, retErr)
+		}
+		span.SetStatus(retErr)
+
+		logger := log.G(ctx).WithField("duration", time.Since(start))
+		switch {
+		case retErr == nil:
+			logger.Debug("Provider call succeeded")
+		case errdefs.IsNotFound(retErr):
+			logger.WithError(retErr).Debug("Provider call returned not found")
+		default:
+			logger.WithError(retErr).Warn("Provider call failed")
+		}
+	}()
+
+	return f(ctx)
+}
+
+func podFields(pod *corev1.Pod) log.Fields {
+	return log.Fields{
+		"uid":       string(pod.GetUID()),
+		"namespace": pod.GetNamespace(),
+		"name":      pod.GetName(),
+	}
+}
+
+func (h *InstrumentedPodLifecycleHandler) CreatePod(ctx context.Context, pod *corev1.Pod) error {
+	return h.call(ctx, "CreatePod", podFields(pod), true, func(ctx context.Context) error {
+		return h.handler.CreatePod(ctx, pod)
+	})
+}
+
+func (h *InstrumentedPodLifecycleHandler) UpdatePod(ctx context.Context, pod *corev1.Pod) error {
+	return h.call(ctx, "UpdatePod", podFields(pod), true, func(ctx context.Context) error {
+		return h.handler.UpdatePod(ctx, pod)
+	})
+}
+
+func (h *InstrumentedPodLifecycleHandler) DeletePod(ctx context.Context, pod *corev1.Pod) error {
+	return h.call(ctx, "DeletePod", podFields(pod), true, func(ctx context.Context) error {
+		return h.handler.DeletePod(ctx, pod)
+	})
+}
+
+// DeletePodWithGracePeriod passes the grace period on to the wrapped handler if it implements GracefulPodDeleter, and
+// otherwise falls back to DeletePod.
+func (h *InstrumentedPodLifecycleHandler) DeletePodWithGracePeriod(ctx context.Context, pod *corev1.Pod, gracePeriod time.Duration) error {
+	d, ok := h.handler.(GracefulPodDeleter)
+	if !ok {
+		return h.DeletePod(ctx, pod)
+	}
+	fields := podFields(pod)
+	fields["gracePeriod"] = gracePeriod
+	return h.call(ctx, "DeletePodWithGracePeriod", fields, true, func(ctx context.Context) error {
+		return d.DeletePodWithGracePeriod(ctx, pod, gracePeriod)
+	})
+}
+
+func (h *InstrumentedPodLifecycleHandler) GetPod(ctx context.Context, namespace, name string) (pod *corev1.Pod, err error) {
+	err = h.call(ctx, "GetPod", log.Fields{"namespace": namespace, "name": name}, true, func(ctx context.Context) error {
+		pod, err = h.handler.GetPod(ctx, namespace, name)
+		return err
+	})
+	return pod, err
+}
+
+func (h *InstrumentedPodLifecycleHandler) GetPodStatus(ctx context.Context, namespace, name string) (status *corev1.PodStatus, err error) {
+	err = h.call(ctx, "GetPodStatus", log.Fields{"namespace": namespace, "name": name}, true, func(ctx context.Context) error {
+		status, err = h.handler.GetPodStatus(ctx, namespace, name)
+		return err
+	})
+	return status, err
+}
+
+func (h *InstrumentedPodLifecycleHandler) GetPods(ctx context.Context) (pods []*corev1.Pod, err error) {
+	err = h.call(ctx, "GetPods", nil, true, func(ctx context.Context) error {
+		pods, err = h.handler.GetPods(ctx)
+		return err
+	})
+	return pods, err
+}
+
+type instrumentedIPAllocator struct {
+	h *InstrumentedPodLifecycleHandler
+	a PodIPAllocator
+}
+
+func (a instrumentedIPAllocator) AllocatePodIPs(ctx context.Context, pod *corev1.Pod) (ips *PodIPs, err error) {
+	err = a.h.call(ctx, "AllocatePodIPs", podFields(pod), true, func(ctx context.Context) error {
+		ips, err = a.a.AllocatePodIPs(ctx, pod)
+		return err
+	})
+	return ips, err
+}
+
+type instrumentedVolumeHandler struct {
+	h *InstrumentedPodLifecycleHandler
+	v PodVolumeHandler
+}
+
+func (v instrumentedVolumeHandler) CreatePodWithVolumes(ctx context.Context, pod *corev1.Pod, volumes PodVolumes) error {
+	return v.h.call(ctx, "CreatePodWithVolumes", podFields(pod), true, func(ctx context.Context) error {
+		return v.v.CreatePodWithVolumes(ctx, pod, volumes)
+	})
+}
+
+func (v instrumentedVolumeHandler) UpdatePodWithVolumes(ctx context.Context, pod *corev1.Pod, volumes PodVolumes) error {
+	return v.h.call(ctx, "UpdatePodWithVolumes", podFields(pod), true, func(ctx context.Context) error {
+		return v.v.UpdatePodWithVolumes(ctx, pod, volumes)
+	})
+}
+
+type instrumentedRestarter struct {
+	h *InstrumentedPodLifecycleHandler
+	r ContainerRestarter
+}
+
+func (r instrumentedRestarter) RestartContainer(ctx context.Context, pod *corev1.Pod, containerName string) error {
+	fields := podFields(pod)
+	fields["container"] = containerName
+	return r.h.call(ctx, "RestartContainer", fields, true, func(ctx context.Context) error {
+		return r.r.RestartContainer(ctx, pod, containerName)
+	})
+}
+
+type instrumentedProber struct {
+	h *InstrumentedPodLifecycleHandler
+	p NativeProber
+}
+
+// RunsProbes returns false if the wrapped prober panics, so that the probes are run by the pod controller.
+func (p instrumentedProber) RunsProbes(pod *corev1.Pod) (runs bool) {
+	_ = p.h.call(context.Background(), "RunsProbes", podFields(pod), false, func(context.Context) error {
+		runs = p.p.RunsProbes(pod)
+		return nil
+	})
+	return runs
+}
+
+type instrumentedAdmitHandler struct {
+	h *InstrumentedPodLifecycleHandler
+	a PodAdmitHandler
+}
+
+func (a instrumentedAdmitHandler) Admit(ctx context.Context, attrs *PodAdmitAttributes) (result PodAdmitResult) {
+	err := a.h.call(ctx, "Admit", podFields(attrs.Pod), false, func(ctx context.Context) error {
+		result = a.a.Admit(ctx, attrs)
+		return nil
+	})
+	if err != nil {
+		return PodAdmitResult{Reason: podAdmitReasonUnexpectedError, Message: err.Error()}
+	}
+	return result
+}
+
+type instrumentedStatsProvider struct {
+	h *InstrumentedPodLifecycleHandler
+	s statsSummaryProvider
+}
+
+func (s instrumentedStatsProvider) GetStatsSummary(ctx context.Context) (summary *stats.Summary, err error) {
+	err = s.h.call(ctx, "GetStatsSummary", nil, true, func(ctx context.Context) error {
+		summary, err = s.s.GetStatsSummary(ctx)
+		return err
+	})
+	return summary, err
+}
+
+type instrumentedLogsGetter struct {
+	h *InstrumentedPodLifecycleHandler
+	l containerLogsGetter
+}
+
+func (l instrumentedLogsGetter) GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts) (logs io.ReadCloser, err error) {
+	fields := log.Fields{"namespace": namespace, "name": podName, "container": containerName}
+	err = l.h.call(ctx, "GetContainerLogs", fields, false, func(ctx context.Context) error {
+		logs, err = l.l.GetContainerLogs(ctx, namespace, podName, containerName, opts)
+		return err
+	})
+	return logs, err
+}
+
+type instrumentedRunner struct {
+	h *InstrumentedPodLifecycleHandler
+	r containerRunner
+}
+
+func (r instrumentedRunner) RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach api.AttachIO) error {
+	fields := log.Fields{"namespace": namespace, "name": podName, "container": containerName}
+	return r.h.call(ctx, "RunInContainer", fields, false, func(ctx context.Context) error {
+		return r.r.RunInContainer(ctx, namespace, podName, containerName, cmd, attach)
+	})
+}
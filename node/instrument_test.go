@@ -0,0 +1,114 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// panickingProvider is a provider which panics when creating pods, and blocks until its context is done when listing
+// them.
+type panickingProvider struct {
+	*mockProvider
+}
+
+func (p *panickingProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
+	panic("boom")
+}
+
+func (p *panickingProvider) GetPods(ctx context.Context) ([]*corev1.Pod, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// volumeProvider is a provider which implements PodVolumeHandler, and records the calls made to it.
+type volumeProvider struct {
+	*mockProviderAsync
+	creates int
+}
+
+func (p *volumeProvider) CreatePodWithVolumes(ctx context.Context, pod *corev1.Pod, volumes PodVolumes) error {
+	p.creates++
+	return p.CreatePod(ctx, pod)
+}
+
+func (p *volumeProvider) UpdatePodWithVolumes(ctx context.Context, pod *corev1.Pod, volumes PodVolumes) error {
+	return p.UpdatePod(ctx, pod)
+}
+
+func TestInstrumentPodLifecycleHandlerOptionalInterfaces(t *testing.T) {
+	h := InstrumentPodLifecycleHandler(newSyncMockProvider())
+	assert.Check(t, h.PodNotifier() == nil, "sync providers must not be reported as implementing PodNotifier")
+	assert.Check(t, h.ContainerExecHandler() == nil)
+	assert.Check(t, h.PodVolumeHandler() == nil)
+	assert.Check(t, h.NativeProber() == nil)
+	var d PodLifecycleHandler = h
+	_, ok := d.(GracefulPodDeleter)
+	assert.Check(t, ok, "the instrumented handler always implements GracefulPodDeleter")
+
+	runner := &struct {
+		*mockProviderAsync
+		*mockContainerRunner
+	}{newMockProvider(), &mockContainerRunner{}}
+	h = InstrumentPodLifecycleHandler(runner)
+	assert.Check(t, h.PodNotifier() != nil)
+	exec := h.ContainerExecHandler()
+	assert.Assert(t, exec != nil)
+	assert.NilError(t, exec(context.Background(), "default", "nginx", "nginx", []string{"true"}, &probeOutput{}))
+	assert.Check(t, is.DeepEqual(runner.cmds, [][]string{{"true"}}))
+
+	assert.Check(t, InstrumentPodLifecycleHandler(h) == h, "instrumented handlers must not be instrumented again")
+	assert.Check(t, h.Unwrap() == PodLifecycleHandler(runner))
+}
+
+func TestInstrumentPodLifecycleHandlerVolumeHandler(t *testing.T) {
+	p := &volumeProvider{mockProviderAsync: newMockProvider()}
+	breaker := newTestCircuitBreaker(t, &corev1.Node{}, p)
+	h := InstrumentPodLifecycleHandler(p, WithCircuitBreaker(breaker))
+
+	v := h.PodVolumeHandler()
+	assert.Assert(t, v != nil)
+	assert.NilError(t, v.CreatePodWithVolumes(context.Background(), newRunningPod(), nil))
+	assert.Check(t, is.Equal(p.creates, 1))
+
+	// Calls to the optional interfaces are subject to the circuit breaker like the others.
+	breaker.record(context.Background(), errors.New("failed"))
+	breaker.record(context.Background(), errors.New("failed"))
+	err := v.CreatePodWithVolumes(context.Background(), newRunningPod(), nil)
+	assert.Check(t, is.Equal(err, errCircuitOpen))
+	assert.Check(t, is.Equal(p.creates, 1))
+}
+
+func TestInstrumentPodLifecycleHandlerGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	p := &mockGracefulProvider{mockProviderAsync: newMockProvider()}
+	pod := newRunningPod()
+	assert.NilError(t, p.CreatePod(ctx, pod))
+
+	h := InstrumentPodLifecycleHandler(p)
+	assert.NilError(t, h.DeletePodWithGracePeriod(ctx, pod, 5*time.Second))
+	assert.Check(t, is.DeepEqual(p.gracePeriods, []time.Duration{5 * time.Second}))
+	assert.Check(t, is.Equal(p.deletes.read(), 1))
+}
+
+func TestInstrumentPodLifecycleHandlerRecoversFromPanics(t *testing.T) {
+	h := InstrumentPodLifecycleHandler(&panickingProvider{newSyncMockProvider()})
+	err := h.CreatePod(context.Background(), newRunningPod())
+	assert.Check(t, is.ErrorContains(err, "boom"))
+}
+
+func TestInstrumentPodLifecycleHandlerTimeout(t *testing.T) {
+	h := InstrumentPodLifecycleHandler(&panickingProvider{newSyncMockProvider()}, WithProviderCallTimeout(10*time.Millisecond))
+	_, err := h.GetPods(context.Background())
+	assert.Check(t, is.Equal(err, context.DeadlineExceeded))
+
+	// Errors of the provider are passed on unchanged.
+	_, err = h.GetPod(context.Background(), "default", "missing")
+	assert.Check(t, errdefs.IsNotFound(err))
+}
@@ -0,0 +1,173 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// The default durations used for leader election, which are the same as those of the Kubernetes controllers.
+const (
+	DefaultLeaderElectionLeaseDuration = 15 * time.Second
+	DefaultLeaderElectionRenewDeadline = 10 * time.Second
+	DefaultLeaderElectionRetryPeriod   = 2 * time.Second
+)
+
+// LeaderElectionConfig is used to configure leader election, see RunWithLeaderElection.
+type LeaderElectionConfig struct {
+	// Client is used to manage the lease backing the election.
+	// This field is required.
+	Client coordv1.LeasesGetter
+
+	// Namespace is the namespace of the lease.
+	// If unset, the "kube-node-lease" namespace is used.
+	Namespace string
+	// Name is the name of the lease. It must not be the name of the node, which is the name of the node's own lease.
+	// This field is required.
+	Name string
+
+	// Identity uniquely identifies the candidate among the processes managing the same node.
+	// This field is required.
+	Identity string
+
+	// LeaseDuration is the duration for which the standbys wait before taking over a lease which is not renewed.
+	// If unset, DefaultLeaderElectionLeaseDuration is used.
+	LeaseDuration time.Duration
+	// RenewDeadline is the duration for which the leader retries renewing the lease before stepping down.
+	// If unset, DefaultLeaderElectionRenewDeadline is used.
+	RenewDeadline time.Duration
+	// RetryPeriod is the interval at which the candidates try to acquire or renew the lease.
+	// If unset, DefaultLeaderElectionRetryPeriod is used.
+	RetryPeriod time.Duration
+}
+
+// RunWithLeaderElection waits for the leadership of the election configured by cfg, and calls run once it is
+// acquired. The context passed to run is cancelled when the leadership is lost.
+//
+// This is used to run several processes managing the same node in active/passive mode: only the leader runs the
+// PodController and the NodeController, while the standbys can keep their informers in sync so that they are ready
+// to take over. Stepping down only stops the controllers, which leaves the pods running in the provider.
+//
+// RunWithLeaderElection blocks until run returns. The lease is then released if the context was cancelled, so that
+// a standby can take over right away. It returns nil if the context was cancelled, and an error if the leadership was
+// lost in the meantime: since the controllers cannot be run again, callers are expected to exit in that case.
+func RunWithLeaderElection(ctx context.Context, cfg LeaderElectionConfig, run func(context.Context)) error {
+	if cfg.Client == nil {
+		return errdefs.InvalidInput("missing lease client")
+	}
+	if cfg.Name == "" {
+		return errdefs.InvalidInput("missing lease name")
+	}
+	if cfg.Identity == "" {
+		return errdefs.InvalidInput("missing identity")
+	}
+	if cfg.Namespace == "" {
+		cfg.Namespace = corev1.NamespaceNodeLease
+	}
+	if cfg.LeaseDuration == 0 {
+		cfg.LeaseDuration = DefaultLeaderElectionLeaseDuration
+	}
+	if cfg.RenewDeadline == 0 {
+		cfg.RenewDeadline = DefaultLeaderElectionRenewDeadline
+	}
+	if cfg.RetryPeriod == 0 {
+		cfg.RetryPeriod = DefaultLeaderElectionRetryPeriod
+	}
+
+	ctx = log.WithLogger(ctx, log.G(ctx).WithFields(log.Fields{
+		"lease":    cfg.Namespace + "/" + cfg.Name,
+		"identity": cfg.Identity,
+	}))
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: cfg.Namespace, Name: cfg.Name},
+		Client:     cfg.Client,
+		LockConfig: resourcelock.ResourceLockConfig{Identity: cfg.Identity},
+	}
+
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: cfg.LeaseDuration,
+		RenewDeadline: cfg.RenewDeadline,
+		RetryPeriod:   cfg.RetryPeriod,
+		Name:          cfg.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				close(started)
+				defer close(stopped)
+				log.G(ctx).Info("Acquired leadership")
+				run(ctx)
+			},
+			OnStoppedLeading: func() {},
+			OnNewLeader: func(identity string) {
+				if identity != cfg.Identity {
+					log.G(ctx).WithField("leader", identity).Info("New leader elected")
+				}
+			},
+		},
+	})
+	if err != nil {
+		return errdefs.AsInvalidInput(err)
+	}
+
+	log.G(ctx).Info("Waiting for leadership")
+	le.Run(ctx)
+
+	// The leader elector starts run in its own goroutine, which may not have started yet if the context was cancelled
+	// right after the leadership was acquired.
+	select {
+	case <-started:
+	default:
+		if le.GetLeader() != cfg.Identity {
+			return nil
+		}
+	}
+	<-stopped
+
+	if ctx.Err() == nil {
+		log.G(ctx).Error("Lost leadership")
+		return pkgerrors.New("lost leadership")
+	}
+	if err := releaseLeadership(lock, cfg.Identity); err != nil {
+		log.G(ctx).WithError(err).Warn("Could not release leadership")
+	} else {
+		log.G(ctx).Info("Released leadership")
+	}
+	return nil
+}
+
+// releaseLeadership releases the lease if it is still held by the given identity.
+func releaseLeadership(lock resourcelock.Interface, identity string) error {
+	record, err := lock.Get()
+	if err != nil {
+		return err
+	}
+	if record.HolderIdentity != identity {
+		return nil
+	}
+	return lock.Update(resourcelock.LeaderElectionRecord{LeaderTransitions: record.LeaderTransitions})
+}
@@ -0,0 +1,102 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestLeaderElectionConfig(c *testclient.Clientset, identity string) LeaderElectionConfig {
+	return LeaderElectionConfig{
+		Client:        c.CoordinationV1(),
+		Name:          "vk-leader",
+		Identity:      identity,
+		LeaseDuration: 500 * time.Millisecond,
+		RenewDeadline: 200 * time.Millisecond,
+		RetryPeriod:   20 * time.Millisecond,
+	}
+}
+
+func TestRunWithLeaderElectionReleasesLease(t *testing.T) {
+	c := testclient.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	running := make(chan struct{})
+	chErr := make(chan error)
+	go func() {
+		chErr <- RunWithLeaderElection(ctx, newTestLeaderElectionConfig(c, "a"), func(ctx context.Context) {
+			close(running)
+			<-ctx.Done()
+		})
+	}()
+
+	select {
+	case <-running:
+	case err := <-chErr:
+		t.Fatalf("returned before acquiring leadership: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for leadership")
+	}
+
+	cancel()
+	assert.NilError(t, <-chErr)
+
+	lease, err := c.CoordinationV1().Leases("kube-node-lease").Get("vk-leader", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(leaseHolder(lease), ""), "the lease must be released when stepping down")
+}
+
+func TestRunWithLeaderElectionLostLeadership(t *testing.T) {
+	c := testclient.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	running := make(chan struct{})
+	stopped := make(chan struct{})
+	chErr := make(chan error)
+	go func() {
+		chErr <- RunWithLeaderElection(ctx, newTestLeaderElectionConfig(c, "a"), func(ctx context.Context) {
+			close(running)
+			<-ctx.Done()
+			close(stopped)
+		})
+	}()
+	<-running
+
+	// Another candidate takes over the lease.
+	leases := c.CoordinationV1().Leases("kube-node-lease")
+	lease, err := leases.Get("vk-leader", metav1.GetOptions{})
+	assert.NilError(t, err)
+	holder := "b"
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.RenewTime = &metav1.MicroTime{Time: time.Now().Add(time.Hour)}
+	_, err = leases.Update(lease)
+	assert.NilError(t, err)
+
+	select {
+	case err := <-chErr:
+		assert.Check(t, is.ErrorContains(err, "lost leadership"))
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the leadership to be lost")
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("run must have returned once the leadership is lost")
+	}
+
+	lease, err = leases.Get("vk-leader", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(leaseHolder(lease), "b"))
+}
+
+func TestRunWithLeaderElectionInvalidConfig(t *testing.T) {
+	err := RunWithLeaderElection(context.Background(), LeaderElectionConfig{}, func(context.Context) {})
+	assert.Check(t, is.ErrorContains(err, "missing lease client"))
+}
@@ -0,0 +1,138 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"fmt"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	coord "k8s.io/api/coordination/v1"
+	coordv1beta1 "k8s.io/api/coordination/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+)
+
+// leaseClient is used to manage the node lease.
+// It is implemented by the coordination.k8s.io/v1 lease client, and by v1beta1LeaseClient for clusters which only
+// serve v1beta1.
+type leaseClient interface {
+	Create(*coord.Lease) (*coord.Lease, error)
+	Get(name string, options metav1.GetOptions) (*coord.Lease, error)
+	Update(*coord.Lease) (*coord.Lease, error)
+	Delete(name string, options *metav1.DeleteOptions) error
+}
+
+// v1beta1LeaseClient adapts a coordination.k8s.io/v1beta1 lease client to leaseClient.
+type v1beta1LeaseClient struct {
+	leases v1beta1.LeaseInterface
+}
+
+func (c v1beta1LeaseClient) Create(lease *coord.Lease) (*coord.Lease, error) {
+	l, err := c.leases.Create(leaseToV1beta1(lease))
+	if err != nil {
+		return nil, err
+	}
+	return leaseFromV1beta1(l), nil
+}
+
+func (c v1beta1LeaseClient) Get(name string, options metav1.GetOptions) (*coord.Lease, error) {
+	l, err := c.leases.Get(name, options)
+	if err != nil {
+		return nil, err
+	}
+	return leaseFromV1beta1(l), nil
+}
+
+func (c v1beta1LeaseClient) Update(lease *coord.Lease) (*coord.Lease, error) {
+	l, err := c.leases.Update(leaseToV1beta1(lease))
+	if err != nil {
+		return nil, err
+	}
+	return leaseFromV1beta1(l), nil
+}
+
+func (c v1beta1LeaseClient) Delete(name string, options *metav1.DeleteOptions) error {
+	return c.leases.Delete(name, options)
+}
+
+// The v1 and v1beta1 lease specs are identical, so leases are converted between the two versions by converting their
+// specs directly.
+
+func leaseToV1beta1(l *coord.Lease) *coordv1beta1.Lease {
+	if l == nil {
+		return nil
+	}
+	l = l.DeepCopy()
+	return &coordv1beta1.Lease{ObjectMeta: l.ObjectMeta, Spec: coordv1beta1.LeaseSpec(l.Spec)}
+}
+
+func leaseFromV1beta1(l *coordv1beta1.Lease) *coord.Lease {
+	if l == nil {
+		return nil
+	}
+	l = l.DeepCopy()
+	return &coord.Lease{ObjectMeta: l.ObjectMeta, Spec: coord.LeaseSpec(l.Spec)}
+}
+
+// discoverLeaseClient returns a client for the node leases using the coordination.k8s.io/v1 API if it is served by
+// the cluster, and the v1beta1 API otherwise.
+func discoverLeaseClient(client kubernetes.Interface) (leaseClient, error) {
+	resources, err := client.Discovery().ServerResourcesForGroupVersion(coord.SchemeGroupVersion.String())
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, pkgerrors.Wrap(err, "error discovering the node lease API version")
+	}
+	if resources != nil {
+		for _, r := range resources.APIResources {
+			if r.Name == "leases" {
+				return client.CoordinationV1().Leases(corev1.NamespaceNodeLease), nil
+			}
+		}
+	}
+	return v1beta1LeaseClient{client.CoordinationV1beta1().Leases(corev1.NamespaceNodeLease)}, nil
+}
+
+// leaseHeldError is returned when the node lease is held by another holder, and has not expired yet.
+type leaseHeldError struct {
+	name   string
+	holder string
+}
+
+func (e *leaseHeldError) Error() string {
+	return fmt.Sprintf("node lease %q is held by %q", e.name, e.holder)
+}
+
+func isLeaseHeld(err error) bool {
+	_, ok := pkgerrors.Cause(err).(*leaseHeldError)
+	return ok
+}
+
+func leaseHolder(l *coord.Lease) string {
+	if l.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *l.Spec.HolderIdentity
+}
+
+// leaseExpired returns whether the lease was not renewed within its duration.
+func leaseExpired(l *coord.Lease, now time.Time) bool {
+	if l.Spec.RenewTime == nil || l.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return l.Spec.RenewTime.Add(time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
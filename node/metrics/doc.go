@@ -0,0 +1,37 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package metrics provides the Prometheus metrics of the pod and node controllers.
+
+The metrics are recorded by the controllers of the node package, and cover the calls made to the provider, the node
+pings and lease updates, the time taken by pods to start, and the work queues of the pod controller.
+They are not registered with any registry by default: embedders register them with a registry of their choosing using
+Register, and expose that registry, for instance with promhttp.HandlerFor.
+
+	registry := prometheus.NewRegistry()
+	if err := metrics.Register(registry); err != nil {
+		return err
+	}
+	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+The metrics of the controllers are labelled with the name of their node, so that the nodes managed by a single
+process can be told apart. The label is empty if the node is unknown, such as for pod controllers created without
+PodControllerConfig.NodeName.
+
+The work queue metrics are labelled with the name of the queue, which the pod controller suffixes with the name of its
+node. They are only recorded once RegisterWorkqueueMetrics has been called, and then cover every named work queue
+created by the process afterwards.
+*/
+package metrics
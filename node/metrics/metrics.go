@@ -0,0 +1,146 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+)
+
+// Namespace is the namespace of all the metrics of virtual-kubelet.
+const Namespace = "virtual_kubelet"
+
+const (
+	resultSuccess  = "success"
+	resultNotFound = "not_found"
+	resultError    = "error"
+)
+
+var (
+	providerCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "provider",
+		Name:      "call_duration_seconds",
+		Help:      "Duration of the calls made to the provider, by node, method and result.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"node", "method", "result"})
+
+	nodePingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "node_controller",
+		Name:      "ping_duration_seconds",
+		Help:      "Duration of the node provider pings, by node and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"node", "result"})
+
+	nodeLeaseUpdateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "node_controller",
+		Name:      "lease_update_duration_seconds",
+		Help:      "Duration of the node lease updates, by node and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"node", "result"})
+
+	podStartDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "pod_controller",
+		Name:      "pod_start_duration_seconds",
+		Help:      "Time from a pod being scheduled to the node to it being reported as running, by node.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"node"})
+
+	reconciledPods = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "pod_controller",
+		Name:      "reconciled_pods_total",
+		Help:      "Number of pods found out of sync between the provider and Kubernetes, by node and action taken.",
+	}, []string{"node", "action", "dry_run"})
+)
+
+// Collectors returns all the collectors of virtual-kubelet's metrics, including those of the work queues.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		providerCallDuration,
+		nodePingDuration,
+		nodeLeaseUpdateDuration,
+		podStartDuration,
+		reconciledPods,
+		queueDepth,
+		queueAdds,
+		queueLatency,
+		queueWorkDuration,
+		queueUnfinishedWork,
+		queueLongestRunningProcessor,
+		queueRetries,
+	}
+}
+
+// Register registers the collectors of virtual-kubelet's metrics with the given registerer.
+// The metrics are recorded whether or not they are registered, so they can be registered with any number of
+// registries.
+func Register(r prometheus.Registerer) error {
+	for _, c := range Collectors() {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// result returns the value of the "result" label for the given error. Not found errors are told apart from other
+// errors, since they are part of the normal operation of providers.
+func result(err error) string {
+	switch {
+	case err == nil:
+		return resultSuccess
+	case errdefs.IsNotFound(err):
+		return resultNotFound
+	default:
+		return resultError
+	}
+}
+
+// ObserveProviderCall records a call to the given method of the provider of the given node which started at the
+// given time, and returned the given error.
+func ObserveProviderCall(node, method string, start time.Time, err error) {
+	providerCallDuration.WithLabelValues(node, method, result(err)).Observe(time.Since(start).Seconds())
+}
+
+// ObservePing records a ping of the node provider of the given node which started at the given time, and returned
+// the given error.
+func ObservePing(node string, start time.Time, err error) {
+	nodePingDuration.WithLabelValues(node, result(err)).Observe(time.Since(start).Seconds())
+}
+
+// ObserveLeaseUpdate records an update of the lease of the given node which started at the given time, and returned
+// the given error.
+func ObserveLeaseUpdate(node string, start time.Time, err error) {
+	nodeLeaseUpdateDuration.WithLabelValues(node, result(err)).Observe(time.Since(start).Seconds())
+}
+
+// ObservePodStart records the time a pod of the given node took to be reported as running since it was scheduled.
+func ObservePodStart(node string, d time.Duration) {
+	podStartDuration.WithLabelValues(node).Observe(d.Seconds())
+}
+
+// IncReconciledPods counts a pod of the given node found out of sync between the provider and Kubernetes by the
+// reconciliation of the pod controller, along with the action taken and whether the reconciliation ran in dry-run
+// mode.
+func IncReconciledPods(node, action string, dryRun bool) {
+	reconciledPods.WithLabelValues(node, action, strconv.FormatBool(dryRun)).Inc()
+}
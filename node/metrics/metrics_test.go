@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestRegister(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	assert.NilError(t, Register(registry))
+	assert.Check(t, Register(registry) != nil, "registering the metrics twice with the same registry must fail")
+
+	// The metrics can be registered with several registries.
+	assert.NilError(t, Register(prometheus.NewRegistry()))
+}
+
+func TestResult(t *testing.T) {
+	assert.Check(t, is.Equal(result(nil), resultSuccess))
+	assert.Check(t, is.Equal(result(errdefs.NotFound("not found")), resultNotFound))
+	assert.Check(t, is.Equal(result(errors.Wrap(errdefs.NotFound("not found"), "wrapped")), resultNotFound))
+	assert.Check(t, is.Equal(result(errors.New("failed")), resultError))
+}
+
+func TestNodeLabel(t *testing.T) {
+	IncReconciledPods("node-1", "delete", false)
+	IncReconciledPods("node-2", "delete", false)
+	IncReconciledPods("node-2", "delete", false)
+	assert.Check(t, is.Equal(testutil.ToFloat64(reconciledPods.WithLabelValues("node-1", "delete", "false")), float64(1)))
+	assert.Check(t, is.Equal(testutil.ToFloat64(reconciledPods.WithLabelValues("node-2", "delete", "false")), float64(2)))
+}
+
+func TestWorkqueueMetrics(t *testing.T) {
+	RegisterWorkqueueMetrics()
+
+	const name = "TestWorkqueueMetrics"
+	q := workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(0, 0), name)
+	defer q.ShutDown()
+
+	q.Add("a")
+	q.Add("b")
+	q.AddRateLimited("c")
+	assert.Check(t, is.Equal(testutil.ToFloat64(queueAdds.WithLabelValues(name)), float64(3)))
+	assert.Check(t, is.Equal(testutil.ToFloat64(queueRetries.WithLabelValues(name)), float64(1)))
+	assert.Check(t, is.Equal(testutil.ToFloat64(queueDepth.WithLabelValues(name)), float64(3)))
+
+	item, _ := q.Get()
+	q.Done(item)
+	assert.Check(t, is.Equal(testutil.ToFloat64(queueDepth.WithLabelValues(name)), float64(2)))
+}
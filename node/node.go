@@ -18,17 +18,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	pkgerrors "github.com/pkg/errors"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/metrics"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
-	coord "k8s.io/api/coordination/v1beta1"
+	coord "k8s.io/api/coordination/v1"
+	coordv1beta1 "k8s.io/api/coordination/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes"
+	coordv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
 	"k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 )
@@ -75,13 +80,56 @@ func NewNodeController(p NodeProvider, node *corev1.Node, nodes v1.NodeInterface
 // NodeControllerOpt are the functional options used for configuring a node
 type NodeControllerOpt func(*NodeController) error // nolint: golint
 
+// WithNodeEnableLease enables support for leases, using the coordination.k8s.io/v1
+// API if it is served by the cluster and falling back to v1beta1 otherwise.
+// The API version is discovered when the node controller runs.
+// Leases are created in the "kube-node-lease" namespace.
+// If client is nil, leases will not be enabled.
+// If baseLease is nil, a default base lease will be used.
+//
+// See WithNodeEnableLeaseV1Beta1 for how leases affect node status updates.
+func WithNodeEnableLease(client kubernetes.Interface, baseLease *coord.Lease) NodeControllerOpt {
+	return func(n *NodeController) error {
+		n.leases = nil
+		n.leaseClientset = client
+		n.lease = baseLease
+		return nil
+	}
+}
+
+// WithNodeEnableLeaseV1 enables support for v1 leases.
+// If client is nil, leases will not be enabled.
+// If baseLease is nil, a default base lease will be used.
+//
+// See WithNodeEnableLeaseV1Beta1 for how leases affect node status updates.
+func WithNodeEnableLeaseV1(client coordv1.LeaseInterface, baseLease *coord.Lease) NodeControllerOpt {
+	return func(n *NodeController) error {
+		n.leases = nil
+		if client != nil {
+			n.leases = client
+		}
+		n.leaseClientset = nil
+		n.lease = baseLease
+		return nil
+	}
+}
+
 // WithNodeEnableLeaseV1Beta1 enables support for v1beta1 leases.
 // If client is nil, leases will not be enabled.
 // If baseLease is nil, a default base lease will be used.
 //
+// Each node controller takes over the node lease only if it is not held by
+// another holder, or if it has expired. Otherwise, the node controller waits
+// for it to be released or to expire, so that two node controllers managing
+// the same node do not fight over its lease. The holder identity defaults to
+// the node name: set it in the base lease to tell node controllers apart.
+// The lease is released as soon as Run returns.
+//
 // The lease will be updated after each successful node ping. To change the
 // lease update interval, you must set the node ping interval.
-// See WithNodePingInterval().
+// See WithNodePingInterval(). Unless set in the base lease, the lease duration
+// is leaseDurationPings ping intervals (40s with the default ping interval, as
+// for the kubelet).
 //
 // This also affects the frequency of node status updates:
 //   - When leases are *not* enabled (or are disabled due to no support on the cluster)
@@ -89,10 +137,14 @@ type NodeControllerOpt func(*NodeController) error // nolint: golint
 //   - When node leases are enabled, node status updates are controlled by the
 //     node status update interval option.
 // To set a custom node status update interval, see WithNodeStatusUpdateInterval().
-func WithNodeEnableLeaseV1Beta1(client v1beta1.LeaseInterface, baseLease *coord.Lease) NodeControllerOpt {
+func WithNodeEnableLeaseV1Beta1(client v1beta1.LeaseInterface, baseLease *coordv1beta1.Lease) NodeControllerOpt {
 	return func(n *NodeController) error {
-		n.leases = client
-		n.lease = baseLease
+		n.leases = nil
+		if client != nil {
+			n.leases = v1beta1LeaseClient{client}
+		}
+		n.leaseClientset = nil
+		n.lease = leaseFromV1beta1(baseLease)
 		return nil
 	}
 }
@@ -143,10 +195,15 @@ type ErrorHandler func(context.Context, error) error
 // NodeController manages a single node entity.
 type NodeController struct { // nolint: golint
 	p NodeProvider
-	n *corev1.Node
 
-	leases v1beta1.LeaseInterface
-	nodes  v1.NodeInterface
+	// nMu protects n from being read by Node() while it is being modified by the control loop.
+	nMu sync.Mutex
+	n   *corev1.Node
+
+	leases leaseClient
+	// leaseClientset is used to discover the lease API version served by the cluster, when leases is not set.
+	leaseClientset kubernetes.Interface
+	nodes          v1.NodeInterface
 
 	disableLease   bool
 	pingInterval   time.Duration
@@ -165,6 +222,9 @@ const (
 	DefaultStatusUpdateInterval = 1 * time.Minute
 )
 
+// leaseDurationPings is the number of ping intervals after which the node lease expires if it is not renewed.
+const leaseDurationPings = 4
+
 // Run registers the node in kubernetes and starts loops for updating the node
 // status in Kubernetes.
 //
@@ -187,35 +247,81 @@ func (n *NodeController) Run(ctx context.Context) error {
 
 	n.chStatusUpdate = make(chan *corev1.Node)
 	n.p.NotifyNodeStatus(ctx, func(node *corev1.Node) {
-		n.chStatusUpdate <- node
+		// Status updates are dropped once the controller is stopped, rather than blocking the provider.
+		select {
+		case n.chStatusUpdate <- node:
+		case <-ctx.Done():
+		}
 	})
 
 	if err := n.ensureNode(ctx); err != nil {
 		return err
 	}
 
+	if n.leases == nil && n.leaseClientset != nil {
+		leases, err := discoverLeaseClient(n.leaseClientset)
+		if err != nil {
+			return err
+		}
+		n.leases = leases
+	}
+
 	if n.leases == nil {
 		n.disableLease = true
 		return n.controlLoop(ctx)
 	}
 
-	n.lease = newLease(n.lease)
-	setLeaseAttrs(n.lease, n.n, n.pingInterval*5)
+	var (
+		l      *coord.Lease
+		err    error
+		logged bool
+	)
+	for {
+		n.lease = newLease(n.lease)
+		setLeaseAttrs(n.lease, n.n, n.pingInterval*leaseDurationPings)
 
-	l, err := ensureLease(ctx, n.leases, n.lease)
+		l, err = ensureLease(ctx, n.leases, n.lease)
+		if !isLeaseHeld(err) {
+			break
+		}
+		// Another node controller is likely managing the same node: wait for it to stop renewing the lease rather
+		// than fighting over it.
+		if !logged {
+			log.G(ctx).WithError(err).Warn("Node lease is held by another holder, waiting for it to be released or to expire")
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(n.pingInterval):
+		}
+	}
 	if err != nil {
 		if !errors.IsNotFound(err) {
 			return pkgerrors.Wrap(err, "error creating node lease")
 		}
-		log.G(ctx).Info("Node leases not supported, falling back to only node status updates")
+		log.G(ctx).Warn("Node leases not supported, falling back to only node status updates")
 		n.disableLease = true
 	}
 	n.lease = l
+	if !n.disableLease {
+		// Release the lease as soon as the node is no longer managed, so that another node controller can take over
+		// right away rather than waiting for it to expire.
+		defer n.releaseLease(ctx)
+	}
 
 	log.G(ctx).Debug("Created node lease")
 	return n.controlLoop(ctx)
 }
 
+func (n *NodeController) releaseLease(ctx context.Context) {
+	if err := deleteNodeLease(n.leases, n.lease); err != nil {
+		log.G(ctx).WithError(err).Warn("Error releasing node lease")
+		return
+	}
+	log.G(ctx).Debug("Released node lease")
+}
+
 func (n *NodeController) ensureNode(ctx context.Context) error {
 	err := n.updateStatus(ctx, true)
 	if err == nil || !errors.IsNotFound(err) {
@@ -226,7 +332,7 @@ func (n *NodeController) ensureNode(ctx context.Context) error {
 	if err != nil {
 		return pkgerrors.Wrap(err, "error registering node with kubernetes")
 	}
-	n.n = node
+	n.setNode(node)
 
 	return nil
 }
@@ -277,7 +383,9 @@ func (n *NodeController) controlLoop(ctx context.Context) error {
 				<-t.C
 			}
 
+			n.nMu.Lock()
 			n.n.Status = updated.Status
+			n.nMu.Unlock()
 			if err := n.updateStatus(ctx, false); err != nil {
 				log.G(ctx).WithError(err).Error("Error handling node status update")
 			}
@@ -305,7 +413,10 @@ func (n *NodeController) handlePing(ctx context.Context) (retErr error) {
 		span.SetStatus(retErr)
 	}()
 
-	if err := n.p.Ping(ctx); err != nil {
+	start := time.Now()
+	err := n.p.Ping(ctx)
+	metrics.ObservePing(n.n.Name, start, err)
+	if err != nil {
 		return pkgerrors.Wrap(err, "error while pinging the node provider")
 	}
 
@@ -317,7 +428,9 @@ func (n *NodeController) handlePing(ctx context.Context) (retErr error) {
 }
 
 func (n *NodeController) updateLease(ctx context.Context) error {
+	start := time.Now()
 	l, err := updateNodeLease(ctx, n.leases, newLease(n.lease))
+	metrics.ObserveLeaseUpdate(n.n.Name, start, err)
 	if err != nil {
 		return err
 	}
@@ -327,7 +440,9 @@ func (n *NodeController) updateLease(ctx context.Context) error {
 }
 
 func (n *NodeController) updateStatus(ctx context.Context, skipErrorCb bool) error {
+	n.nMu.Lock()
 	updateNodeStatusHeartbeat(n.n)
+	n.nMu.Unlock()
 
 	node, err := updateNodeStatus(ctx, n.nodes, n.n)
 	if err != nil {
@@ -344,27 +459,131 @@ func (n *NodeController) updateStatus(ctx context.Context, skipErrorCb bool) err
 		}
 	}
 
-	n.n = node
+	n.setNode(node)
 	return nil
 }
 
-func ensureLease(ctx context.Context, leases v1beta1.LeaseInterface, lease *coord.Lease) (*coord.Lease, error) {
+// Shutdown reports the node as not ready in Kubernetes, since it is no longer managed, and then deletes the node if
+// deleteNode is set. The node lease has already been released by Run: if another node controller has taken it over
+// since, the node is left untouched.
+//
+// Shutdown must only be called once Run has returned. It does nothing if the node controller never became ready, e.g.
+// because the node lease is held by another node controller which is still managing the node.
+func (n *NodeController) Shutdown(ctx context.Context, deleteNode bool) error {
+	select {
+	case <-n.chReady:
+	default:
+		return nil
+	}
+
+	if n.leases != nil && !n.disableLease {
+		if l, err := n.leases.Get(n.lease.Name, emptyGetOptions); err == nil && leaseHolder(l) != leaseHolder(n.lease) {
+			log.G(ctx).WithField("holder", leaseHolder(l)).Info("Node lease has been taken over, leaving the node to its new holder")
+			return nil
+		}
+	}
+
+	now := metav1.Now()
+	n.nMu.Lock()
+	setNodeCondition(&n.n.Status, corev1.NodeCondition{
+		Type:               corev1.NodeReady,
+		Status:             corev1.ConditionFalse,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             nodeConditionReasonShutdown,
+		Message:            "The node is shutting down",
+	})
+	n.nMu.Unlock()
+	if err := n.updateStatus(ctx, true); err != nil {
+		return pkgerrors.Wrap(err, "error marking node as not ready")
+	}
+	log.G(ctx).Info("Marked node as not ready")
+
+	if !deleteNode {
+		return nil
+	}
+
+	if err := n.nodes.Delete(n.n.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		return pkgerrors.Wrap(err, "error deleting node")
+	}
+	log.G(ctx).Info("Deleted node")
+	return nil
+}
+
+func (n *NodeController) setNode(node *corev1.Node) {
+	n.nMu.Lock()
+	n.n = node
+	n.nMu.Unlock()
+}
+
+// Node returns a copy of the node object managed by the controller.
+// Once the node has been registered, this reflects the node as last seen in Kubernetes.
+func (n *NodeController) Node() *corev1.Node {
+	n.nMu.Lock()
+	defer n.nMu.Unlock()
+	return n.n.DeepCopy()
+}
+
+// ensureLease creates the node lease.
+//
+// If the lease already exists, it is taken over only if it is held by the same
+// holder, or if it has expired. Otherwise, a *leaseHeldError is returned.
+func ensureLease(ctx context.Context, leases leaseClient, lease *coord.Lease) (*coord.Lease, error) {
 	l, err := leases.Create(lease)
+	switch {
+	case err == nil:
+		return l, nil
+	case errors.IsNotFound(err):
+		log.G(ctx).WithError(err).Info("Node lease not supported")
+		return nil, err
+	case !errors.IsAlreadyExists(err):
+		return nil, err
+	}
+
+	existing, err := leases.Get(lease.Name, emptyGetOptions)
 	if err != nil {
-		switch {
-		case errors.IsNotFound(err):
-			log.G(ctx).WithError(err).Info("Node lease not supported")
-			return nil, err
-		case errors.IsAlreadyExists(err):
-			if err := leases.Delete(lease.Name, nil); err != nil && !errors.IsNotFound(err) {
-				log.G(ctx).WithError(err).Error("could not delete old node lease")
-				return nil, pkgerrors.Wrap(err, "old lease exists but could not delete it")
-			}
-			l, err = leases.Create(lease)
+		return nil, pkgerrors.Wrap(err, "old lease exists but could not get it")
+	}
+	holder := leaseHolder(existing)
+	if holder != "" && holder != leaseHolder(lease) {
+		if !leaseExpired(existing, time.Now()) {
+			return nil, &leaseHeldError{name: lease.Name, holder: holder}
+		}
+		log.G(ctx).WithField("holder", holder).Warn("Taking over expired node lease")
+	}
+
+	lease = lease.DeepCopy()
+	lease.ResourceVersion = existing.ResourceVersion
+	if holder != leaseHolder(lease) {
+		transitions := int32(1)
+		if existing.Spec.LeaseTransitions != nil {
+			transitions += *existing.Spec.LeaseTransitions
 		}
+		lease.Spec.LeaseTransitions = &transitions
+		lease.Spec.AcquireTime = &metav1.MicroTime{Time: time.Now()}
 	}
+	return leases.Update(lease)
+}
 
-	return l, err
+// deleteNodeLease deletes the node lease, unless it has been taken over by another holder in the meantime.
+func deleteNodeLease(leases leaseClient, lease *coord.Lease) error {
+	existing, err := leases.Get(lease.Name, emptyGetOptions)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if leaseHolder(existing) != leaseHolder(lease) {
+		return nil
+	}
+	err = leases.Delete(lease.Name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &existing.ResourceVersion},
+	})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
 }
 
 // updateNodeLease updates the node lease.
@@ -372,7 +591,7 @@ func ensureLease(ctx context.Context, leases v1beta1.LeaseInterface, lease *coor
 // If this function returns an errors.IsNotFound(err) error, this likely means
 // that node leases are not supported, if this is the case, call updateNodeStatus
 // instead.
-func updateNodeLease(ctx context.Context, leases v1beta1.LeaseInterface, lease *coord.Lease) (*coord.Lease, error) {
+func updateNodeLease(ctx context.Context, leases leaseClient, lease *coord.Lease) (*coord.Lease, error) {
 	ctx, span := trace.StartSpan(ctx, "node.UpdateNodeLease")
 	defer span.End()
 
@@ -504,7 +723,7 @@ func setLeaseAttrs(l *coord.Lease, n *corev1.Node, dur time.Duration) {
 	}
 
 	if l.Spec.LeaseDurationSeconds == nil {
-		d := int32(dur.Seconds()) * 5
+		d := int32(dur.Seconds())
 		l.Spec.LeaseDurationSeconds = &d
 	}
 }
@@ -22,6 +22,7 @@ import (
 
 	"gotest.tools/assert"
 	"gotest.tools/assert/cmp"
+	coordv1 "k8s.io/api/coordination/v1"
 	coord "k8s.io/api/coordination/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -222,7 +223,7 @@ func TestNodeCustomUpdateStatusErrorHandler(t *testing.T) {
 }
 
 func TestEnsureLease(t *testing.T) {
-	c := testclient.NewSimpleClientset().CoordinationV1beta1().Leases(corev1.NamespaceNodeLease)
+	c := testclient.NewSimpleClientset().CoordinationV1().Leases(corev1.NamespaceNodeLease)
 	n := testNode(t)
 	ctx := context.Background()
 
@@ -239,6 +240,130 @@ func TestEnsureLease(t *testing.T) {
 	assert.Check(t, timeEqual(l2.Spec.RenewTime.Time, l1.Spec.RenewTime.Time))
 }
 
+func TestEnsureLeaseHeldByAnotherHolder(t *testing.T) {
+	c := testclient.NewSimpleClientset().CoordinationV1().Leases(corev1.NamespaceNodeLease)
+	n := testNode(t)
+	ctx := context.Background()
+
+	holder := "other"
+	other := newLease(nil)
+	other.Spec.HolderIdentity = &holder
+	setLeaseAttrs(other, n, time.Minute)
+	_, err := c.Create(other)
+	assert.NilError(t, err)
+
+	lease := newLease(nil)
+	setLeaseAttrs(lease, n, 1*time.Second)
+	_, err = ensureLease(ctx, c, lease.DeepCopy())
+	assert.Check(t, isLeaseHeld(err), err)
+
+	// The lease must not have been deleted or taken over.
+	l, err := c.Get(lease.Name, emptyGetOptions)
+	assert.NilError(t, err)
+	assert.Check(t, cmp.Equal(leaseHolder(l), "other"))
+
+	// Expired leases are taken over.
+	l.Spec.RenewTime.Time = time.Now().Add(-time.Hour)
+	_, err = c.Update(l)
+	assert.NilError(t, err)
+	l, err = ensureLease(ctx, c, lease.DeepCopy())
+	assert.NilError(t, err)
+	assert.Check(t, cmp.Equal(leaseHolder(l), n.Name))
+	assert.Assert(t, l.Spec.LeaseTransitions != nil)
+	assert.Check(t, cmp.Equal(*l.Spec.LeaseTransitions, int32(1)))
+}
+
+func TestNodeLeaseSharedNodeName(t *testing.T) {
+	c := testclient.NewSimpleClientset()
+	nodes := c.CoreV1().Nodes()
+	leases := c.CoordinationV1().Leases(corev1.NamespaceNodeLease)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Two node controllers manage the same node from different processes, each with its own holder identity. The
+	// lease does not expire during the test, so that it can only be taken over once released.
+	leaseDuration := int32(time.Hour.Seconds())
+	newController := func(holder string) (*NodeController, context.CancelFunc, <-chan error) {
+		base := &coordv1.Lease{Spec: coordv1.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &leaseDuration}}
+		node, err := NewNodeController(&NaiveNodeProvider{}, testNode(t), nodes,
+			WithNodeEnableLeaseV1(leases, base),
+			WithNodePingInterval(10*time.Millisecond),
+		)
+		assert.NilError(t, err)
+		ctx, cancel := context.WithCancel(ctx)
+		chErr := make(chan error, 1)
+		go func() {
+			chErr <- node.Run(ctx)
+		}()
+		return node, cancel, chErr
+	}
+
+	first, cancelFirst, firstErr := newController("first")
+	select {
+	case <-first.Ready():
+	case err := <-firstErr:
+		t.Fatalf("node.Run returned earlier than expected: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for node to be ready")
+	}
+
+	second, cancelSecond, secondErr := newController("second")
+	defer cancelSecond()
+	select {
+	case <-second.Ready():
+		t.Fatal("the node lease must not be taken over while it is held by another holder")
+	case err := <-secondErr:
+		t.Fatalf("node.Run returned earlier than expected: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	l, err := leases.Get(testNode(t).Name, emptyGetOptions)
+	assert.NilError(t, err)
+	assert.Check(t, cmp.Equal(leaseHolder(l), "first"))
+
+	// Once the first node controller stops, it releases its lease and the second one takes over.
+	cancelFirst()
+	assert.NilError(t, <-firstErr)
+	select {
+	case <-second.Ready():
+	case err := <-secondErr:
+		t.Fatalf("node.Run returned earlier than expected: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the node lease to be taken over")
+	}
+	l, err = leases.Get(l.Name, emptyGetOptions)
+	assert.NilError(t, err)
+	assert.Check(t, cmp.Equal(leaseHolder(l), "second"))
+
+	// The first node controller must leave the node to the second one when shutting down.
+	assert.NilError(t, first.Shutdown(ctx, true))
+	_, err = nodes.Get(testNode(t).Name, emptyGetOptions)
+	assert.NilError(t, err)
+}
+
+func TestDiscoverLeaseClient(t *testing.T) {
+	c := testclient.NewSimpleClientset()
+	leases, err := discoverLeaseClient(c)
+	assert.NilError(t, err)
+	_, ok := leases.(v1beta1LeaseClient)
+	assert.Check(t, ok, "v1beta1 leases must be used when the cluster does not serve v1 leases")
+
+	c.Resources = []*metav1.APIResourceList{{
+		GroupVersion: coordv1.SchemeGroupVersion.String(),
+		APIResources: []metav1.APIResource{{Name: "leases", Namespaced: true, Kind: "Lease"}},
+	}}
+	leases, err = discoverLeaseClient(c)
+	assert.NilError(t, err)
+	_, ok = leases.(v1beta1LeaseClient)
+	assert.Check(t, !ok, "v1 leases must be used when the cluster serves them")
+
+	// Leases are converted between the two versions.
+	lease := newLease(nil)
+	setLeaseAttrs(lease, testNode(t), 1*time.Second)
+	l, err := v1beta1LeaseClient{c.CoordinationV1beta1().Leases(corev1.NamespaceNodeLease)}.Create(lease)
+	assert.NilError(t, err)
+	assert.Check(t, cmp.DeepEqual(l.Spec, lease.Spec))
+}
+
 func TestUpdateNodeStatus(t *testing.T) {
 	n := testNode(t)
 	n.Status.Conditions = append(n.Status.Conditions, corev1.NodeCondition{
@@ -276,7 +401,7 @@ func TestUpdateNodeStatus(t *testing.T) {
 }
 
 func TestUpdateNodeLease(t *testing.T) {
-	leases := testclient.NewSimpleClientset().CoordinationV1beta1().Leases(corev1.NamespaceNodeLease)
+	leases := testclient.NewSimpleClientset().CoordinationV1().Leases(corev1.NamespaceNodeLease)
 	lease := newLease(nil)
 	n := testNode(t)
 	setLeaseAttrs(lease, n, 0)
@@ -374,6 +499,52 @@ func TestPingAfterStatusUpdate(t *testing.T) {
 	assert.Assert(t, testP.maxPingInterval < maxAllowedInterval, "maximum time between node pings (%v) was greater than the maximum expected interval (%v)", testP.maxPingInterval, maxAllowedInterval)
 }
 
+func TestNodeShutdown(t *testing.T) {
+	c := testclient.NewSimpleClientset()
+	testP := &testNodeProvider{NodeProvider: &NaiveNodeProvider{}}
+	nodes := c.CoreV1().Nodes()
+	leases := c.CoordinationV1().Leases(corev1.NamespaceNodeLease)
+
+	node, err := NewNodeController(testP, testNode(t), nodes, WithNodeEnableLeaseV1(leases, nil))
+	assert.NilError(t, err)
+	name := node.n.Name
+
+	// Shutting down a node controller which never became ready leaves the node alone.
+	assert.NilError(t, node.Shutdown(context.Background(), true))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chErr := make(chan error, 1)
+	go func() {
+		chErr <- node.Run(ctx)
+	}()
+	select {
+	case <-node.Ready():
+	case err := <-chErr:
+		t.Fatalf("node.Run returned earlier than expected: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for node to be ready")
+	}
+	cancel()
+	assert.NilError(t, <-chErr)
+	_, err = leases.Get(name, metav1.GetOptions{})
+	assert.Check(t, errors.IsNotFound(err), "lease must be released once Run returns: %v", err)
+
+	// Status updates must not block the provider once the node controller is stopped.
+	testP.triggerStatusUpdate(node.Node())
+
+	assert.NilError(t, node.Shutdown(context.Background(), false))
+	n, err := nodes.Get(name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	ready := findNodeCondition(&n.Status, corev1.NodeReady)
+	assert.Assert(t, ready != nil)
+	assert.Check(t, cmp.Equal(ready.Status, corev1.ConditionFalse))
+	assert.Check(t, cmp.Equal(ready.Reason, nodeConditionReasonShutdown))
+
+	assert.NilError(t, node.Shutdown(context.Background(), true))
+	_, err = nodes.Get(name, metav1.GetOptions{})
+	assert.Check(t, errors.IsNotFound(err), "node must be deleted: %v", err)
+}
+
 func testNode(t *testing.T) *corev1.Node {
 	n := &corev1.Node{}
 	n.Name = strings.ToLower(t.Name())
@@ -16,10 +16,14 @@ package node
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/metrics"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -36,6 +40,7 @@ const (
 	podEventDeleteSuccess         = "ProviderDeleteSuccess"
 	podEventUpdateFailed          = "ProviderUpdateFailed"
 	podEventUpdateSuccess         = "ProviderUpdateSuccess"
+	podEventMaxRetriesExceeded    = "MaxRetriesExceeded"
 )
 
 func addPodAttributes(ctx context.Context, span trace.Span, pod *corev1.Pod) context.Context {
@@ -61,11 +66,63 @@ func (pc *PodController) createOrUpdatePod(ctx context.Context, pod *corev1.Pod)
 
 	// We do this so we don't mutate the pod from the informer cache
 	pod = pod.DeepCopy()
-	if err := populateEnvironmentVariables(ctx, pod, pc.resourceManager, pc.recorder); err != nil {
+	var node *corev1.Node
+	if pc.getNode != nil {
+		node = pc.getNode()
+	}
+
+	var kPod *knownPod
+	if key, err := cache.MetaNamespaceKeyFunc(pod); err == nil {
+		if obj, ok := pc.knownPods.Load(key); ok {
+			kPod = obj.(*knownPod)
+		}
+	}
+
+	// Resolve the pod's IPs first, so that the environment variables and volumes referencing them can be populated
+	// before the provider starts the pod's containers.
+	var podIPs []string
+	if podReferencesStatusIPs(pod) {
+		ips, err := pc.resolvePodIPs(ctx, pod, kPod)
+		if err != nil {
+			span.SetStatus(err)
+			return err
+		}
+		if ips != nil {
+			podIPs = ips.PodIPs
+			pod.Status.PodIP = ips.primary()
+			pod.Status.HostIP = ips.HostIP
+		}
+		if kPod != nil {
+			kPod.Lock()
+			kPod.podIPs = ips
+			kPod.Unlock()
+		}
+	}
+
+	if err := populateEnvironmentVariables(ctx, pod, node, podIPs, pc.resourceManager, pc.recorder); err != nil {
 		span.SetStatus(err)
 		return err
 	}
 
+	// The contents of the pod's volumes are only resolved for providers which want them, and may change without the
+	// pod itself changing (e.g. when a referenced configmap is updated).
+	var (
+		volumes        PodVolumes
+		volumesChanged bool
+	)
+	if pc.volumeHandler != nil {
+		var err error
+		if volumes, err = resolveVolumes(ctx, pod, node, podIPs, pc.resourceManager, pc.recorder); err != nil {
+			span.SetStatus(err)
+			return err
+		}
+		if kPod != nil {
+			kPod.Lock()
+			volumesChanged = !cmp.Equal(kPod.volumes, volumes, cmpopts.EquateEmpty())
+			kPod.Unlock()
+		}
+	}
+
 	// We have to use a  different pod that we pass to the provider than the one that gets used in handleProviderError
 	// because the provider  may manipulate the pod in a separate goroutine while we were doing work
 	podForProvider := pod.DeepCopy()
@@ -74,9 +131,11 @@ func (pc *PodController) createOrUpdatePod(ctx context.Context, pod *corev1.Pod)
 	// NOTE: Some providers return a non-nil error in their GetPod implementation when the pod is not found while some other don't.
 	// Hence, we ignore the error and just act upon the pod if it is non-nil (meaning that the provider still knows about the pod).
 	if podFromProvider, _ := pc.provider.GetPod(ctx, pod.Namespace, pod.Name); podFromProvider != nil {
-		if !podsEqual(podFromProvider, podForProvider) {
+		// Pods which the provider already knows about (e.g. after a restart) are considered admitted.
+		setAdmitted(kPod, pod)
+		if !podsEqual(podFromProvider, podForProvider) || volumesChanged {
 			log.G(ctx).Debugf("Pod %s exists, updating pod in provider", podFromProvider.Name)
-			if origErr := pc.provider.UpdatePod(ctx, podForProvider); origErr != nil {
+			if origErr := pc.updatePodInProvider(ctx, podForProvider, volumes); origErr != nil {
 				pc.handleProviderError(ctx, span, origErr, pod)
 				pc.recorder.Event(pod, corev1.EventTypeWarning, podEventUpdateFailed, origErr.Error())
 
@@ -87,7 +146,14 @@ func (pc *PodController) createOrUpdatePod(ctx context.Context, pod *corev1.Pod)
 
 		}
 	} else {
-		if origErr := pc.provider.CreatePod(ctx, podForProvider); origErr != nil {
+		if result := pc.admitPod(ctx, pod, kPod, node); !result.Admit {
+			if err := pc.rejectPod(ctx, pod, result); err != nil {
+				span.SetStatus(err)
+				return err
+			}
+			return nil
+		}
+		if origErr := pc.createPodInProvider(ctx, podForProvider, volumes); origErr != nil {
 			pc.handleProviderError(ctx, span, origErr, pod)
 			pc.recorder.Event(pod, corev1.EventTypeWarning, podEventCreateFailed, origErr.Error())
 			return origErr
@@ -95,9 +161,31 @@ func (pc *PodController) createOrUpdatePod(ctx context.Context, pod *corev1.Pod)
 		log.G(ctx).Info("Created pod in provider")
 		pc.recorder.Event(pod, corev1.EventTypeNormal, podEventCreateSuccess, "Create pod in provider successfully")
 	}
+
+	if pc.volumeHandler != nil && kPod != nil {
+		kPod.Lock()
+		kPod.volumes = volumes
+		kPod.Unlock()
+	}
 	return nil
 }
 
+// createPodInProvider creates the pod in the provider, handing it the resolved volumes if it implements PodVolumeHandler.
+func (pc *PodController) createPodInProvider(ctx context.Context, pod *corev1.Pod, volumes PodVolumes) error {
+	if pc.volumeHandler != nil {
+		return pc.volumeHandler.CreatePodWithVolumes(ctx, pod, volumes)
+	}
+	return pc.provider.CreatePod(ctx, pod)
+}
+
+// updatePodInProvider updates the pod in the provider, handing it the resolved volumes if it implements PodVolumeHandler.
+func (pc *PodController) updatePodInProvider(ctx context.Context, pod *corev1.Pod, volumes PodVolumes) error {
+	if pc.volumeHandler != nil {
+		return pc.volumeHandler.UpdatePodWithVolumes(ctx, pod, volumes)
+	}
+	return pc.provider.UpdatePod(ctx, pod)
+}
+
 // podsEqual checks if two pods are equal according to the fields we know that are allowed
 // to be modified after startup time.
 func podsEqual(pod1, pod2 *corev1.Pod) bool {
@@ -120,22 +208,33 @@ func podsEqual(pod1, pod2 *corev1.Pod) bool {
 }
 
 func (pc *PodController) handleProviderError(ctx context.Context, span trace.Span, origErr error, pod *corev1.Pod) {
+	if pkgerrors.Cause(origErr) == errCircuitOpen {
+		// The pod is not failed since the provider was not called, and it is synced again once the provider recovers.
+		span.SetStatus(origErr)
+		return
+	}
+
 	podPhase := corev1.PodPending
 	if pod.Spec.RestartPolicy == corev1.RestartPolicyNever {
 		podPhase = corev1.PodFailed
 	}
 
-	pod.ResourceVersion = "" // Blank out resource version to prevent object has been modified error
-	pod.Status.Phase = podPhase
-	pod.Status.Reason = podStatusReasonProviderFailed
-	pod.Status.Message = origErr.Error()
+	// The status is patched against the pod from Kubernetes, as the given pod may have been amended for the provider.
+	current := pod
+	if p, err := pc.podsLister.Pods(pod.Namespace).Get(pod.Name); err == nil {
+		current = p
+	}
+	status := current.Status.DeepCopy()
+	status.Phase = podPhase
+	status.Reason = podStatusReasonProviderFailed
+	status.Message = origErr.Error()
 
 	logger := log.G(ctx).WithFields(log.Fields{
 		"podPhase": podPhase,
-		"reason":   pod.Status.Reason,
+		"reason":   status.Reason,
 	})
 
-	_, err := pc.client.Pods(pod.Namespace).UpdateStatus(pod)
+	err := pc.patchPodStatus(ctx, current, status)
 	if err != nil {
 		logger.WithError(err).Warn("Failed to update pod status")
 	} else {
@@ -144,12 +243,19 @@ func (pc *PodController) handleProviderError(ctx context.Context, span trace.Spa
 	span.SetStatus(origErr)
 }
 
-func (pc *PodController) deletePod(ctx context.Context, pod *corev1.Pod) error {
+// deletePod deletes the pod in the provider, passing it the grace period if it implements GracefulPodDeleter.
+func (pc *PodController) deletePod(ctx context.Context, pod *corev1.Pod, gracePeriod time.Duration) error {
 	ctx, span := trace.StartSpan(ctx, "deletePod")
 	defer span.End()
 	ctx = addPodAttributes(ctx, span, pod)
+	ctx = span.WithField(ctx, "gracePeriod", gracePeriod)
 
-	err := pc.provider.DeletePod(ctx, pod.DeepCopy())
+	var err error
+	if d, ok := pc.provider.(GracefulPodDeleter); ok {
+		err = d.DeletePodWithGracePeriod(ctx, pod.DeepCopy(), gracePeriod)
+	} else {
+		err = pc.provider.DeletePod(ctx, pod.DeepCopy())
+	}
 	if err != nil {
 		span.SetStatus(err)
 		pc.recorder.Event(pod, corev1.EventTypeWarning, podEventDeleteFailed, err.Error())
@@ -184,12 +290,15 @@ func (pc *PodController) updatePodStatus(ctx context.Context, podFromKubernetes
 	kPod := obj.(*knownPod)
 	kPod.Lock()
 	podFromProvider := kPod.lastPodStatusReceivedFromProvider.DeepCopy()
+	observeStart := !kPod.startObserved && podFromProvider.Status.Phase == corev1.PodRunning
+	kPod.startObserved = kPod.startObserved || observeStart
 	kPod.Unlock()
-	// We need to do this because the other parts of the pod can be updated elsewhere. Since we're only updating
-	// the pod status, and we should be the sole writers of the pod status, we can blind overwrite it. Therefore
-	// we need to copy the pod and set ResourceVersion to 0.
-	podFromProvider.ResourceVersion = "0"
-	if _, err := pc.client.Pods(podFromKubernetes.Namespace).UpdateStatus(podFromProvider); err != nil {
+	if observeStart {
+		metrics.ObservePodStart(pc.nodeName, time.Since(podScheduledTime(podFromKubernetes)))
+	}
+	// Only the fields of the status owned by virtual-kubelet are patched, so that the fields written by other
+	// controllers (such as the conditions of readiness gates) are preserved.
+	if err := pc.patchPodStatus(ctx, podFromKubernetes, &podFromProvider.Status); err != nil {
 		span.SetStatus(err)
 		return pkgerrors.Wrap(err, "error while updating pod status in kubernetes")
 	}
@@ -204,6 +313,17 @@ func (pc *PodController) updatePodStatus(ctx context.Context, podFromKubernetes
 	return nil
 }
 
+// podScheduledTime returns when the pod was scheduled to the node, falling back to its creation time for pods without
+// a PodScheduled condition.
+func podScheduledTime(pod *corev1.Pod) time.Time {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodScheduled && c.Status == corev1.ConditionTrue {
+			return c.LastTransitionTime.Time
+		}
+	}
+	return pod.CreationTimestamp.Time
+}
+
 // enqueuePodStatusUpdate updates our pod status map, and marks the pod as dirty in the workqueue. The pod must be DeepCopy'd
 // prior to enqueuePodStatusUpdate.
 func (pc *PodController) enqueuePodStatusUpdate(ctx context.Context, q workqueue.RateLimitingInterface, pod *corev1.Pod) {
@@ -211,6 +331,9 @@ func (pc *PodController) enqueuePodStatusUpdate(ctx context.Context, q workqueue
 		log.G(ctx).WithError(err).WithField("method", "enqueuePodStatusUpdate").Error("Error getting pod meta namespace key")
 	} else {
 		if obj, ok := pc.knownPods.Load(key); ok {
+			pc.applyContainerRestarts(ctx, key, pod)
+			pc.syncProbes(ctx, key, pod)
+
 			kpod := obj.(*knownPod)
 			kpod.Lock()
 			if cmp.Equal(kpod.lastPodStatusReceivedFromProvider, pod) {
@@ -218,12 +341,38 @@ func (pc *PodController) enqueuePodStatusUpdate(ctx context.Context, q workqueue
 				return
 			}
 			kpod.lastPodStatusReceivedFromProvider = pod
+			// If the pod's environment or volumes were resolved without knowing its IPs (or with different ones), it
+			// must be synced to the provider again now that the IPs have been reported.
+			resync := (kpod.lastPodUsed == nil || podReferencesStatusIPs(kpod.lastPodUsed)) && podIPsChanged(kpod.podIPs, &pod.Status)
+			if resync {
+				kpod.lastPodUsed = nil
+			}
 			kpod.Unlock()
-			q.AddRateLimited(key)
+			pc.queuePodStatusUpdate(q, key)
+			if resync {
+				log.G(ctx).WithField("key", key).Debug("Requeuing pod as the provider reported new pod IPs")
+				pc.k8sQ.AddRateLimited(key)
+			}
 		}
 	}
 }
 
+// applyContainerRestarts amends the status of the pod reported by the provider with the restarts of its containers,
+// and queues the pod for its terminated containers to be restarted, if container restarts are enabled.
+func (pc *PodController) applyContainerRestarts(ctx context.Context, key string, pod *corev1.Pod) {
+	if pc.restarts == nil {
+		return
+	}
+	k8sPod, err := pc.podsLister.Pods(pod.Namespace).Get(pod.Name)
+	if err != nil || k8sPod.DeletionTimestamp != nil {
+		return
+	}
+	if pc.restarts.updateStatus(key, k8sPod.Spec.RestartPolicy, pod) {
+		log.G(ctx).WithField("key", key).Debug("Queuing pod for its terminated containers to be restarted")
+		pc.restarts.q.Add(key)
+	}
+}
+
 func (pc *PodController) podStatusHandler(ctx context.Context, key string) (retErr error) {
 	ctx, span := trace.StartSpan(ctx, "podStatusHandler")
 	defer span.End()
@@ -291,6 +440,11 @@ func (pc *PodController) deletePodHandler(ctx context.Context, key string) (retE
 
 	if running(&k8sPod.Status) {
 		log.G(ctx).Error("Force deleting pod in running state")
+		// The grace period has ended, so the pod is killed in the provider before being deleted from Kubernetes.
+		if err := pc.deletePod(ctx, k8sPod, 0); err != nil && !errdefs.IsNotFound(err) {
+			span.SetStatus(err)
+			return pkgerrors.Wrap(err, "failed to kill pod in the provider")
+		}
 	}
 
 	// We don't check with the provider before doing this delete. At this point, even if an outstanding pod status update
@@ -25,7 +25,6 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
-	"k8s.io/client-go/util/workqueue"
 )
 
 type TestController struct {
@@ -34,26 +33,33 @@ type TestController struct {
 	client *fake.Clientset
 }
 
-func newTestController() *TestController {
+// newTestController creates a pod controller backed by the mock provider, using NewPodController and its defaults.
+// The config can be changed by the given functions, which are handed the mock provider so that they can wrap it.
+func newTestController(opts ...func(*PodControllerConfig, *mockProviderAsync)) *TestController {
 	fk8s := fake.NewSimpleClientset()
 
-	rm := testutil.FakeResourceManager()
 	p := newMockProvider()
 	iFactory := kubeinformers.NewSharedInformerFactoryWithOptions(fk8s, 10*time.Minute)
+	cfg := PodControllerConfig{
+		PodClient:         fk8s.CoreV1(),
+		PodInformer:       iFactory.Core().V1().Pods(),
+		EventRecorder:     testutil.FakeEventRecorder(5),
+		Provider:          p,
+		ConfigMapInformer: iFactory.Core().V1().ConfigMaps(),
+		SecretInformer:    iFactory.Core().V1().Secrets(),
+		ServiceInformer:   iFactory.Core().V1().Services(),
+	}
+	for _, opt := range opts {
+		opt(&cfg, p)
+	}
+	pc, err := NewPodController(cfg)
+	if err != nil {
+		panic(err)
+	}
 	return &TestController{
-		PodController: &PodController{
-			client:          fk8s.CoreV1(),
-			provider:        p,
-			resourceManager: rm,
-			recorder:        testutil.FakeEventRecorder(5),
-			k8sQ:            workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
-			deletionQ:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
-			done:            make(chan struct{}),
-			ready:           make(chan struct{}),
-			podsInformer:    iFactory.Core().V1().Pods(),
-		},
-		mock:   p,
-		client: fk8s,
+		PodController: pc,
+		mock:          p,
+		client:        fk8s,
 	}
 }
 
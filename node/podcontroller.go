@@ -34,6 +34,7 @@ import (
 	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/client-go/util/workqueue"
 )
 
@@ -87,15 +88,96 @@ type PodNotifier interface {
 	NotifyPods(context.Context, func(*corev1.Pod))
 }
 
+// PodIPAllocator is an optional interface that providers can implement to assign IPs to a pod before it is created.
+// This allows environment variables and downward API volumes referencing "status.podIP", "status.podIPs" and
+// "status.hostIP" to be resolved before the pod's containers are started.
+//
+// Providers which do not implement this interface can instead report the pod's IPs through NotifyPods (or
+// GetPodStatus) before starting its containers. The pod is then updated in the provider with the resolved
+// environment and volumes.
+type PodIPAllocator interface {
+	// AllocatePodIPs assigns IPs to the given pod.
+	// It is called at most once per pod as long as the IPs are not reported back with a different primary IP.
+	// The IPs are also set in the status of the pod passed to CreatePod.
+	AllocatePodIPs(ctx context.Context, pod *corev1.Pod) (*PodIPs, error)
+}
+
+// PodVolumeHandler is an optional interface that providers can implement to receive the contents of the pod's
+// configmap, secret, projected and downward API volumes, as resolved by the pod controller, along with the pod.
+// This saves providers from looking up the referenced configmaps and secrets on their own.
+// When implemented, CreatePodWithVolumes and UpdatePodWithVolumes are called instead of CreatePod and UpdatePod.
+type PodVolumeHandler interface {
+	// CreatePodWithVolumes takes a Kubernetes Pod and the contents of its volumes, and deploys it within the provider.
+	CreatePodWithVolumes(ctx context.Context, pod *corev1.Pod, volumes PodVolumes) error
+
+	// UpdatePodWithVolumes takes a Kubernetes Pod and the contents of its volumes, and updates it within the provider.
+	// It is also called when only the contents of the volumes have changed, such as when a referenced configmap or
+	// secret is updated.
+	UpdatePodWithVolumes(ctx context.Context, pod *corev1.Pod, volumes PodVolumes) error
+}
+
+// ContainerRestarter is an optional interface that providers can implement to have the pod controller restart the
+// containers they report as terminated, according to the pod's restart policy.
+// See PodControllerConfig.EnableContainerRestarts.
+type ContainerRestarter interface {
+	// RestartContainer restarts the given container of the pod within the provider.
+	// The new state of the container is expected to be reported through NotifyPods (or GetPodStatus). The restart
+	// count of the container is kept by the pod controller, and does not need to be reported by the provider.
+	RestartContainer(ctx context.Context, pod *corev1.Pod, containerName string) error
+}
+
+// GracefulPodDeleter is an optional interface that providers can implement to be given a grace period when pods are
+// deleted, during which the pod's containers are expected to be stopped gracefully before being killed.
+// When implemented, DeletePodWithGracePeriod is called instead of DeletePod.
+type GracefulPodDeleter interface {
+	// DeletePodWithGracePeriod takes a Kubernetes Pod and deletes it from the provider, giving its containers up to
+	// the grace period to exit before killing them. A grace period of zero means the pod must be killed right away.
+	// The grace period does not include the time taken by the containers' preStop hooks, which the pod controller
+	// runs beforehand.
+	DeletePodWithGracePeriod(ctx context.Context, pod *corev1.Pod, gracePeriod time.Duration) error
+}
+
+// NativeProber is an optional interface that providers which run the liveness and readiness probes of containers on
+// their own can implement to opt out of the probes run by the pod controller.
+// See PodControllerConfig.EnableProbes.
+type NativeProber interface {
+	// RunsProbes returns whether the provider runs the probes of the given pod's containers itself, in which case it
+	// is responsible for reporting the readiness of the containers and restarting those which are unhealthy.
+	RunsProbes(pod *corev1.Pod) bool
+}
+
 // PodController is the controller implementation for Pod resources.
 type PodController struct {
 	provider PodLifecycleHandler
 
+	// ipAllocator and volumeHandler are set if the provider implements the corresponding optional interfaces. Like
+	// the other optional interfaces, they are looked up on the instrumented provider when the controller is created.
+	ipAllocator   PodIPAllocator
+	volumeHandler PodVolumeHandler
+	// runner is set if the provider is able to run commands in containers, which is used to run exec probes and
+	// preStop hooks.
+	runner containerRunner
+
 	// podsInformer is an informer for Pod resources.
 	podsInformer corev1informers.PodInformer
 	// podsLister is able to list/get Pod resources from a shared informer's store.
 	podsLister corev1listers.PodLister
 
+	// configMapInformer and secretInformer are used to get notified about changes to objects referenced by pods.
+	configMapInformer corev1informers.ConfigMapInformer
+	secretInformer    corev1informers.SecretInformer
+
+	// podRefs keeps track of the configmaps and secrets referenced by each pod.
+	podRefs *podReferences
+
+	// getNode returns the node the pods are running on. It may be nil.
+	getNode func() *corev1.Node
+	// nodeName is the name of the node the pods are running on, with which the metrics are labelled. It may be empty.
+	nodeName string
+
+	// breaker pauses the workers calling the provider while it is open. It may be nil.
+	breaker *CircuitBreaker
+
 	// recorder is an event recorder for recording Event resources to the Kubernetes API.
 	recorder record.EventRecorder
 
@@ -108,6 +190,50 @@ type PodController struct {
 	// deletionQ is a queue on which pods are reconciled, and we check if pods are in API server after grace period
 	deletionQ workqueue.RateLimitingInterface
 
+	// podStatusQ is a queue on which pod status updates received from the provider are processed
+	podStatusQ workqueue.RateLimitingInterface
+
+	// The maximum number of times a key is retried in each of the queues before being dropped.
+	k8sMaxRetries       int
+	deletionMaxRetries  int
+	podStatusMaxRetries int
+
+	// The number of workers for the pod status and deletion queues.
+	// If zero, the number of pod sync workers passed to Run is used.
+	podStatusWorkers int
+	deletionWorkers  int
+
+	// deadLetterHandler is called (if set) when a key is dropped from any of the queues.
+	deadLetterHandler DeadLetterHandler
+
+	// restarts restarts the containers reported as terminated by the provider. It is nil unless container restarts
+	// are enabled.
+	restarts *restartManager
+
+	// probes runs the probes of the pods' containers. It is nil unless probes are enabled.
+	probes *probeManager
+	// nativeProber is set if the provider implements NativeProber.
+	nativeProber NativeProber
+
+	// admitHandlers decide whether pods are admitted before being created in the provider.
+	admitHandlers []PodAdmitHandler
+	// admitMu makes sure pods are admitted one at a time.
+	admitMu sync.Mutex
+
+	// reconcileInterval is the interval at which pods are reconciled between the provider and Kubernetes. It is
+	// negative if pods are only reconciled at startup.
+	reconcileInterval time.Duration
+	// reconcileDryRun is set if reconciliation only reports the pods which are out of sync.
+	reconcileDryRun bool
+
+	// podStatusCoalescePeriod is the period during which successive status updates of a pod are coalesced. Status
+	// updates are not coalesced if it is negative.
+	podStatusCoalescePeriod time.Duration
+
+	// queueDrainTimeout is the maximum duration for which the queues are drained once the controller is shut down. The
+	// queues are not drained if it is negative.
+	queueDrainTimeout time.Duration
+
 	// From the time of creation, to termination the knownPods map will contain the pods key
 	// (derived from Kubernetes' cache library) -> a *knownPod struct.
 	knownPods sync.Map
@@ -118,6 +244,9 @@ type PodController struct {
 	// done is closed when Run returns
 	// Once done is closed `err` may be set to a non-nil value
 	done chan struct{}
+	// shutdown is closed by Shutdown, to stop the controller once the queues are drained.
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 
 	mu sync.Mutex
 	// err is set if there is an error while while running the pod controller.
@@ -135,6 +264,20 @@ type knownPod struct {
 	sync.Mutex
 	lastPodStatusReceivedFromProvider *corev1.Pod
 	lastPodUsed                       *corev1.Pod
+	// podIPs are the IPs which were used to resolve the pod's environment and volumes.
+	podIPs *PodIPs
+	// volumes are the contents of the pod's volumes last handed to the provider, if it implements PodVolumeHandler.
+	volumes PodVolumes
+	// terminationDeadline is when the grace period of the pod ends, once its termination has started.
+	terminationDeadline time.Time
+	// preStopHooksStarted is set once the preStop hooks of the pod's containers have been started, and
+	// preStopHooksRun once they have completed.
+	preStopHooksStarted bool
+	preStopHooksRun     bool
+	// admittedPod is the pod as it was admitted on the node. It is nil until the pod is admitted.
+	admittedPod *corev1.Pod
+	// startObserved is set once the time the pod took to start has been recorded.
+	startObserved bool
 }
 
 // PodControllerConfig is used to configure a new PodController.
@@ -149,15 +292,142 @@ type PodControllerConfig struct {
 
 	EventRecorder record.EventRecorder
 
+	// Provider is the provider of the node's pods. The calls made to it are instrumented, see
+	// InstrumentPodLifecycleHandler.
 	Provider PodLifecycleHandler
 
 	// Informers used for filling details for things like downward API in pod spec.
 	//
-	// We are using informers here instead of listeners because we'll need the
-	// informer for certain features (like notifications for updated ConfigMaps)
+	// We are using informers here instead of listeners because we need the
+	// informer for certain features (like notifications for updated ConfigMaps).
+	// Pods referencing a ConfigMap or Secret (from their environment or volumes)
+	// are re-synced with the provider whenever that object changes.
 	ConfigMapInformer corev1informers.ConfigMapInformer
 	SecretInformer    corev1informers.SecretInformer
 	ServiceInformer   corev1informers.ServiceInformer
+
+	// GetNode is used to get the node object the pods are running on, such as NodeController.Node.
+	// When resolving "resourceFieldRef" environment variables, limits which are not set on a container default to
+	// the node's allocatable resources, as is done by the kubelet.
+	// If unset, limits which are not set on a container are resolved to zero.
+	GetNode func() *corev1.Node
+
+	// NodeName is the name of the node the pods are running on. The metrics of the pod controller are labelled with
+	// it, and the names of its work queues suffixed with it, so that the nodes managed by a single process can be told
+	// apart (see the node/metrics package).
+	// If unset, the metrics have an empty node label and the work queues are named after their purpose only.
+	NodeName string
+
+	// SyncPodsFromKubernetesRateLimiter defines the rate limiter for the queue on which pods coming from Kubernetes
+	// are synced to the provider.
+	// If unset, workqueue.DefaultControllerRateLimiter() is used.
+	SyncPodsFromKubernetesRateLimiter workqueue.RateLimiter
+	// SyncPodsFromKubernetesMaxRetries is the number of times a pod sync is retried before the pod is dropped from the
+	// queue. If unset, DefaultMaxRetries is used.
+	SyncPodsFromKubernetesMaxRetries int
+
+	// SyncPodStatusFromProviderRateLimiter defines the rate limiter for the queue on which pod status updates coming
+	// from the provider are written to Kubernetes.
+	// If unset, workqueue.DefaultControllerRateLimiter() is used.
+	SyncPodStatusFromProviderRateLimiter workqueue.RateLimiter
+	// SyncPodStatusFromProviderMaxRetries is the number of times a pod status update is retried before the pod is
+	// dropped from the queue. If unset, DefaultMaxRetries is used.
+	SyncPodStatusFromProviderMaxRetries int
+	// SyncPodStatusFromProviderWorkers is the number of workers processing pod status updates.
+	// If unset, the number of pod sync workers passed to Run is used.
+	SyncPodStatusFromProviderWorkers int
+
+	// DeletePodsFromKubernetesRateLimiter defines the rate limiter for the queue on which pods are force deleted from
+	// Kubernetes once they are no longer running in the provider.
+	// If unset, workqueue.DefaultControllerRateLimiter() is used.
+	DeletePodsFromKubernetesRateLimiter workqueue.RateLimiter
+	// DeletePodsFromKubernetesMaxRetries is the number of times a pod deletion is retried before the pod is dropped
+	// from the queue. If unset, DefaultMaxRetries is used.
+	DeletePodsFromKubernetesMaxRetries int
+	// DeletePodsFromKubernetesWorkers is the number of workers processing pod deletions.
+	// If unset, the number of pod sync workers passed to Run is used.
+	DeletePodsFromKubernetesWorkers int
+
+	// DeadLetterHandler is called when a key is dropped from any of the queues after reaching the maximum number of
+	// retries. A warning event is always emitted on the pod, regardless of whether this is set.
+	DeadLetterHandler DeadLetterHandler
+
+	// EnableContainerRestarts makes the pod controller restart the containers which the provider reports as
+	// terminated, according to the pod's restart policy. Containers which keep terminating are restarted with an
+	// exponential back-off, and reported in the "CrashLoopBackOff" waiting state in the meantime, as done by the
+	// kubelet. The provider must implement ContainerRestarter.
+	EnableContainerRestarts bool
+	// ContainerRestartBackOff is the initial back-off of containers which keep terminating. It doubles on each
+	// restart, up to ContainerRestartMaxBackOff.
+	// If unset, DefaultContainerRestartBackOff is used.
+	ContainerRestartBackOff time.Duration
+	// ContainerRestartMaxBackOff is the maximum back-off of containers which keep terminating.
+	// If unset, DefaultContainerRestartMaxBackOff is used.
+	ContainerRestartMaxBackOff time.Duration
+
+	// EnableProbes makes the pod controller run the liveness and readiness probes of the pods' containers, as done by
+	// the kubelet. HTTP and TCP probes are run against the pod's IP, so it must be reachable from virtual-kubelet.
+	// Exec probes are run through the provider's RunInContainer method, and fail if the provider does not implement
+	// it. The readiness of containers is reflected in their status and in the pod's "ContainersReady" and "Ready"
+	// conditions. Containers which fail their liveness probe are restarted if EnableContainerRestarts is also set.
+	// Providers which run the probes themselves can opt out by implementing NativeProber.
+	EnableProbes bool
+
+	// PodAdmitHandlers are additional admit handlers which pods must pass before being created in the provider, as
+	// is done by the kubelet. Pods which are rejected are marked as failed with the reason given by the handler.
+	// The built-in admission checks that the pod fits within the node's allocatable resources and pod count, matches
+	// the node selector and required node affinity, and tolerates the node's NoExecute taints. These checks require
+	// GetNode to be set. If the provider implements PodAdmitHandler, it is run after the built-in checks and before
+	// the handlers set here.
+	PodAdmitHandlers []PodAdmitHandler
+
+	// ReconcileInterval is the interval at which the pods known to the provider are reconciled with the pods known to
+	// Kubernetes. Pods which leaked in the provider are deleted, and pods which Kubernetes reports as running but the
+	// provider lost are marked as failed. Pods are always reconciled when the controller starts.
+	// If unset, DefaultReconcileInterval is used. If negative, pods are only reconciled at startup.
+	ReconcileInterval time.Duration
+	// ReconcileDryRun makes reconciliation only report the pods which are out of sync, through events, logs and
+	// metrics, without acting upon them.
+	ReconcileDryRun bool
+
+	// PodStatusCoalescePeriod is the period during which successive status updates of a pod, as notified by the
+	// provider, are coalesced into a single update in Kubernetes with the latest status.
+	// If unset, DefaultPodStatusCoalescePeriod is used. If negative, status updates are not coalesced.
+	PodStatusCoalescePeriod time.Duration
+
+	// CircuitBreaker records the results of the calls made to the provider. While it is open, the queues on which
+	// pods are synced to the provider are paused, and resumed once it recovers. The same circuit breaker should be
+	// used as the node provider of the NodeController, so that the node is reported as not ready in the meantime.
+	// If unset, calls to the provider are never short-circuited.
+	CircuitBreaker *CircuitBreaker
+
+	// ProviderCallTimeout is the maximum duration of the calls made to the provider, see WithProviderCallTimeout.
+	// If unset, calls have no timeout.
+	ProviderCallTimeout time.Duration
+
+	// QueueDrainTimeout is the maximum duration for which the workers keep processing the items left in the queues
+	// once the controller is shut down with Shutdown. Items are processed with a context which is only cancelled once
+	// it expires, so that the workers do not give up on their current item half-way through.
+	// If unset, DefaultQueueDrainTimeout is used. If negative, the queues are not drained.
+	QueueDrainTimeout time.Duration
+}
+
+// The names of the work queues used by the pod controller.
+// These are used for naming the queues and are passed to the DeadLetterHandler.
+const (
+	syncPodsFromKubernetesQueueName    = "syncPodsFromKubernetes"
+	syncPodStatusFromProviderQueueName = "syncPodStatusFromProvider"
+	deletePodsFromKubernetesQueueName  = "deletePodsFromKubernetes"
+	restartContainersQueueName         = "restartContainers"
+)
+
+// queueName returns the name of the given work queue of the pod controller of the given node, as used to label the
+// work queue metrics.
+func queueName(name, nodeName string) string {
+	if nodeName == "" {
+		return name
+	}
+	return name + "_" + nodeName
 }
 
 // NewPodController creates a new pod controller with the provided config.
@@ -183,38 +453,143 @@ func NewPodController(cfg PodControllerConfig) (*PodController, error) {
 	if cfg.Provider == nil {
 		return nil, errdefs.InvalidInput("missing provider")
 	}
+	if cfg.SyncPodsFromKubernetesMaxRetries < 0 || cfg.SyncPodStatusFromProviderMaxRetries < 0 || cfg.DeletePodsFromKubernetesMaxRetries < 0 {
+		return nil, errdefs.InvalidInput("max retries cannot be negative")
+	}
+	if cfg.SyncPodStatusFromProviderWorkers < 0 || cfg.DeletePodsFromKubernetesWorkers < 0 {
+		return nil, errdefs.InvalidInput("number of workers cannot be negative")
+	}
+	if cfg.ContainerRestartBackOff < 0 || cfg.ContainerRestartMaxBackOff < 0 {
+		return nil, errdefs.InvalidInput("container restart back-off cannot be negative")
+	}
+	if cfg.ProviderCallTimeout < 0 {
+		return nil, errdefs.InvalidInput("provider call timeout cannot be negative")
+	}
+	if cfg.SyncPodsFromKubernetesRateLimiter == nil {
+		cfg.SyncPodsFromKubernetesRateLimiter = workqueue.DefaultControllerRateLimiter()
+	}
+	if cfg.SyncPodStatusFromProviderRateLimiter == nil {
+		cfg.SyncPodStatusFromProviderRateLimiter = workqueue.DefaultControllerRateLimiter()
+	}
+	if cfg.DeletePodsFromKubernetesRateLimiter == nil {
+		cfg.DeletePodsFromKubernetesRateLimiter = workqueue.DefaultControllerRateLimiter()
+	}
+	if cfg.SyncPodsFromKubernetesMaxRetries == 0 {
+		cfg.SyncPodsFromKubernetesMaxRetries = DefaultMaxRetries
+	}
+	if cfg.SyncPodStatusFromProviderMaxRetries == 0 {
+		cfg.SyncPodStatusFromProviderMaxRetries = DefaultMaxRetries
+	}
+	if cfg.DeletePodsFromKubernetesMaxRetries == 0 {
+		cfg.DeletePodsFromKubernetesMaxRetries = DefaultMaxRetries
+	}
 
 	rm, err := manager.NewResourceManager(cfg.PodInformer.Lister(), cfg.SecretInformer.Lister(), cfg.ConfigMapInformer.Lister(), cfg.ServiceInformer.Lister())
 	if err != nil {
 		return nil, pkgerrors.Wrap(err, "could not create resource manager")
 	}
 
+	provider := InstrumentPodLifecycleHandler(
+		cfg.Provider,
+		WithCircuitBreaker(cfg.CircuitBreaker),
+		WithNodeName(cfg.NodeName),
+		WithProviderCallTimeout(cfg.ProviderCallTimeout),
+	)
+
 	pc := &PodController{
-		client:          cfg.PodClient,
-		podsInformer:    cfg.PodInformer,
-		podsLister:      cfg.PodInformer.Lister(),
-		provider:        cfg.Provider,
-		resourceManager: rm,
-		ready:           make(chan struct{}),
-		done:            make(chan struct{}),
-		recorder:        cfg.EventRecorder,
-		k8sQ:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "syncPodsFromKubernetes"),
-		deletionQ:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "deletePodsFromKubernetes"),
+		client:              cfg.PodClient,
+		podsInformer:        cfg.PodInformer,
+		podsLister:          cfg.PodInformer.Lister(),
+		configMapInformer:   cfg.ConfigMapInformer,
+		secretInformer:      cfg.SecretInformer,
+		podRefs:             newPodReferences(),
+		getNode:             cfg.GetNode,
+		nodeName:            cfg.NodeName,
+		provider:            provider,
+		breaker:             cfg.CircuitBreaker,
+		resourceManager:     rm,
+		ready:               make(chan struct{}),
+		done:                make(chan struct{}),
+		shutdown:            make(chan struct{}),
+		recorder:            cfg.EventRecorder,
+		k8sQ:                workqueue.NewNamedRateLimitingQueue(cfg.SyncPodsFromKubernetesRateLimiter, queueName(syncPodsFromKubernetesQueueName, cfg.NodeName)),
+		deletionQ:           workqueue.NewNamedRateLimitingQueue(cfg.DeletePodsFromKubernetesRateLimiter, queueName(deletePodsFromKubernetesQueueName, cfg.NodeName)),
+		podStatusQ:          workqueue.NewNamedRateLimitingQueue(cfg.SyncPodStatusFromProviderRateLimiter, queueName(syncPodStatusFromProviderQueueName, cfg.NodeName)),
+		k8sMaxRetries:       cfg.SyncPodsFromKubernetesMaxRetries,
+		deletionMaxRetries:  cfg.DeletePodsFromKubernetesMaxRetries,
+		podStatusMaxRetries: cfg.SyncPodStatusFromProviderMaxRetries,
+		podStatusWorkers:    cfg.SyncPodStatusFromProviderWorkers,
+		deletionWorkers:     cfg.DeletePodsFromKubernetesWorkers,
+		deadLetterHandler:   cfg.DeadLetterHandler,
+		reconcileInterval:   cfg.ReconcileInterval,
+		reconcileDryRun:     cfg.ReconcileDryRun,
+	}
+	pc.podStatusCoalescePeriod = cfg.PodStatusCoalescePeriod
+	if pc.podStatusCoalescePeriod == 0 {
+		pc.podStatusCoalescePeriod = DefaultPodStatusCoalescePeriod
+	}
+	if pc.reconcileInterval == 0 {
+		pc.reconcileInterval = DefaultReconcileInterval
+	}
+	pc.queueDrainTimeout = cfg.QueueDrainTimeout
+	if pc.queueDrainTimeout == 0 {
+		pc.queueDrainTimeout = DefaultQueueDrainTimeout
+	}
+	pc.ipAllocator = provider.PodIPAllocator()
+	pc.volumeHandler = provider.PodVolumeHandler()
+	pc.runner = provider.containerRunner()
+
+	pc.admitHandlers = []PodAdmitHandler{PodAdmitHandlerFunc(admitPodOnNode)}
+	if h := provider.PodAdmitHandler(); h != nil {
+		pc.admitHandlers = append(pc.admitHandlers, h)
+	}
+	pc.admitHandlers = append(pc.admitHandlers, cfg.PodAdmitHandlers...)
+
+	if cfg.EnableContainerRestarts {
+		restarter := provider.ContainerRestarter()
+		if restarter == nil {
+			return nil, errdefs.InvalidInput("container restarts are enabled, but the provider does not implement ContainerRestarter")
+		}
+		if cfg.ContainerRestartBackOff == 0 {
+			cfg.ContainerRestartBackOff = DefaultContainerRestartBackOff
+		}
+		if cfg.ContainerRestartMaxBackOff == 0 {
+			cfg.ContainerRestartMaxBackOff = DefaultContainerRestartMaxBackOff
+		}
+		pc.restarts = newRestartManager(restarter, flowcontrol.NewBackOff(cfg.ContainerRestartBackOff, cfg.ContainerRestartMaxBackOff), cfg.NodeName)
+	}
+
+	if cfg.EnableProbes {
+		pc.probes = newProbeManager(pc.runner)
+		pc.nativeProber = provider.NativeProber()
 	}
 
 	return pc, nil
 }
 
-type asyncProvider interface {
-	PodLifecycleHandler
-	PodNotifier
+// podNotifier returns the PodNotifier of the provider, or nil if it does not implement it.
+func podNotifier(p PodLifecycleHandler) PodNotifier {
+	if i, ok := p.(*InstrumentedPodLifecycleHandler); ok {
+		return i.PodNotifier()
+	}
+	n, _ := p.(PodNotifier)
+	return n
 }
 
 // Run will set up the event handlers for types we are interested in, as well
 // as syncing informer caches and starting workers.  It will block until the
-// context is cancelled, at which point it will shutdown the work queue and
-// wait for workers to finish processing their current work items prior to
-// returning.
+// context is cancelled or Shutdown is called.
+//
+// When the context is cancelled, such as when the leadership of the controller
+// is lost, the workers are stopped right away: the context of the items being
+// processed is cancelled, and the items left in the work queues are dropped.
+// When Shutdown is called instead, the work queues are shut down and the
+// workers finish processing the items left in them prior to returning (see
+// PodControllerConfig.QueueDrainTimeout).
+//
+// podSyncWorkers is the number of workers syncing pods from Kubernetes to the
+// provider. It is also used for the pod status and deletion queues unless a
+// number of workers has been set for those in the PodControllerConfig.
 //
 // Once this returns, you should not re-use the controller.
 func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr error) {
@@ -223,33 +598,32 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 	defer func() {
 		pc.k8sQ.ShutDown()
 		pc.deletionQ.ShutDown()
+		pc.podStatusQ.ShutDown()
+		if pc.restarts != nil {
+			pc.restarts.q.ShutDown()
+		}
 		pc.mu.Lock()
 		pc.err = retErr
 		close(pc.done)
 		pc.mu.Unlock()
 	}()
 
-	var provider asyncProvider
 	runProvider := func(context.Context) {}
 
-	if p, ok := pc.provider.(asyncProvider); ok {
-		provider = p
-	} else {
+	notifier := podNotifier(pc.provider)
+	if notifier == nil {
 		wrapped := &syncProviderWrapper{PodLifecycleHandler: pc.provider, l: pc.podsLister}
 		runProvider = wrapped.run
-		provider = wrapped
+		notifier = wrapped
+		pc.provider = wrapped
 		log.G(ctx).Debug("Wrapped non-async provider with async")
 	}
-	pc.provider = provider
 
-	podStatusQueue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "syncPodStatusFromProvider")
-	provider.NotifyPods(ctx, func(pod *corev1.Pod) {
-		pc.enqueuePodStatusUpdate(ctx, podStatusQueue, pod.DeepCopy())
+	notifier.NotifyPods(ctx, func(pod *corev1.Pod) {
+		pc.enqueuePodStatusUpdate(ctx, pc.podStatusQ, pod.DeepCopy())
 	})
 	go runProvider(ctx)
 
-	defer podStatusQueue.ShutDown()
-
 	// Wait for the caches to be synced *before* starting to do work.
 	if ok := cache.WaitForCacheSync(ctx.Done(), pc.podsInformer.Informer().HasSynced); !ok {
 		return pkgerrors.New("failed to wait for caches to sync")
@@ -265,6 +639,7 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 				log.G(ctx).Error(err)
 			} else {
 				pc.knownPods.Store(key, &knownPod{})
+				pc.podRefs.update(key, pod.(*corev1.Pod))
 				pc.k8sQ.AddRateLimited(key)
 			}
 		},
@@ -276,6 +651,7 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 			if key, err := cache.MetaNamespaceKeyFunc(newPod); err != nil {
 				log.G(ctx).Error(err)
 			} else {
+				pc.podRefs.update(key, newPod)
 				pc.k8sQ.AddRateLimited(key)
 			}
 		},
@@ -284,6 +660,13 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 				log.G(ctx).Error(err)
 			} else {
 				pc.knownPods.Delete(key)
+				pc.podRefs.remove(key)
+				if pc.restarts != nil {
+					pc.restarts.forget(key)
+				}
+				if pc.probes != nil {
+					pc.probes.forget(key)
+				}
 				pc.k8sQ.AddRateLimited(key)
 				// If this pod was in the deletion queue, forget about it
 				pc.deletionQ.Forget(key)
@@ -291,21 +674,39 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 		},
 	})
 
-	// Perform a reconciliation step that deletes any dangling pods from the provider.
-	// This happens only when the virtual-kubelet is starting, and operates on a "best-effort" basis.
-	// If by any reason the provider fails to delete a dangling pod, it will stay in the provider and deletion won't be retried.
-	pc.deleteDanglingPods(ctx, podSyncWorkers)
+	// Set up event handlers for when ConfigMap and Secret resources change, so that pods referencing them get re-synced.
+	pc.configMapInformer.Informer().AddEventHandler(pc.referencedResourceEventHandler(ctx, configMapKind))
+	pc.secretInformer.Informer().AddEventHandler(pc.referencedResourceEventHandler(ctx, secretKind))
+
+	// Perform a reconciliation step that deletes any dangling pods from the provider, and marks pods lost by the
+	// provider as failed. This operates on a "best-effort" basis, and is then repeated periodically (unless disabled)
+	// so that pods which could not be acted upon, or went out of sync later, are eventually reconciled.
+	pc.reconcilePods(ctx, podSyncWorkers)
 
 	log.G(ctx).Info("starting workers")
 	wg := sync.WaitGroup{}
 
+	// The workers are stopped as soon as ctx is cancelled, but are only stopped once they have drained the queues (or
+	// the drain timeout expires) when the controller is shut down.
+	workerCtx, cancelWorkers := context.WithCancel(ctx)
+	defer cancelWorkers()
+
+	podStatusWorkers := pc.podStatusWorkers
+	if podStatusWorkers == 0 {
+		podStatusWorkers = podSyncWorkers
+	}
+	deletionWorkers := pc.deletionWorkers
+	if deletionWorkers == 0 {
+		deletionWorkers = podSyncWorkers
+	}
+
 	// Use the worker's "index" as its ID so we can use it for tracing.
-	for id := 0; id < podSyncWorkers; id++ {
+	for id := 0; id < podStatusWorkers; id++ {
 		wg.Add(1)
 		workerID := strconv.Itoa(id)
 		go func() {
 			defer wg.Done()
-			pc.runSyncPodStatusFromProviderWorker(ctx, workerID, podStatusQueue)
+			pc.runSyncPodStatusFromProviderWorker(workerCtx, workerID, pc.podStatusQ)
 		}()
 	}
 
@@ -314,32 +715,99 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 		workerID := strconv.Itoa(id)
 		go func() {
 			defer wg.Done()
-			pc.runSyncPodsFromKubernetesWorker(ctx, workerID, pc.k8sQ)
+			pc.runSyncPodsFromKubernetesWorker(workerCtx, workerID, pc.k8sQ)
 		}()
 	}
 
-	for id := 0; id < podSyncWorkers; id++ {
+	for id := 0; id < deletionWorkers; id++ {
 		wg.Add(1)
 		workerID := strconv.Itoa(id)
 		go func() {
 			defer wg.Done()
-			pc.runDeletionReconcilationWorker(ctx, workerID, pc.deletionQ)
+			pc.runDeletionReconcilationWorker(workerCtx, workerID, pc.deletionQ)
+		}()
+	}
+
+	if pc.restarts != nil {
+		for id := 0; id < podStatusWorkers; id++ {
+			wg.Add(1)
+			workerID := strconv.Itoa(id)
+			go func() {
+				defer wg.Done()
+				pc.runRestartContainersWorker(workerCtx, workerID, pc.restarts.q)
+			}()
+		}
+	}
+
+	if pc.reconcileInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pc.runReconciliation(workerCtx, podSyncWorkers)
 		}()
 	}
 
 	close(pc.ready)
 
 	log.G(ctx).Info("started workers")
-	<-ctx.Done()
+	shutdownQueues := func() {
+		pc.k8sQ.ShutDown()
+		pc.podStatusQ.ShutDown()
+		pc.deletionQ.ShutDown()
+		if pc.restarts != nil {
+			pc.restarts.q.ShutDown()
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		log.G(ctx).Info("stopping workers")
+		cancelWorkers()
+		shutdownQueues()
+		wg.Wait()
+		return nil
+	case <-pc.shutdown:
+	}
+
 	log.G(ctx).Info("shutting down workers")
-	pc.k8sQ.ShutDown()
-	podStatusQueue.ShutDown()
-	pc.deletionQ.ShutDown()
+	shutdownQueues()
 
-	wg.Wait()
+	// Shutting down the queues lets the workers process the items left in them, and then makes them return.
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	if pc.queueDrainTimeout < 0 {
+		cancelWorkers()
+		<-drained
+		return nil
+	}
+	timer := time.NewTimer(pc.queueDrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		// The workers are stopped along with ctx.
+		<-drained
+	case <-timer.C:
+		log.G(ctx).Warn("Timed out draining the work queues, cancelling the remaining items")
+		cancelWorkers()
+		<-drained
+	}
 	return nil
 }
 
+// Shutdown stops the pod controller gracefully: the work queues are shut down, and Run returns once the workers have
+// processed the items left in them (see PodControllerConfig.QueueDrainTimeout). Use Done to wait for it.
+// Unlike cancelling the context passed to Run, this lets the workers finish the items they are processing. It is a
+// no-op if the pod controller is already shut down.
+func (pc *PodController) Shutdown() {
+	pc.shutdownOnce.Do(func() {
+		close(pc.shutdown)
+	})
+}
+
 // Ready returns a channel which gets closed once the PodController is ready to handle scheduled pods.
 // This channel will never close if there is an error on startup.
 // The status of this channel after shutdown is indeterminate.
@@ -363,7 +831,7 @@ func (pc *PodController) Err() error {
 // runSyncPodsFromKubernetesWorker is a long-running function that will continually call the processNextWorkItem function
 // in order to read and process an item on the work queue that is generated by the pod informer.
 func (pc *PodController) runSyncPodsFromKubernetesWorker(ctx context.Context, workerID string, q workqueue.RateLimitingInterface) {
-	for pc.processNextWorkItem(ctx, workerID, q) {
+	for pc.breaker.wait(ctx) && pc.processNextWorkItem(ctx, workerID, q) {
 	}
 }
 
@@ -376,7 +844,7 @@ func (pc *PodController) processNextWorkItem(ctx context.Context, workerID strin
 
 	// Add the ID of the current worker as an attribute to the current span.
 	ctx = span.WithField(ctx, "workerId", workerID)
-	return handleQueueItem(ctx, q, pc.syncHandler)
+	return handleQueueItem(ctx, q, pc.syncHandler, pc.k8sMaxRetries, pc.retriesExhausted(syncPodsFromKubernetesQueueName))
 }
 
 // syncHandler compares the actual state with the desired, and attempts to converge the two.
@@ -453,6 +921,23 @@ func (pc *PodController) syncPodInProvider(ctx context.Context, pod *corev1.Pod,
 		return nil
 	}
 	kPod := obj.(*knownPod)
+
+	// Fail the pod if it has been active for longer than its activeDeadlineSeconds, or else check it again once the
+	// deadline has passed.
+	if pod.DeletionTimestamp == nil && pod.Status.Phase != corev1.PodFailed && pod.Status.Phase != corev1.PodSucceeded {
+		if remaining, ok := activeDeadlineRemaining(pod, time.Now()); ok {
+			if remaining <= 0 {
+				if err := pc.failPodDeadlineExceeded(ctx, pod, key, kPod); err != nil {
+					err := pkgerrors.Wrapf(err, "failed to stop pod %q which exceeded its active deadline", loggablePodName(pod))
+					span.SetStatus(err)
+					return err
+				}
+				return nil
+			}
+			pc.k8sQ.AddAfter(key, remaining)
+		}
+	}
+
 	kPod.Lock()
 	if kPod.lastPodUsed != nil && podsEffectivelyEqual(kPod.lastPodUsed, pod) {
 		kPod.Unlock()
@@ -460,8 +945,10 @@ func (pc *PodController) syncPodInProvider(ctx context.Context, pod *corev1.Pod,
 	}
 	kPod.Unlock()
 
+	// The pod is synced again once the preStop hooks complete, so it must not be recorded as used until then.
+	var hooksRunning bool
 	defer func() {
-		if retErr == nil {
+		if retErr == nil && !hooksRunning {
 			kPod.Lock()
 			defer kPod.Unlock()
 			kPod.lastPodUsed = pod
@@ -472,7 +959,13 @@ func (pc *PodController) syncPodInProvider(ctx context.Context, pod *corev1.Pod,
 	// If it does, guarantee it is deleted in the provider and Kubernetes.
 	if pod.DeletionTimestamp != nil {
 		log.G(ctx).Debug("Deleting pod in provider")
-		if err := pc.deletePod(ctx, pod); errdefs.IsNotFound(err) {
+		killAt, running, err := pc.terminatePod(ctx, pod, key, kPod)
+		hooksRunning = running
+		if hooksRunning {
+			log.G(ctx).Debug("Waiting for the preStop hooks to complete")
+			return nil
+		}
+		if errdefs.IsNotFound(err) {
 			log.G(ctx).Debug("Pod not found in provider")
 		} else if err != nil {
 			err := pkgerrors.Wrapf(err, "failed to delete pod %q in the provider", loggablePodName(pod))
@@ -480,7 +973,9 @@ func (pc *PodController) syncPodInProvider(ctx context.Context, pod *corev1.Pod,
 			return err
 		}
 
-		pc.deletionQ.AddAfter(key, time.Second*time.Duration(*pod.DeletionGracePeriodSeconds))
+		// Once the grace period ends, the pod is killed in the provider if it is still running, and deleted from
+		// Kubernetes.
+		pc.deletionQ.AddAfter(key, time.Until(killAt))
 		return nil
 	}
 
@@ -502,7 +997,7 @@ func (pc *PodController) syncPodInProvider(ctx context.Context, pod *corev1.Pod,
 // runDeletionReconcilationWorker is a long-running function that will continually call the processDeletionReconcilationWorkItem
 // function in order to read and process an item on the work queue that is generated by the pod informer.
 func (pc *PodController) runDeletionReconcilationWorker(ctx context.Context, workerID string, q workqueue.RateLimitingInterface) {
-	for pc.processDeletionReconcilationWorkItem(ctx, workerID, q) {
+	for pc.breaker.wait(ctx) && pc.processDeletionReconcilationWorkItem(ctx, workerID, q) {
 	}
 }
 
@@ -515,76 +1010,7 @@ func (pc *PodController) processDeletionReconcilationWorkItem(ctx context.Contex
 
 	// Add the ID of the current worker as an attribute to the current span.
 	ctx = span.WithField(ctx, "workerId", workerID)
-	return handleQueueItem(ctx, q, pc.deletePodHandler)
-}
-
-// deleteDanglingPods checks whether the provider knows about any pods which Kubernetes doesn't know about, and deletes them.
-func (pc *PodController) deleteDanglingPods(ctx context.Context, threadiness int) {
-	ctx, span := trace.StartSpan(ctx, "deleteDanglingPods")
-	defer span.End()
-
-	// Grab the list of pods known to the provider.
-	pps, err := pc.provider.GetPods(ctx)
-	if err != nil {
-		err := pkgerrors.Wrap(err, "failed to fetch the list of pods from the provider")
-		span.SetStatus(err)
-		log.G(ctx).Error(err)
-		return
-	}
-
-	// Create a slice to hold the pods we will be deleting from the provider.
-	ptd := make([]*corev1.Pod, 0)
-
-	// Iterate over the pods known to the provider, marking for deletion those that don't exist in Kubernetes.
-	// Take on this opportunity to populate the list of key that correspond to pods known to the provider.
-	for _, pp := range pps {
-		if _, err := pc.podsLister.Pods(pp.Namespace).Get(pp.Name); err != nil {
-			if errors.IsNotFound(err) {
-				// The current pod does not exist in Kubernetes, so we mark it for deletion.
-				ptd = append(ptd, pp)
-				continue
-			}
-			// For some reason we couldn't fetch the pod from the lister, so we propagate the error.
-			err := pkgerrors.Wrap(err, "failed to fetch pod from the lister")
-			span.SetStatus(err)
-			log.G(ctx).Error(err)
-			return
-		}
-	}
-
-	// We delete each pod in its own goroutine, allowing a maximum of "threadiness" concurrent deletions.
-	semaphore := make(chan struct{}, threadiness)
-	var wg sync.WaitGroup
-	wg.Add(len(ptd))
-
-	// Iterate over the slice of pods to be deleted and delete them in the provider.
-	for _, pod := range ptd {
-		go func(ctx context.Context, pod *corev1.Pod) {
-			defer wg.Done()
-
-			ctx, span := trace.StartSpan(ctx, "deleteDanglingPod")
-			defer span.End()
-
-			semaphore <- struct{}{}
-			defer func() {
-				<-semaphore
-			}()
-
-			// Add the pod's attributes to the current span.
-			ctx = addPodAttributes(ctx, span, pod)
-			// Actually delete the pod.
-			if err := pc.provider.DeletePod(ctx, pod.DeepCopy()); err != nil && !errdefs.IsNotFound(err) {
-				span.SetStatus(err)
-				log.G(ctx).Errorf("failed to delete pod %q in provider", loggablePodName(pod))
-			} else {
-				log.G(ctx).Infof("deleted leaked pod %q in provider", loggablePodName(pod))
-			}
-		}(ctx, pod)
-	}
-
-	// Wait for all pods to be deleted.
-	wg.Wait()
-	return
+	return handleQueueItem(ctx, q, pc.deletePodHandler, pc.deletionMaxRetries, pc.retriesExhausted(deletePodsFromKubernetesQueueName))
 }
 
 // loggablePodName returns the "namespace/name" key for the specified pod.
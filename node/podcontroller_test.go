@@ -45,6 +45,93 @@ func TestPodControllerExitOnContextCancel(t *testing.T) {
 	assert.NilError(t, tc.Err())
 }
 
+// blockingCreateProvider blocks pod creations until released, and records whether their context was cancelled.
+type blockingCreateProvider struct {
+	*mockProviderAsync
+	started chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func (p *blockingCreateProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
+	close(p.started)
+	<-p.release
+	p.err = ctx.Err()
+	return p.mockProviderAsync.CreatePod(ctx, pod)
+}
+
+// runBlockedPodCreation runs a pod controller until it is processing the creation of a pod, blocked in the provider.
+func runBlockedPodCreation(t *testing.T, opts ...func(*PodControllerConfig, *mockProviderAsync)) (*TestController, *blockingCreateProvider, context.CancelFunc, <-chan error) {
+	t.Helper()
+	var p *blockingCreateProvider
+	opts = append(opts, func(cfg *PodControllerConfig, mock *mockProviderAsync) {
+		p = &blockingCreateProvider{mockProviderAsync: mock, started: make(chan struct{}), release: make(chan struct{})}
+		cfg.Provider = p
+	})
+	tc := newTestController(opts...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.Run(ctx, 1)
+	}()
+	<-tc.Ready()
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"}, Spec: newPodSpec()}
+	_, err := tc.client.CoreV1().Pods(pod.Namespace).Create(pod)
+	assert.NilError(t, err)
+
+	select {
+	case <-p.started:
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for the pod to be created")
+	}
+	return tc, p, cancel, done
+}
+
+func waitForRunExit(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		assert.NilError(t, err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for Run() to exit")
+	}
+}
+
+func TestPodControllerDrainsQueuesOnShutdown(t *testing.T) {
+	tc, p, cancel, done := runBlockedPodCreation(t)
+	defer cancel()
+
+	tc.Shutdown()
+	close(p.release)
+	waitForRunExit(t, done)
+	assert.NilError(t, p.err, "the item being processed must not be cancelled")
+	assert.Check(t, tc.mock.creates.read() == 1)
+}
+
+func TestPodControllerShutdownWithReconciliation(t *testing.T) {
+	tc, p, cancel, done := runBlockedPodCreation(t, func(cfg *PodControllerConfig, _ *mockProviderAsync) {
+		cfg.ReconcileInterval = 10 * time.Millisecond
+	})
+	defer cancel()
+
+	// The periodic reconciliation must stop along with the workers, rather than keeping Run from returning.
+	tc.Shutdown()
+	close(p.release)
+	waitForRunExit(t, done)
+}
+
+func TestPodControllerStopsWorkersOnContextCancel(t *testing.T) {
+	tc, p, cancel, done := runBlockedPodCreation(t)
+
+	// Such as when the leadership is lost: the items being processed must not keep mutating the provider.
+	cancel()
+	close(p.release)
+	waitForRunExit(t, done)
+	assert.Check(t, p.err == context.Canceled, "the item being processed must be cancelled: %v", p.err)
+}
+
 func TestCompareResourceVersion(t *testing.T) {
 	p1 := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -0,0 +1,147 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// podIPsFieldPath is the downward API field path which resolves to the comma-separated list of the pod's IPs.
+const podIPsFieldPath = "status.podIPs"
+
+// statusIPsFieldPaths are the downward API field paths which can only be resolved once IPs have been assigned to the pod.
+var statusIPsFieldPaths = map[string]bool{
+	"status.podIP":  true,
+	"status.hostIP": true,
+	podIPsFieldPath: true,
+}
+
+// PodIPs holds the IPs assigned to a pod by the provider.
+type PodIPs struct {
+	// HostIP is the IP of the host the pod is running on.
+	HostIP string
+	// PodIPs are the IPs assigned to the pod. The first one is the pod's primary IP, which is reported as ".status.podIP".
+	PodIPs []string
+}
+
+// primary returns the pod's primary IP, or an empty string if no IP has been assigned.
+func (ips *PodIPs) primary() string {
+	if ips == nil || len(ips.PodIPs) == 0 {
+		return ""
+	}
+	return ips.PodIPs[0]
+}
+
+// podReferencesStatusIPs returns whether the environment of any of the pod's containers, or any of its downward API
+// volumes, references the IPs in the pod's status.
+func podReferencesStatusIPs(pod *corev1.Pod) bool {
+	referencesIPs := func(fs *corev1.ObjectFieldSelector) bool {
+		return fs != nil && statusIPsFieldPaths[fs.FieldPath]
+	}
+	containerReferencesIPs := func(containers []corev1.Container) bool {
+		for _, c := range containers {
+			for _, env := range c.Env {
+				if env.ValueFrom != nil && referencesIPs(env.ValueFrom.FieldRef) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if containerReferencesIPs(pod.Spec.InitContainers) || containerReferencesIPs(pod.Spec.Containers) {
+		return true
+	}
+
+	for _, v := range pod.Spec.Volumes {
+		var items []corev1.DownwardAPIVolumeFile
+		switch {
+		case v.DownwardAPI != nil:
+			items = v.DownwardAPI.Items
+		case v.Projected != nil:
+			for _, source := range v.Projected.Sources {
+				if source.DownwardAPI != nil {
+					items = append(items, source.DownwardAPI.Items...)
+				}
+			}
+		}
+		for _, item := range items {
+			if referencesIPs(item.FieldRef) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolvePodIPs returns the IPs assigned to the pod, so that the environment variables and downward API volumes which
+// reference them can be resolved before the provider starts the pod's containers.
+//
+// The IPs last reported by the provider through NotifyPods (or, failing that, the ones in the pod's status in
+// Kubernetes) take precedence. If no IPs are known yet and the provider implements PodIPAllocator, it is asked to
+// assign them. Otherwise nil is returned, and the pod is synced again once the provider reports its IPs.
+func (pc *PodController) resolvePodIPs(ctx context.Context, pod *corev1.Pod, kPod *knownPod) (*PodIPs, error) {
+	status := pod.Status
+	var used *PodIPs
+	if kPod != nil {
+		kPod.Lock()
+		if kPod.lastPodStatusReceivedFromProvider != nil {
+			status = kPod.lastPodStatusReceivedFromProvider.Status
+		}
+		used = kPod.podIPs
+		kPod.Unlock()
+	}
+
+	if status.PodIP != "" {
+		ips := &PodIPs{HostIP: status.HostIP, PodIPs: []string{status.PodIP}}
+		// The pod's status can only hold its primary IP, so we keep using any additional IPs handed out by the
+		// provider as long as the primary IP has not changed.
+		if used.primary() == status.PodIP {
+			ips.PodIPs = used.PodIPs
+			if ips.HostIP == "" {
+				ips.HostIP = used.HostIP
+			}
+		}
+		return ips, nil
+	}
+	if used != nil {
+		return used, nil
+	}
+
+	if pc.ipAllocator == nil {
+		log.G(ctx).Debug("Pod IPs are not known yet, waiting for the provider to report them")
+		return nil, nil
+	}
+	ips, err := pc.ipAllocator.AllocatePodIPs(ctx, pod.DeepCopy())
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "error allocating pod IPs")
+	}
+	return ips, nil
+}
+
+// podIPsChanged returns whether the IPs in the given status differ from the IPs which were used to resolve the
+// pod's environment and volumes.
+func podIPsChanged(used *PodIPs, status *corev1.PodStatus) bool {
+	if status.PodIP == "" {
+		return false
+	}
+	if used == nil {
+		return true
+	}
+	return used.primary() != status.PodIP || (status.HostIP != "" && used.HostIP != status.HostIP)
+}
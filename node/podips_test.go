@@ -0,0 +1,174 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// mockIPAllocatorProvider is a provider which assigns IPs to pods before they are created, and records the volumes
+// it is handed by the pod controller.
+type mockIPAllocatorProvider struct {
+	*mockProviderAsync
+	allocations int
+	volumes     PodVolumes
+}
+
+func (p *mockIPAllocatorProvider) AllocatePodIPs(ctx context.Context, pod *corev1.Pod) (*PodIPs, error) {
+	p.allocations++
+	return &PodIPs{HostIP: "1.2.3.4", PodIPs: []string{"5.6.7.8", "fd00::1"}}, nil
+}
+
+func (p *mockIPAllocatorProvider) CreatePodWithVolumes(ctx context.Context, pod *corev1.Pod, volumes PodVolumes) error {
+	p.volumes = volumes
+	return p.CreatePod(ctx, pod)
+}
+
+func (p *mockIPAllocatorProvider) UpdatePodWithVolumes(ctx context.Context, pod *corev1.Pod, volumes PodVolumes) error {
+	p.volumes = volumes
+	return p.UpdatePod(ctx, pod)
+}
+
+func fieldRefEnv(name, fieldPath string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name:      name,
+		ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: fieldPath}},
+	}
+}
+
+func newPodReferencingIPs() *corev1.Pod {
+	pod := &corev1.Pod{}
+	pod.ObjectMeta.Namespace = "default"
+	pod.ObjectMeta.Name = "nginx"
+	pod.Spec = newPodSpec()
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{
+		fieldRefEnv("POD_IP", "status.podIP"),
+		fieldRefEnv("POD_IPS", "status.podIPs"),
+		fieldRefEnv("HOST_IP", "status.hostIP"),
+	}
+	return pod
+}
+
+func envMap(env []corev1.EnvVar) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, e := range env {
+		m[e.Name] = e.Value
+	}
+	return m
+}
+
+func TestPodReferencesStatusIPs(t *testing.T) {
+	assert.Check(t, podReferencesStatusIPs(newPodReferencingIPs()))
+
+	pod := &corev1.Pod{Spec: newPodSpec()}
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{fieldRefEnv("NODE_NAME", "spec.nodeName")}
+	assert.Check(t, !podReferencesStatusIPs(pod))
+
+	pod.Spec.Volumes = []corev1.Volume{
+		{
+			Name: "podinfo",
+			VolumeSource: corev1.VolumeSource{DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{
+					{Path: "ip", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"}},
+				},
+			}},
+		},
+	}
+	assert.Check(t, podReferencesStatusIPs(pod))
+}
+
+func TestPodCreateWithAllocatedIPs(t *testing.T) {
+	var p *mockIPAllocatorProvider
+	tc := newTestController(func(cfg *PodControllerConfig, mock *mockProviderAsync) {
+		p = &mockIPAllocatorProvider{mockProviderAsync: mock}
+		cfg.Provider = p
+	})
+
+	pod := newPodReferencingIPs()
+	mode := int32(0400)
+	pod.Spec.Volumes = []corev1.Volume{
+		{
+			Name: "podinfo",
+			VolumeSource: corev1.VolumeSource{DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{
+					{Path: "name", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}},
+					{Path: "ips", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIPs"}, Mode: &mode},
+				},
+			}},
+		},
+	}
+	kPod := &knownPod{}
+	tc.knownPods.Store("default/nginx", kPod)
+
+	assert.NilError(t, tc.createOrUpdatePod(context.Background(), pod.DeepCopy()))
+	assert.Check(t, is.Equal(p.allocations, 1))
+	assert.Check(t, is.Equal(tc.mock.creates.read(), 1))
+
+	created, err := tc.mock.GetPod(context.Background(), "default", "nginx")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(envMap(created.Spec.Containers[0].Env), map[string]string{
+		"POD_IP":  "5.6.7.8",
+		"POD_IPS": "5.6.7.8,fd00::1",
+		"HOST_IP": "1.2.3.4",
+	}))
+	assert.Check(t, is.DeepEqual(p.volumes, PodVolumes{
+		"podinfo": {
+			{Path: "name", Data: []byte("nginx"), Mode: corev1.DownwardAPIVolumeSourceDefaultMode},
+			{Path: "ips", Data: []byte("5.6.7.8,fd00::1"), Mode: mode},
+		},
+	}))
+
+	// The IPs must be reused rather than allocated again on subsequent syncs.
+	assert.NilError(t, tc.createOrUpdatePod(context.Background(), pod.DeepCopy()))
+	assert.Check(t, is.Equal(p.allocations, 1))
+	assert.Check(t, is.Equal(tc.mock.updates.read(), 0))
+}
+
+func TestPodResyncedWhenProviderReportsIPs(t *testing.T) {
+	tc := newTestController()
+	ctx := context.Background()
+
+	pod := newPodReferencingIPs()
+	key := "default/nginx"
+	kPod := &knownPod{}
+	tc.knownPods.Store(key, kPod)
+
+	// The provider does not know the pod's IPs before it is created, so they resolve to empty values.
+	assert.NilError(t, tc.createOrUpdatePod(ctx, pod.DeepCopy()))
+	created, err := tc.mock.GetPod(ctx, "default", "nginx")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(envMap(created.Spec.Containers[0].Env)["POD_IP"], ""))
+	kPod.lastPodUsed = pod
+
+	// Once the provider reports the pod's IPs, the pod must be synced again.
+	reported := created.DeepCopy()
+	reported.Status.PodIP = "5.6.7.8"
+	reported.Status.HostIP = "1.2.3.4"
+	tc.enqueuePodStatusUpdate(ctx, tc.podStatusQ, reported)
+
+	item, shutdown := tc.k8sQ.Get()
+	assert.Assert(t, !shutdown)
+	assert.Check(t, is.Equal(item, key))
+	tc.k8sQ.Done(item)
+	assert.Check(t, kPod.lastPodUsed == nil, "last used pod should be reset so the pod gets re-synced")
+
+	assert.NilError(t, tc.createOrUpdatePod(ctx, pod.DeepCopy()))
+	assert.Check(t, is.Equal(tc.mock.updates.read(), 1))
+	updated, err := tc.mock.GetPod(ctx, "default", "nginx")
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(envMap(updated.Spec.Containers[0].Env), map[string]string{
+		"POD_IP":  "5.6.7.8",
+		"POD_IPS": "5.6.7.8",
+		"HOST_IP": "1.2.3.4",
+	}))
+
+	// Further status updates which do not change the IPs must not cause the pod to be synced again.
+	kPod.lastPodUsed = pod
+	reported = reported.DeepCopy()
+	reported.Status.Phase = corev1.PodRunning
+	tc.enqueuePodStatusUpdate(ctx, tc.podStatusQ, reported)
+	assert.Check(t, kPod.lastPodUsed != nil)
+}
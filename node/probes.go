@@ -0,0 +1,559 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	podEventUnhealthy = "Unhealthy"
+	podEventKilling   = "Killing"
+)
+
+// probeType is the type of a container probe.
+type probeType string
+
+const (
+	livenessProbe  probeType = "Liveness"
+	readinessProbe probeType = "Readiness"
+)
+
+// containerRunner is implemented by providers which are able to run commands in containers, and is used to run exec
+// probes and preStop hooks. This is the same method the kubelet API uses for "exec".
+type containerRunner interface {
+	RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach api.AttachIO) error
+}
+
+// probeKey identifies a probe of a container.
+type probeKey struct {
+	podKey    string
+	container string
+	probeType probeType
+}
+
+// probeWorker periodically runs a single probe of a container.
+type probeWorker struct {
+	probe  *corev1.Probe
+	cancel context.CancelFunc
+}
+
+// probeManager runs the liveness and readiness probes of the pods' containers, and keeps track of the containers'
+// readiness.
+// Startup probes are not supported by the version of the Kubernetes API we build against.
+type probeManager struct {
+	// runner is used to run exec probes. It is nil if the provider does not support running commands in containers.
+	runner containerRunner
+	// transport is used for HTTP probes.
+	transport http.RoundTripper
+
+	mu      sync.Mutex
+	workers map[probeKey]*probeWorker
+	// ready holds the readiness of the containers which have a readiness probe, keyed by containerRestartID.
+	ready map[string]bool
+}
+
+func newProbeManager(runner containerRunner) *probeManager {
+	return &probeManager{
+		runner: runner,
+		// As done by the kubelet, certificates are not verified and connections are not reused.
+		transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+			DisableKeepAlives: true,
+			Proxy:             http.ProxyURL(nil),
+		},
+		workers: make(map[probeKey]*probeWorker),
+		ready:   make(map[string]bool),
+	}
+}
+
+// syncWorkers makes sure a worker is running for each probe of the pod's running containers, and stops the workers
+// of the containers which are no longer running.
+func (pm *probeManager) syncWorkers(ctx context.Context, key string, pod *corev1.Pod, status *corev1.PodStatus, run func(context.Context, probeKey, *corev1.Probe)) {
+	running := make(map[string]bool, len(status.ContainerStatuses))
+	for _, cs := range status.ContainerStatuses {
+		running[cs.Name] = cs.State.Running != nil
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		probes := map[probeType]*corev1.Probe{
+			livenessProbe:  c.LivenessProbe,
+			readinessProbe: c.ReadinessProbe,
+		}
+		for t, probe := range probes {
+			k := probeKey{podKey: key, container: c.Name, probeType: t}
+			w, ok := pm.workers[k]
+			switch {
+			case probe != nil && running[c.Name] && !ok:
+				workerCtx, cancel := context.WithCancel(ctx)
+				pm.workers[k] = &probeWorker{probe: probe, cancel: cancel}
+				go run(workerCtx, k, probe)
+			case (probe == nil || !running[c.Name]) && ok:
+				w.cancel()
+				delete(pm.workers, k)
+				if t == readinessProbe {
+					delete(pm.ready, containerRestartID(key, c.Name))
+				}
+			}
+		}
+	}
+}
+
+// forget stops the workers of the pod with the given key, and drops the readiness of its containers.
+func (pm *probeManager) forget(key string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for k, w := range pm.workers {
+		if k.podKey == key {
+			w.cancel()
+			delete(pm.workers, k)
+			delete(pm.ready, containerRestartID(key, k.container))
+		}
+	}
+}
+
+// setReady records the readiness of a container, and returns whether it changed.
+func (pm *probeManager) setReady(key, containerName string, ready bool) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	id := containerRestartID(key, containerName)
+	changed := pm.ready[id] != ready
+	pm.ready[id] = ready
+	return changed
+}
+
+// updateStatus sets the readiness of the containers of the pod which have a readiness probe, as well as the pod's
+// "ContainersReady" and "Ready" conditions.
+// Containers which have a readiness probe are not ready until the probe succeeds. The conditions are left untouched
+// for pods which do not have any readiness probe, so that the ones reported by the provider are used.
+func (pm *probeManager) updateStatus(key string, pod *corev1.Pod, status *corev1.PodStatus) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var hasReadinessProbe bool
+	ready := make(map[string]bool, len(status.ContainerStatuses))
+	for i := range status.ContainerStatuses {
+		cs := &status.ContainerStatuses[i]
+		if c := findContainer(pod, cs.Name); c != nil && c.ReadinessProbe != nil {
+			hasReadinessProbe = true
+			cs.Ready = cs.State.Running != nil && pm.ready[containerRestartID(key, cs.Name)]
+		}
+		ready[cs.Name] = cs.Ready
+	}
+	if !hasReadinessProbe {
+		return
+	}
+
+	allReady := true
+	for _, c := range pod.Spec.Containers {
+		allReady = allReady && ready[c.Name]
+	}
+	setPodCondition(status, corev1.ContainersReady, allReady)
+	setPodCondition(status, corev1.PodReady, allReady)
+}
+
+// setPodCondition sets the status of the condition of the given type, updating its transition time if it changed.
+func setPodCondition(status *corev1.PodStatus, conditionType corev1.PodConditionType, value bool) {
+	conditionStatus := corev1.ConditionFalse
+	if value {
+		conditionStatus = corev1.ConditionTrue
+	}
+	for i := range status.Conditions {
+		c := &status.Conditions[i]
+		if c.Type != conditionType {
+			continue
+		}
+		if c.Status != conditionStatus {
+			c.Status = conditionStatus
+			c.LastTransitionTime = metav1.Now()
+			c.Reason = ""
+			c.Message = ""
+		}
+		return
+	}
+	status.Conditions = append(status.Conditions, corev1.PodCondition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		LastTransitionTime: metav1.Now(),
+	})
+}
+
+// runProbe runs the given probe against a container once.
+// Based on runProbe in pkg/kubelet/prober/prober.go.
+func (pm *probeManager) runProbe(ctx context.Context, pod *corev1.Pod, container *corev1.Container, podIP string, probe *corev1.Probe) error {
+	ctx, cancel := context.WithTimeout(ctx, secondsOrDefault(probe.TimeoutSeconds, 1))
+	defer cancel()
+
+	switch {
+	case probe.Exec != nil:
+		if pm.runner == nil {
+			return pkgerrors.New("the provider does not support running commands in containers")
+		}
+		output := &probeOutput{}
+		if err := pm.runner.RunInContainer(ctx, pod.Namespace, pod.Name, container.Name, probe.Exec.Command, output); err != nil {
+			return pkgerrors.Wrapf(err, "command %v failed with output %q", probe.Exec.Command, output.String())
+		}
+		return nil
+	case probe.HTTPGet != nil:
+		return pm.runHTTPProbe(ctx, container, podIP, probe.HTTPGet)
+	case probe.TCPSocket != nil:
+		host := probe.TCPSocket.Host
+		if host == "" {
+			host = podIP
+		}
+		port, err := probePort(probe.TCPSocket.Port, container)
+		if err != nil {
+			return err
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	return pkgerrors.New("missing probe handler")
+}
+
+// runHTTPProbe runs an HTTP GET probe. The probe succeeds if the response status code is in the 2xx or 3xx range.
+// Based on pkg/probe/http/http.go.
+func (pm *probeManager) runHTTPProbe(ctx context.Context, container *corev1.Container, podIP string, action *corev1.HTTPGetAction) error {
+	host := action.Host
+	if host == "" {
+		host = podIP
+	}
+	port, err := probePort(action.Port, container)
+	if err != nil {
+		return err
+	}
+	scheme := strings.ToLower(string(action.Scheme))
+	if scheme == "" {
+		scheme = "http"
+	}
+	u, err := url.Parse(action.Path)
+	if err != nil {
+		return err
+	}
+	u.Scheme = scheme
+	u.Host = net.JoinHostPort(host, strconv.Itoa(port))
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	for _, h := range action.HTTPHeaders {
+		if strings.EqualFold(h.Name, "Host") {
+			req.Host = h.Value
+			continue
+		}
+		req.Header.Add(h.Name, h.Value)
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", "virtual-kubelet-probe")
+	}
+
+	resp, err := pm.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 10*1024))
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("HTTP probe failed with statuscode: %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// probePort resolves the port of a probe, which may reference one of the container's ports by name.
+func probePort(port intstr.IntOrString, container *corev1.Container) (int, error) {
+	p := port.IntValue()
+	if port.Type == intstr.String {
+		for _, cp := range container.Ports {
+			if cp.Name == port.StrVal {
+				p = int(cp.ContainerPort)
+				break
+			}
+		}
+	}
+	if p <= 0 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %q", port.String())
+	}
+	return p, nil
+}
+
+func secondsOrDefault(seconds, def int32) time.Duration {
+	if seconds <= 0 {
+		seconds = def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func thresholdOrDefault(threshold, def int32) int32 {
+	if threshold <= 0 {
+		return def
+	}
+	return threshold
+}
+
+// probeOutput collects the output of exec probes. It implements api.AttachIO.
+type probeOutput struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (o *probeOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// Only keep the beginning of the output, which is what ends up in events.
+	if remaining := 10*1024 - o.buf.Len(); remaining > 0 {
+		if len(p) > remaining {
+			o.buf.Write(p[:remaining])
+		} else {
+			o.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (o *probeOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
+}
+
+func (o *probeOutput) Close() error                { return nil }
+func (o *probeOutput) Stdin() io.Reader            { return nil }
+func (o *probeOutput) Stdout() io.WriteCloser      { return o }
+func (o *probeOutput) Stderr() io.WriteCloser      { return o }
+func (o *probeOutput) TTY() bool                   { return false }
+func (o *probeOutput) Resize() <-chan api.TermSize { return nil }
+
+// syncProbes starts and stops the probe workers of the pod according to the status reported by the provider, unless
+// the provider runs the pod's probes itself.
+func (pc *PodController) syncProbes(ctx context.Context, key string, pod *corev1.Pod) {
+	if pc.probes == nil {
+		return
+	}
+	k8sPod, err := pc.podsLister.Pods(pod.Namespace).Get(pod.Name)
+	if err != nil {
+		return
+	}
+	if pc.nativeProber != nil && pc.nativeProber.RunsProbes(k8sPod) {
+		return
+	}
+	if k8sPod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		pc.probes.forget(key)
+		return
+	}
+	pc.probes.syncWorkers(ctx, key, k8sPod, &pod.Status, pc.runProbeWorker)
+	pc.probes.updateStatus(key, k8sPod, &pod.Status)
+}
+
+// runProbeWorker runs a probe of a container periodically, until the context is cancelled.
+// Based on pkg/kubelet/prober/worker.go.
+func (pc *PodController) runProbeWorker(ctx context.Context, k probeKey, probe *corev1.Probe) {
+	ctx = log.WithLogger(ctx, log.G(ctx).WithFields(log.Fields{
+		"key":       k.podKey,
+		"container": k.container,
+		"probe":     string(k.probeType),
+	}))
+
+	// As done by the kubelet, containers are probed right away, and then every period. The first probe is run as soon
+	// as the initial delay expires, rather than on the next period.
+	period := secondsOrDefault(probe.PeriodSeconds, 10)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var (
+		// containerID is the ID of the container being probed, used to reset the worker when it is restarted.
+		containerID string
+		// startedAt is when the container being probed was started, used to reset the worker when it is restarted.
+		startedAt            metav1.Time
+		successes, failures  int32
+		successThreshold     = thresholdOrDefault(probe.SuccessThreshold, 1)
+		failureThreshold     = thresholdOrDefault(probe.FailureThreshold, 3)
+		initialDelay         = time.Duration(probe.InitialDelaySeconds) * time.Second
+		healthy, resultKnown bool
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(period)
+
+		pod, status, ok := pc.probeTarget(k)
+		if !ok {
+			continue
+		}
+		cs := findContainerStatus(status, k.container)
+		if cs == nil || cs.State.Running == nil {
+			continue
+		}
+		if cs.ContainerID != containerID || !cs.State.Running.StartedAt.Equal(&startedAt) {
+			// The container was (re)started, so we start over.
+			containerID, startedAt = cs.ContainerID, cs.State.Running.StartedAt
+			successes, failures, resultKnown = 0, 0, false
+			if k.probeType == readinessProbe && pc.probes.setReady(k.podKey, k.container, false) {
+				pc.refreshPodStatus(ctx, k.podKey)
+			}
+		}
+		if delay := initialDelay - time.Since(startedAt.Time); delay > 0 {
+			if delay < period && timer.Stop() {
+				timer.Reset(delay)
+			}
+			continue
+		}
+		container := findContainer(pod, k.container)
+		if container == nil {
+			continue
+		}
+
+		err := pc.probes.runProbe(ctx, pod, container, status.PodIP, probe)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).Debug("Probe failed")
+			pc.recorder.Eventf(pod, corev1.EventTypeWarning, podEventUnhealthy, "%s probe failed: %v", k.probeType, err)
+			successes, failures = 0, failures+1
+			if failures < failureThreshold || (resultKnown && !healthy) {
+				continue
+			}
+			healthy, resultKnown = false, true
+		} else {
+			successes, failures = successes+1, 0
+			if successes < successThreshold || (resultKnown && healthy) {
+				continue
+			}
+			healthy, resultKnown = true, true
+		}
+
+		switch k.probeType {
+		case readinessProbe:
+			if pc.probes.setReady(k.podKey, k.container, healthy) {
+				pc.refreshPodStatus(ctx, k.podKey)
+			}
+		case livenessProbe:
+			if !healthy {
+				pc.restartUnhealthyContainer(ctx, k.podKey, pod, k.container)
+				// Start over, so that the container is not restarted again before having been probed again.
+				successes, failures, resultKnown = 0, 0, false
+			}
+		}
+	}
+}
+
+// probeTarget returns the pod from Kubernetes and the last status reported by the provider for the probed pod.
+func (pc *PodController) probeTarget(k probeKey) (*corev1.Pod, *corev1.PodStatus, bool) {
+	obj, ok := pc.knownPods.Load(k.podKey)
+	if !ok {
+		return nil, nil, false
+	}
+	kPod := obj.(*knownPod)
+	kPod.Lock()
+	providerPod := kPod.lastPodStatusReceivedFromProvider
+	kPod.Unlock()
+	if providerPod == nil {
+		return nil, nil, false
+	}
+
+	pod, err := pc.podsLister.Pods(providerPod.Namespace).Get(providerPod.Name)
+	if err != nil {
+		return nil, nil, false
+	}
+	return pod, &providerPod.Status, true
+}
+
+func findContainerStatus(status *corev1.PodStatus, name string) *corev1.ContainerStatus {
+	for i := range status.ContainerStatuses {
+		if status.ContainerStatuses[i].Name == name {
+			return &status.ContainerStatuses[i]
+		}
+	}
+	return nil
+}
+
+// refreshPodStatus re-applies the readiness of the pod's containers to the last status reported by the provider, and
+// queues the pod for its status to be updated in Kubernetes.
+func (pc *PodController) refreshPodStatus(ctx context.Context, key string) {
+	obj, ok := pc.knownPods.Load(key)
+	if !ok {
+		return
+	}
+	kPod := obj.(*knownPod)
+	kPod.Lock()
+	if kPod.lastPodStatusReceivedFromProvider == nil {
+		kPod.Unlock()
+		return
+	}
+	updated := kPod.lastPodStatusReceivedFromProvider.DeepCopy()
+	kPod.Unlock()
+
+	pod, err := pc.podsLister.Pods(updated.Namespace).Get(updated.Name)
+	if err != nil {
+		return
+	}
+	pc.probes.updateStatus(key, pod, &updated.Status)
+
+	kPod.Lock()
+	kPod.lastPodStatusReceivedFromProvider = updated
+	kPod.Unlock()
+	log.G(ctx).Debug("Container readiness changed, updating pod status")
+	pc.queuePodStatusUpdate(pc.podStatusQ, key)
+}
+
+// restartUnhealthyContainer restarts a container which failed its liveness probe, according to the pod's restart
+// policy. Containers can only be restarted if container restarts are enabled.
+func (pc *PodController) restartUnhealthyContainer(ctx context.Context, key string, pod *corev1.Pod, containerName string) {
+	if pod.Spec.RestartPolicy == corev1.RestartPolicyNever {
+		return
+	}
+	if pc.restarts == nil {
+		log.G(ctx).Warn("Container failed its liveness probe, but container restarts are not enabled")
+		return
+	}
+	pc.recorder.Eventf(pod, corev1.EventTypeNormal, podEventKilling, "Container %s failed liveness probe, will be restarted", containerName)
+	if err := pc.restarts.restartUnhealthyContainer(ctx, key, pod, containerName); err != nil {
+		log.G(ctx).WithError(err).Error("Failed to restart unhealthy container")
+		pc.recorder.Event(pod, corev1.EventTypeWarning, podEventContainerRestartFailed, err.Error())
+	}
+}
@@ -0,0 +1,236 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+type mockContainerRunner struct {
+	cmds [][]string
+	err  error
+}
+
+func (r *mockContainerRunner) RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach api.AttachIO) error {
+	r.cmds = append(r.cmds, cmd)
+	if r.err != nil {
+		attach.Stderr().Write([]byte("not ready")) // nolint:errcheck
+	}
+	return r.err
+}
+
+func TestRunHTTPProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Header.Get("X-Probe") != "yes" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	assert.NilError(t, err)
+	portNum, err := strconv.Atoi(port)
+	assert.NilError(t, err)
+
+	pm := newProbeManager(nil)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"}}
+	container := &corev1.Container{
+		Name:  "nginx",
+		Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: int32(portNum)}},
+	}
+	probe := func(path string, port intstr.IntOrString) *corev1.Probe {
+		return &corev1.Probe{Handler: corev1.Handler{HTTPGet: &corev1.HTTPGetAction{
+			Path:        path,
+			Port:        port,
+			HTTPHeaders: []corev1.HTTPHeader{{Name: "X-Probe", Value: "yes"}},
+		}}}
+	}
+
+	err = pm.runProbe(context.Background(), pod, container, host, probe("/healthz", intstr.FromInt(portNum)))
+	assert.Check(t, err)
+	err = pm.runProbe(context.Background(), pod, container, host, probe("/healthz", intstr.FromString("http")))
+	assert.Check(t, err)
+	err = pm.runProbe(context.Background(), pod, container, host, probe("/", intstr.FromInt(portNum)))
+	assert.Check(t, is.ErrorContains(err, "statuscode: 503"))
+	err = pm.runProbe(context.Background(), pod, container, host, probe("/healthz", intstr.FromString("metrics")))
+	assert.Check(t, is.ErrorContains(err, "invalid port"))
+}
+
+func TestRunTCPProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+
+	pm := newProbeManager(nil)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"}}
+	container := &corev1.Container{Name: "nginx"}
+	probe := &corev1.Probe{Handler: corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(port)}}}
+
+	assert.Check(t, pm.runProbe(context.Background(), pod, container, "127.0.0.1", probe))
+
+	assert.NilError(t, l.Close())
+	assert.Check(t, pm.runProbe(context.Background(), pod, container, "127.0.0.1", probe) != nil)
+}
+
+func TestRunExecProbe(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"}}
+	container := &corev1.Container{Name: "nginx"}
+	probe := &corev1.Probe{Handler: corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"cat", "/tmp/healthy"}}}}
+
+	runner := &mockContainerRunner{}
+	pm := newProbeManager(runner)
+	assert.Check(t, pm.runProbe(context.Background(), pod, container, "", probe))
+	assert.Check(t, is.DeepEqual(runner.cmds, [][]string{{"cat", "/tmp/healthy"}}))
+
+	runner.err = errors.New("command terminated with exit code 1")
+	err := pm.runProbe(context.Background(), pod, container, "", probe)
+	assert.Check(t, is.ErrorContains(err, "not ready"))
+
+	// Exec probes fail if the provider cannot run commands in containers.
+	pm = newProbeManager(nil)
+	err = pm.runProbe(context.Background(), pod, container, "", probe)
+	assert.Check(t, is.ErrorContains(err, "does not support running commands"))
+}
+
+func TestProbeReadinessUpdatesStatus(t *testing.T) {
+	pm := newProbeManager(nil)
+	key := "default/nginx"
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"}}
+	pod.Spec.Containers = []corev1.Container{
+		{Name: "nginx", ReadinessProbe: &corev1.Probe{Handler: corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(80)}}}},
+		{Name: "sidecar"},
+	}
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	newStatus := func() *corev1.PodStatus {
+		return &corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "nginx", State: running, Ready: true},
+				{Name: "sidecar", State: running, Ready: true},
+			},
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		}
+	}
+	condition := func(status *corev1.PodStatus, conditionType corev1.PodConditionType) corev1.ConditionStatus {
+		for _, c := range status.Conditions {
+			if c.Type == conditionType {
+				return c.Status
+			}
+		}
+		return corev1.ConditionUnknown
+	}
+
+	// The container is not ready until its readiness probe succeeds, regardless of what the provider reports.
+	status := newStatus()
+	pm.updateStatus(key, pod, status)
+	assert.Check(t, !status.ContainerStatuses[0].Ready)
+	assert.Check(t, status.ContainerStatuses[1].Ready)
+	assert.Check(t, is.Equal(condition(status, corev1.ContainersReady), corev1.ConditionFalse))
+	assert.Check(t, is.Equal(condition(status, corev1.PodReady), corev1.ConditionFalse))
+
+	assert.Check(t, pm.setReady(key, "nginx", true))
+	assert.Check(t, !pm.setReady(key, "nginx", true))
+	status = newStatus()
+	pm.updateStatus(key, pod, status)
+	assert.Check(t, status.ContainerStatuses[0].Ready)
+	assert.Check(t, is.Equal(condition(status, corev1.ContainersReady), corev1.ConditionTrue))
+	assert.Check(t, is.Equal(condition(status, corev1.PodReady), corev1.ConditionTrue))
+
+	// Forgetting the pod drops the readiness of its containers.
+	pm.forget(key)
+	status = newStatus()
+	pm.updateStatus(key, pod, status)
+	assert.Check(t, !status.ContainerStatuses[0].Ready)
+
+	// The conditions reported by the provider are left untouched for pods without readiness probes.
+	pod.Spec.Containers[0].ReadinessProbe = nil
+	status = newStatus()
+	status.ContainerStatuses[0].Ready = false
+	pm.updateStatus(key, pod, status)
+	assert.Check(t, is.Len(status.Conditions, 1))
+	assert.Check(t, is.Equal(condition(status, corev1.PodReady), corev1.ConditionTrue))
+}
+
+func TestProbeWorkersFollowContainerState(t *testing.T) {
+	pm := newProbeManager(nil)
+	key := "default/nginx"
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"}}
+	probe := &corev1.Probe{Handler: corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(80)}}}
+	pod.Spec.Containers = []corev1.Container{{Name: "nginx", LivenessProbe: probe, ReadinessProbe: probe}}
+
+	started := make(chan probeKey, 2)
+	run := func(ctx context.Context, k probeKey, _ *corev1.Probe) {
+		started <- k
+	}
+
+	status := &corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{Name: "nginx"}}}
+	pm.syncWorkers(context.Background(), key, pod, status, run)
+	assert.Check(t, is.Len(pm.workers, 0))
+
+	status.ContainerStatuses[0].State.Running = &corev1.ContainerStateRunning{}
+	pm.syncWorkers(context.Background(), key, pod, status, run)
+	pm.syncWorkers(context.Background(), key, pod, status, run)
+	assert.Check(t, is.Len(pm.workers, 2))
+	<-started
+	<-started
+
+	status.ContainerStatuses[0].State.Running = nil
+	pm.syncWorkers(context.Background(), key, pod, status, run)
+	assert.Check(t, is.Len(pm.workers, 0))
+}
+
+type chanContainerRunner chan []string
+
+func (r chanContainerRunner) RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach api.AttachIO) error {
+	r <- cmd
+	return nil
+}
+
+func TestProbeWorkerProbesWhenInitialDelayExpires(t *testing.T) {
+	tc := newTestController()
+	runner := make(chanContainerRunner, 10)
+	tc.probes = newProbeManager(runner)
+
+	probe := &corev1.Probe{
+		Handler:             corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"true"}}},
+		InitialDelaySeconds: 1,
+		PeriodSeconds:       60,
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", ReadinessProbe: probe}}},
+	}
+	assert.NilError(t, tc.podsInformer.Informer().GetIndexer().Add(pod))
+
+	started := time.Now()
+	providerPod := pod.DeepCopy()
+	providerPod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		Name:  "nginx",
+		State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: metav1.NewTime(started)}},
+	}}
+	tc.knownPods.Store("default/nginx", &knownPod{lastPodStatusReceivedFromProvider: providerPod})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tc.runProbeWorker(ctx, probeKey{podKey: "default/nginx", container: "nginx", probeType: readinessProbe}, probe)
+
+	select {
+	case cmd := <-runner:
+		assert.Check(t, is.DeepEqual(cmd, []string{"true"}))
+		assert.Check(t, time.Since(started) >= time.Second, "the container must not be probed before the initial delay")
+	case <-time.After(30 * time.Second):
+		t.Fatal("the container must be probed once the initial delay expires, rather than after a full period")
+	}
+}
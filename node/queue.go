@@ -16,21 +16,36 @@ package node
 
 import (
 	"context"
+	"time"
 
 	pkgerrors "github.com/pkg/errors"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 )
 
 const (
-	// maxRetries is the number of times we try to process a given key before permanently forgetting it.
-	maxRetries = 20
+	// DefaultMaxRetries is the default number of times we try to process a given key before permanently forgetting it.
+	DefaultMaxRetries = 20
+
+	// DefaultQueueDrainTimeout is the default maximum duration for which the queues are drained when the pod
+	// controller is shut down.
+	DefaultQueueDrainTimeout = 30 * time.Second
 )
 
 type queueHandler func(ctx context.Context, key string) error
 
-func handleQueueItem(ctx context.Context, q workqueue.RateLimitingInterface, handler queueHandler) bool {
+// DeadLetterHandler is called when a key is permanently dropped from one of the pod controller's work queues after it
+// has reached the maximum number of retries for that queue.
+// queue is the name of the work queue the key was dropped from, and err is the last error returned while processing it.
+type DeadLetterHandler func(ctx context.Context, queue, key string, err error)
+
+// retriesExhaustedHandler is called by handleQueueItem when a key has been forgotten due to maximum retries reached.
+type retriesExhaustedHandler func(ctx context.Context, key string, err error)
+
+func handleQueueItem(ctx context.Context, q workqueue.RateLimitingInterface, handler queueHandler, maxRetries int, onRetriesExhausted retriesExhaustedHandler) bool {
 	ctx, span := trace.StartSpan(ctx, "handleQueueItem")
 	defer span.End()
 
@@ -72,6 +87,9 @@ func handleQueueItem(ctx context.Context, q workqueue.RateLimitingInterface, han
 			}
 			// We've exceeded the maximum retries, so we must forget the key.
 			q.Forget(key)
+			if onRetriesExhausted != nil {
+				onRetriesExhausted(ctx, key, err)
+			}
 			return pkgerrors.Wrapf(err, "forgetting %q due to maximum retries reached", key)
 		}
 		// Finally, if no error occurs we Forget this item so it does not get queued again until another change happens.
@@ -101,5 +119,21 @@ func (pc *PodController) processPodStatusUpdate(ctx context.Context, workerID st
 	// Add the ID of the current worker as an attribute to the current span.
 	ctx = span.WithField(ctx, "workerID", workerID)
 
-	return handleQueueItem(ctx, q, pc.podStatusHandler)
+	return handleQueueItem(ctx, q, pc.podStatusHandler, pc.podStatusMaxRetries, pc.retriesExhausted(syncPodStatusFromProviderQueueName))
+}
+
+// retriesExhausted returns a handler which reports that the given key was dropped from the named queue.
+// An event is emitted on the pod (if it still exists in Kubernetes) and the configured DeadLetterHandler, if any, is called.
+func (pc *PodController) retriesExhausted(queue string) retriesExhaustedHandler {
+	return func(ctx context.Context, key string, err error) {
+		if namespace, name, splitErr := cache.SplitMetaNamespaceKey(key); splitErr == nil {
+			if pod, getErr := pc.podsLister.Pods(namespace).Get(name); getErr == nil {
+				pc.recorder.Eventf(pod, corev1.EventTypeWarning, podEventMaxRetriesExceeded, "gave up processing pod in %s after reaching the maximum number of retries: %v", queue, err)
+			}
+		}
+
+		if pc.deadLetterHandler != nil {
+			pc.deadLetterHandler(ctx, queue, key, err)
+		}
+	}
 }
@@ -0,0 +1,84 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestHandleQueueItemRetriesExhausted(t *testing.T) {
+	type dropped struct {
+		queue, key string
+		err        error
+	}
+	var deadLetters []dropped
+	tc := newTestController(func(cfg *PodControllerConfig, _ *mockProviderAsync) {
+		cfg.DeadLetterHandler = func(ctx context.Context, queue, key string, err error) {
+			deadLetters = append(deadLetters, dropped{queue: queue, key: key, err: err})
+		}
+	})
+	ctx := context.Background()
+
+	pod := &corev1.Pod{}
+	pod.ObjectMeta.Namespace = "default"
+	pod.ObjectMeta.Name = "nginx"
+	pod.Spec = newPodSpec()
+	assert.NilError(t, tc.podsInformer.Informer().GetStore().Add(pod))
+
+	syncErr := errors.New("provider is throttled")
+	var attempts int
+	handler := func(ctx context.Context, key string) error {
+		attempts++
+		return syncErr
+	}
+
+	// Use a rate limiter with no delay so that requeued keys are immediately available.
+	q := workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(0, 0))
+	defer q.ShutDown()
+	q.Add("default/nginx")
+
+	const maxRetries = 2
+	for i := 0; i <= maxRetries; i++ {
+		assert.Assert(t, handleQueueItem(ctx, q, handler, maxRetries, tc.retriesExhausted("test")))
+	}
+
+	assert.Check(t, is.Equal(attempts, maxRetries+1))
+	assert.Check(t, is.Equal(q.Len(), 0))
+	assert.Check(t, is.Equal(q.NumRequeues("default/nginx"), 0))
+
+	assert.Assert(t, is.Len(deadLetters, 1))
+	assert.Check(t, is.Equal(deadLetters[0].queue, "test"))
+	assert.Check(t, is.Equal(deadLetters[0].key, "default/nginx"))
+	assert.Check(t, is.Equal(deadLetters[0].err, syncErr))
+
+	recorder := tc.recorder.(*record.FakeRecorder)
+	select {
+	case event := <-recorder.Events:
+		assert.Check(t, is.Contains(event, podEventMaxRetriesExceeded))
+	default:
+		t.Fatal("expected an event to be emitted on the pod")
+	}
+}
+
+func TestHandleQueueItemSuccessForgetsKey(t *testing.T) {
+	tc := newTestController(func(cfg *PodControllerConfig, _ *mockProviderAsync) {
+		cfg.DeadLetterHandler = func(ctx context.Context, queue, key string, err error) {
+			t.Fatalf("unexpected dead letter for key %q: %v", key, err)
+		}
+	})
+	ctx := context.Background()
+
+	q := workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(0, 0))
+	defer q.ShutDown()
+	q.Add("default/nginx")
+
+	assert.Assert(t, handleQueueItem(ctx, q, func(context.Context, string) error { return nil }, 1, tc.retriesExhausted("test")))
+	assert.Check(t, is.Equal(q.Len(), 0))
+	assert.Check(t, is.Equal(q.NumRequeues("default/nginx"), 0))
+}
@@ -0,0 +1,201 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/metrics"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// DefaultReconcileInterval is the default interval at which the pods known to the provider are reconciled with
+	// the pods known to Kubernetes.
+	DefaultReconcileInterval = 5 * time.Minute
+
+	podEventLeakedPodDeleted      = "ProviderLeakedPodDeleted"
+	podEventLeakedPodDeleteFailed = "ProviderLeakedPodDeleteFailed"
+	podEventLeakedPodFound        = "ProviderLeakedPodFound"
+	podEventLostPodFailed         = "ProviderLostPodFailed"
+	podEventLostPodFound          = "ProviderLostPodFound"
+
+	// The actions taken by the reconciliation, used as the value of the "action" label of the reconciliation metric.
+	reconcileActionDeleteLeaked = "delete_leaked"
+	reconcileActionFailLost     = "fail_lost"
+)
+
+// runReconciliation reconciles the pods known to the provider with the pods known to Kubernetes every interval,
+// until the context is cancelled or the pod controller is shut down.
+func (pc *PodController) runReconciliation(ctx context.Context, threadiness int) {
+	ticker := time.NewTicker(pc.reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pc.shutdown:
+			// There is no point in reconciling pods while the work queues are being drained.
+			return
+		case <-ticker.C:
+			pc.reconcilePods(ctx, threadiness)
+		}
+	}
+}
+
+// reconcilePods compares the pods known to the provider with the pods known to Kubernetes, in both directions.
+// Pods which the provider knows about but Kubernetes doesn't have leaked, and are deleted from the provider. Pods
+// which Kubernetes reports as running but which the provider doesn't know about have been lost, and are marked as
+// failed. In dry-run mode, these pods are only reported.
+// Reconciliation is best-effort: pods it fails to act upon are acted upon again on the next reconciliation.
+func (pc *PodController) reconcilePods(ctx context.Context, threadiness int) {
+	ctx, span := trace.StartSpan(ctx, "reconcilePods")
+	defer span.End()
+	ctx = span.WithField(ctx, "dryRun", pc.reconcileDryRun)
+
+	// Pods are listed from Kubernetes before the provider, so that any pod reported as running by Kubernetes was
+	// created in the provider before the provider's pods were listed.
+	k8sPods, err := pc.podsLister.List(labels.Everything())
+	if err != nil {
+		err := pkgerrors.Wrap(err, "failed to list pods from the lister")
+		span.SetStatus(err)
+		log.G(ctx).Error(err)
+		return
+	}
+
+	// Grab the list of pods known to the provider.
+	pps, err := pc.provider.GetPods(ctx)
+	if err != nil {
+		err := pkgerrors.Wrap(err, "failed to fetch the list of pods from the provider")
+		span.SetStatus(err)
+		log.G(ctx).Error(err)
+		return
+	}
+
+	if err := pc.deleteDanglingPods(ctx, threadiness, pps); err != nil {
+		span.SetStatus(err)
+		log.G(ctx).Error(err)
+	}
+	pc.failLostPods(ctx, k8sPods, pps)
+}
+
+// deleteDanglingPods deletes the given pods known to the provider which Kubernetes doesn't know about.
+func (pc *PodController) deleteDanglingPods(ctx context.Context, threadiness int, pps []*corev1.Pod) error {
+	ctx, span := trace.StartSpan(ctx, "deleteDanglingPods")
+	defer span.End()
+
+	// Create a slice to hold the pods we will be deleting from the provider.
+	ptd := make([]*corev1.Pod, 0)
+
+	// Iterate over the pods known to the provider, marking for deletion those that don't exist in Kubernetes.
+	for _, pp := range pps {
+		if _, err := pc.podsLister.Pods(pp.Namespace).Get(pp.Name); err != nil {
+			if errors.IsNotFound(err) {
+				// The current pod does not exist in Kubernetes, so we mark it for deletion.
+				ptd = append(ptd, pp)
+				continue
+			}
+			// For some reason we couldn't fetch the pod from the lister, so we propagate the error.
+			err := pkgerrors.Wrap(err, "failed to fetch pod from the lister")
+			span.SetStatus(err)
+			return err
+		}
+	}
+
+	// We delete each pod in its own goroutine, allowing a maximum of "threadiness" concurrent deletions.
+	semaphore := make(chan struct{}, threadiness)
+	var wg sync.WaitGroup
+	wg.Add(len(ptd))
+
+	// Iterate over the slice of pods to be deleted and delete them in the provider.
+	for _, pod := range ptd {
+		go func(ctx context.Context, pod *corev1.Pod) {
+			defer wg.Done()
+
+			ctx, span := trace.StartSpan(ctx, "deleteDanglingPod")
+			defer span.End()
+
+			semaphore <- struct{}{}
+			defer func() {
+				<-semaphore
+			}()
+
+			// Add the pod's attributes to the current span.
+			ctx = addPodAttributes(ctx, span, pod)
+			metrics.IncReconciledPods(pc.nodeName, reconcileActionDeleteLeaked, pc.reconcileDryRun)
+			if pc.reconcileDryRun {
+				log.G(ctx).Infof("found leaked pod %q in provider, not deleting it as reconciliation is in dry-run mode", loggablePodName(pod))
+				pc.recorder.Event(pod, corev1.EventTypeWarning, podEventLeakedPodFound, "Pod is not known to Kubernetes but is still running in the provider")
+				return
+			}
+			// Actually delete the pod.
+			if err := pc.provider.DeletePod(ctx, pod.DeepCopy()); err != nil && !errdefs.IsNotFound(err) {
+				span.SetStatus(err)
+				log.G(ctx).Errorf("failed to delete pod %q in provider", loggablePodName(pod))
+				pc.recorder.Eventf(pod, corev1.EventTypeWarning, podEventLeakedPodDeleteFailed, "Failed to delete pod leaked in the provider: %v", err)
+			} else {
+				log.G(ctx).Infof("deleted leaked pod %q in provider", loggablePodName(pod))
+				pc.recorder.Event(pod, corev1.EventTypeNormal, podEventLeakedPodDeleted, "Deleted pod leaked in the provider")
+			}
+		}(ctx, pod)
+	}
+
+	// Wait for all pods to be deleted.
+	wg.Wait()
+	return nil
+}
+
+// failLostPods marks the pods which Kubernetes reports as running, but which are not among the given pods known to the
+// provider, as failed.
+func (pc *PodController) failLostPods(ctx context.Context, k8sPods, pps []*corev1.Pod) {
+	ctx, span := trace.StartSpan(ctx, "failLostPods")
+	defer span.End()
+
+	known := make(map[string]bool, len(pps))
+	for _, pp := range pps {
+		known[loggablePodName(pp)] = true
+	}
+
+	for _, pod := range k8sPods {
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil || known[loggablePodName(pod)] {
+			continue
+		}
+
+		logger := log.G(ctx).WithField("pod", loggablePodName(pod))
+		metrics.IncReconciledPods(pc.nodeName, reconcileActionFailLost, pc.reconcileDryRun)
+		if pc.reconcileDryRun {
+			logger.Info("Found pod lost by the provider, not marking it as failed as reconciliation is in dry-run mode")
+			pc.recorder.Event(pod, corev1.EventTypeWarning, podEventLostPodFound, "Pod is running according to Kubernetes but is not known to the provider")
+			continue
+		}
+
+		if err := pc.patchPodStatus(ctx, pod, &podNotFound(pod).Status); err != nil {
+			span.SetStatus(err)
+			logger.WithError(err).Error("Failed to mark pod lost by the provider as failed")
+			continue
+		}
+		logger.Info("Marked pod lost by the provider as failed")
+		pc.recorder.Event(pod, corev1.EventTypeWarning, podEventLostPodFailed, podStatusMessageNotFound)
+	}
+}
@@ -0,0 +1,78 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func setupReconcileTest(t *testing.T, opts ...func(*PodControllerConfig, *mockProviderAsync)) (*TestController, *corev1.Pod, *corev1.Pod) {
+	tc := newTestController(opts...)
+	ctx := context.Background()
+
+	// The leaked pod is known to the provider, but not to Kubernetes.
+	leaked := newRunningPod()
+	leaked.Name = "leaked"
+	assert.NilError(t, tc.mock.CreatePod(ctx, leaked.DeepCopy()))
+
+	// The lost pod is running according to Kubernetes, but is not known to the provider.
+	lost := newRunningPod()
+	lost.Name = "lost"
+	_, err := tc.client.CoreV1().Pods(lost.Namespace).Create(lost)
+	assert.NilError(t, err)
+	assert.NilError(t, tc.podsInformer.Informer().GetStore().Add(lost))
+
+	// The synced pod is known to both, and must be left untouched.
+	synced := newRunningPod()
+	synced.Name = "synced"
+	assert.NilError(t, tc.mock.CreatePod(ctx, synced.DeepCopy()))
+	_, err = tc.client.CoreV1().Pods(synced.Namespace).Create(synced)
+	assert.NilError(t, err)
+	assert.NilError(t, tc.podsInformer.Informer().GetStore().Add(synced))
+
+	return tc, leaked, lost
+}
+
+func TestReconcilePods(t *testing.T) {
+	tc, leaked, lost := setupReconcileTest(t)
+	ctx := context.Background()
+
+	tc.reconcilePods(ctx, 1)
+
+	_, err := tc.mock.GetPod(ctx, leaked.Namespace, leaked.Name)
+	assert.Check(t, errdefs.IsNotFound(err), "the leaked pod must be deleted from the provider")
+	_, err = tc.mock.GetPod(ctx, "default", "synced")
+	assert.Check(t, err)
+
+	pod, err := tc.client.CoreV1().Pods(lost.Namespace).Get(lost.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pod.Status.Phase, corev1.PodFailed))
+	assert.Check(t, is.Equal(pod.Status.Reason, podStatusReasonNotFound))
+	assert.Check(t, pod.Status.ContainerStatuses[0].State.Terminated != nil)
+
+	pod, err = tc.client.CoreV1().Pods("default").Get("synced", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pod.Status.Phase, corev1.PodRunning))
+}
+
+func TestReconcilePodsDryRun(t *testing.T) {
+	tc, leaked, lost := setupReconcileTest(t, func(cfg *PodControllerConfig, _ *mockProviderAsync) {
+		cfg.ReconcileDryRun = true
+	})
+	ctx := context.Background()
+
+	tc.reconcilePods(ctx, 1)
+
+	_, err := tc.mock.GetPod(ctx, leaked.Namespace, leaked.Name)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(tc.mock.deletes.read(), 0))
+
+	pod, err := tc.client.CoreV1().Pods(lost.Namespace).Get(lost.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pod.Status.Phase, corev1.PodRunning))
+}
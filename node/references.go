@@ -0,0 +1,233 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"sync"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	configMapKind = "ConfigMap"
+	secretKind    = "Secret"
+)
+
+// resourceReference identifies a namespaced object (a configmap or a secret) which is referenced by a pod.
+type resourceReference struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+// podReferences keeps track of which pods reference which configmaps and secrets, either from their containers'
+// environment (".env" and ".envFrom") or from their volumes.
+type podReferences struct {
+	mu sync.Mutex
+	// byResource maps a configmap or secret to the keys of the pods which reference it.
+	byResource map[resourceReference]sets.String
+	// byPod maps the key of a pod to the configmaps and secrets it references.
+	byPod map[string][]resourceReference
+}
+
+func newPodReferences() *podReferences {
+	return &podReferences{
+		byResource: make(map[resourceReference]sets.String),
+		byPod:      make(map[string][]resourceReference),
+	}
+}
+
+// update replaces the set of references tracked for the pod with the given key.
+func (r *podReferences) update(key string, pod *corev1.Pod) {
+	refs := referencedResources(pod)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.removeLocked(key)
+	if len(refs) == 0 {
+		return
+	}
+	r.byPod[key] = refs
+	for _, ref := range refs {
+		keys, ok := r.byResource[ref]
+		if !ok {
+			keys = sets.NewString()
+			r.byResource[ref] = keys
+		}
+		keys.Insert(key)
+	}
+}
+
+// remove stops tracking the references of the pod with the given key.
+func (r *podReferences) remove(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeLocked(key)
+}
+
+func (r *podReferences) removeLocked(key string) {
+	for _, ref := range r.byPod[key] {
+		keys := r.byResource[ref]
+		keys.Delete(key)
+		if keys.Len() == 0 {
+			delete(r.byResource, ref)
+		}
+	}
+	delete(r.byPod, key)
+}
+
+// podsReferencing returns the keys of the pods which reference the given configmap or secret.
+func (r *podReferences) podsReferencing(ref resourceReference) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.byResource[ref].List()
+}
+
+// referencedResources returns the configmaps and secrets referenced by the pod.
+// This includes references from the environment of containers and init containers, as well as configmap, secret and
+// projected volumes.
+func referencedResources(pod *corev1.Pod) []resourceReference {
+	seen := make(map[resourceReference]struct{})
+	var refs []resourceReference
+	add := func(kind, name string) {
+		if name == "" {
+			return
+		}
+		ref := resourceReference{kind: kind, namespace: pod.Namespace, name: name}
+		if _, ok := seen[ref]; ok {
+			return
+		}
+		seen[ref] = struct{}{}
+		refs = append(refs, ref)
+	}
+
+	addContainer := func(c *corev1.Container) {
+		for _, envFrom := range c.EnvFrom {
+			if envFrom.ConfigMapRef != nil {
+				add(configMapKind, envFrom.ConfigMapRef.Name)
+			}
+			if envFrom.SecretRef != nil {
+				add(secretKind, envFrom.SecretRef.Name)
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				add(configMapKind, env.ValueFrom.ConfigMapKeyRef.Name)
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				add(secretKind, env.ValueFrom.SecretKeyRef.Name)
+			}
+		}
+	}
+
+	for i := range pod.Spec.InitContainers {
+		addContainer(&pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		addContainer(&pod.Spec.Containers[i])
+	}
+
+	for _, v := range pod.Spec.Volumes {
+		switch {
+		case v.ConfigMap != nil:
+			add(configMapKind, v.ConfigMap.Name)
+		case v.Secret != nil:
+			add(secretKind, v.Secret.SecretName)
+		case v.Projected != nil:
+			for _, source := range v.Projected.Sources {
+				if source.ConfigMap != nil {
+					add(configMapKind, source.ConfigMap.Name)
+				}
+				if source.Secret != nil {
+					add(secretKind, source.Secret.Name)
+				}
+			}
+		}
+	}
+
+	return refs
+}
+
+// referencedResourceEventHandler returns an event handler which requeues the pods referencing a configmap or secret
+// (depending on kind) whenever that object is created or changed.
+//
+// Creations are handled so that pods which failed to be created because a mandatory configmap or secret was missing
+// are retried as soon as it shows up.
+// Deletions are ignored, as the kubelet does not act upon already running pods when a referenced object goes away.
+func (pc *PodController) referencedResourceEventHandler(ctx context.Context, kind string) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pc.enqueueReferencingPods(ctx, kind, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldMeta, err := meta.Accessor(oldObj)
+			if err != nil {
+				log.G(ctx).Error(err)
+				return
+			}
+			newMeta, err := meta.Accessor(newObj)
+			if err != nil {
+				log.G(ctx).Error(err)
+				return
+			}
+			// Periodic resyncs send update events for objects that have not changed, so we skip those.
+			if oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+				return
+			}
+			pc.enqueueReferencingPods(ctx, kind, newObj)
+		},
+	}
+}
+
+// enqueueReferencingPods puts the pods referencing the given configmap or secret back on the work queue, making sure
+// they are synced against the provider even though the pods themselves have not changed.
+func (pc *PodController) enqueueReferencingPods(ctx context.Context, kind string, obj interface{}) {
+	ctx, span := trace.StartSpan(ctx, "enqueueReferencingPods")
+	defer span.End()
+
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		span.SetStatus(err)
+		log.G(ctx).Error(err)
+		return
+	}
+	ctx = span.WithFields(ctx, log.Fields{
+		"kind":      kind,
+		"namespace": m.GetNamespace(),
+		"name":      m.GetName(),
+	})
+
+	for _, key := range pc.podRefs.podsReferencing(resourceReference{kind: kind, namespace: m.GetNamespace(), name: m.GetName()}) {
+		if obj, ok := pc.knownPods.Load(key); ok {
+			// Forget about the last pod we have synced, otherwise syncPodInProvider would consider the pod unchanged.
+			kPod := obj.(*knownPod)
+			kPod.Lock()
+			kPod.lastPodUsed = nil
+			kPod.Unlock()
+		}
+		log.G(ctx).WithField("key", key).Debug("Requeuing pod due to a change in a referenced object")
+		pc.k8sQ.AddRateLimited(key)
+	}
+}
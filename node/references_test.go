@@ -0,0 +1,147 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newPodWithReferences() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "nginx",
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{
+					Name: "init",
+					EnvFrom: []corev1.EnvFromSource{
+						{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "init-secret"}}},
+					},
+				},
+			},
+			Containers: []corev1.Container{
+				{
+					Name: "nginx",
+					EnvFrom: []corev1.EnvFromSource{
+						{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "env-from-cm"}}},
+					},
+					Env: []corev1.EnvVar{
+						{
+							Name: "FROM_CM",
+							ValueFrom: &corev1.EnvVarSource{
+								ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "env-cm"}, Key: "k"},
+							},
+						},
+						{
+							Name: "FROM_SECRET",
+							ValueFrom: &corev1.EnvVarSource{
+								SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "env-secret"}, Key: "k"},
+							},
+						},
+						{
+							// A second reference to the same configmap must not be reported twice.
+							Name: "FROM_CM_AGAIN",
+							ValueFrom: &corev1.EnvVarSource{
+								ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "env-cm"}, Key: "k2"},
+							},
+						},
+					},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name:         "cm",
+					VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "volume-cm"}}},
+				},
+				{
+					Name:         "secret",
+					VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "volume-secret"}},
+				},
+				{
+					Name: "projected",
+					VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+						Sources: []corev1.VolumeProjection{
+							{ConfigMap: &corev1.ConfigMapProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "projected-cm"}}},
+							{Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "projected-secret"}}},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+func TestReferencedResources(t *testing.T) {
+	refs := referencedResources(newPodWithReferences())
+
+	ref := func(kind, name string) resourceReference {
+		return resourceReference{kind: kind, namespace: "default", name: name}
+	}
+	assert.Check(t, is.DeepEqual(refs, []resourceReference{
+		ref(secretKind, "init-secret"),
+		ref(configMapKind, "env-from-cm"),
+		ref(configMapKind, "env-cm"),
+		ref(secretKind, "env-secret"),
+		ref(configMapKind, "volume-cm"),
+		ref(secretKind, "volume-secret"),
+		ref(configMapKind, "projected-cm"),
+		ref(secretKind, "projected-secret"),
+	}, cmp.AllowUnexported(resourceReference{})))
+}
+
+func TestPodReferencesUpdateAndRemove(t *testing.T) {
+	r := newPodReferences()
+	pod := newPodWithReferences()
+	cm := resourceReference{kind: configMapKind, namespace: "default", name: "env-cm"}
+
+	r.update("default/nginx", pod)
+	r.update("default/other", pod)
+	assert.Check(t, is.DeepEqual(r.podsReferencing(cm), []string{"default/nginx", "default/other"}))
+
+	// Dropping the reference from the pod spec must stop tracking it.
+	pod = pod.DeepCopy()
+	pod.Spec.Containers[0].Env = nil
+	r.update("default/nginx", pod)
+	assert.Check(t, is.DeepEqual(r.podsReferencing(cm), []string{"default/other"}))
+
+	r.remove("default/other")
+	assert.Check(t, is.Len(r.podsReferencing(cm), 0))
+	assert.Check(t, is.Len(r.byResource[cm], 0))
+}
+
+func TestEnqueueReferencingPods(t *testing.T) {
+	tc := newTestController()
+	ctx := context.Background()
+
+	pod := newPodWithReferences()
+	key := "default/nginx"
+	kPod := &knownPod{lastPodUsed: pod}
+	tc.knownPods.Store(key, kPod)
+	tc.podRefs.update(key, pod)
+
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unrelated"}}
+	tc.enqueueReferencingPods(ctx, configMapKind, cm)
+	assert.Check(t, is.Equal(tc.k8sQ.Len(), 0))
+
+	cm.Name = "volume-cm"
+	tc.enqueueReferencingPods(ctx, configMapKind, cm)
+	// A secret with the same name as a referenced configmap must not match.
+	tc.enqueueReferencingPods(ctx, secretKind, &corev1.Secret{ObjectMeta: cm.ObjectMeta})
+
+	item, shutdown := tc.k8sQ.Get()
+	assert.Assert(t, !shutdown)
+	assert.Check(t, is.Equal(item, key))
+	tc.k8sQ.Done(item)
+	assert.Check(t, is.Equal(tc.k8sQ.Len(), 0))
+
+	kPod.Lock()
+	defer kPod.Unlock()
+	assert.Check(t, kPod.lastPodUsed == nil, "last used pod should be reset so the pod gets re-synced")
+}
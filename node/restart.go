@@ -0,0 +1,318 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// DefaultContainerRestartBackOff is the default delay before restarting a container which keeps terminating.
+	// This is the same as the kubelet's.
+	DefaultContainerRestartBackOff = 10 * time.Second
+	// DefaultContainerRestartMaxBackOff is the default maximum delay before restarting a container which keeps
+	// terminating. This is the same as the kubelet's.
+	DefaultContainerRestartMaxBackOff = 300 * time.Second
+
+	containerStateReasonCrashLoopBackOff = "CrashLoopBackOff"
+	podEventBackOff                      = "BackOff"
+	podEventContainerRestartSuccess      = "ProviderContainerRestartSuccess"
+	podEventContainerRestartFailed       = "ProviderContainerRestartFailed"
+)
+
+// restartManager restarts the containers of pods which the provider reports as terminated, according to the pods'
+// restart policy. Containers which keep terminating are restarted with an exponential back-off, during which they are
+// reported in the "CrashLoopBackOff" waiting state.
+type restartManager struct {
+	restarter ContainerRestarter
+	// q is the queue on which pods that have containers to restart are processed.
+	q workqueue.RateLimitingInterface
+
+	mu      sync.Mutex
+	backOff *flowcontrol.Backoff
+	// containers holds the restarts of each container, keyed by containerRestartID.
+	containers map[string]*containerRestarts
+}
+
+// containerRestarts keeps track of the restarts of a single container.
+type containerRestarts struct {
+	// count is the number of times the container was restarted.
+	count int32
+	// lastTermination is the last termination of the container which caused it to be restarted.
+	lastTermination *corev1.ContainerStateTerminated
+}
+
+func newRestartManager(restarter ContainerRestarter, backOff *flowcontrol.Backoff, nodeName string) *restartManager {
+	return &restartManager{
+		restarter:  restarter,
+		q:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), queueName(restartContainersQueueName, nodeName)),
+		backOff:    backOff,
+		containers: make(map[string]*containerRestarts),
+	}
+}
+
+func containerRestartID(key, containerName string) string {
+	return key + "/" + containerName
+}
+
+// shouldRestartContainer returns whether a container which terminated must be restarted according to the restart
+// policy of its pod.
+func shouldRestartContainer(policy corev1.RestartPolicy, terminated *corev1.ContainerStateTerminated) bool {
+	switch policy {
+	case corev1.RestartPolicyNever:
+		return false
+	case corev1.RestartPolicyOnFailure:
+		return terminated.ExitCode != 0
+	default:
+		return true
+	}
+}
+
+func sameTermination(t1, t2 *corev1.ContainerStateTerminated) bool {
+	return t1.ContainerID == t2.ContainerID && t1.FinishedAt.Equal(&t2.FinishedAt)
+}
+
+// terminationOf returns the termination of the container which is pending a restart, if any.
+// Containers in back-off are in the waiting state, with the termination as their last state.
+func terminationOf(cs *corev1.ContainerStatus) *corev1.ContainerStateTerminated {
+	if cs.State.Terminated != nil {
+		return cs.State.Terminated
+	}
+	if cs.State.Waiting != nil && cs.State.Waiting.Reason == containerStateReasonCrashLoopBackOff {
+		return cs.LastTerminationState.Terminated
+	}
+	return nil
+}
+
+// updateStatus amends the status of the given pod, as reported by the provider, with the restarts of its containers.
+// The restart count and last termination state of restarted containers are set, and containers waiting to be
+// restarted are reported in the "CrashLoopBackOff" waiting state. It returns whether any of the pod's containers
+// must be restarted.
+func (rm *restartManager) updateStatus(key string, policy corev1.RestartPolicy, pod *corev1.Pod) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	var restart, pending bool
+	for i := range pod.Status.ContainerStatuses {
+		cs := &pod.Status.ContainerStatuses[i]
+		id := containerRestartID(key, cs.Name)
+
+		restarts := rm.containers[id]
+		if restarts != nil {
+			if cs.RestartCount < restarts.count {
+				cs.RestartCount = restarts.count
+			}
+			if cs.LastTerminationState.Terminated == nil {
+				cs.LastTerminationState.Terminated = restarts.lastTermination.DeepCopy()
+			}
+		}
+
+		terminated := cs.State.Terminated
+		if terminated == nil || !shouldRestartContainer(policy, terminated) {
+			continue
+		}
+		if restarts != nil && restarts.lastTermination != nil && sameTermination(restarts.lastTermination, terminated) {
+			// The container has already been restarted, but the provider has not reported its new state yet.
+			pending = true
+			continue
+		}
+		restart = true
+
+		if rm.backOff.IsInBackOffSince(id, terminated.FinishedAt.Time) {
+			cs.LastTerminationState = corev1.ContainerState{Terminated: terminated}
+			cs.State = corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+				Reason:  containerStateReasonCrashLoopBackOff,
+				Message: fmt.Sprintf("back-off %s restarting failed container=%s pod=%s", rm.backOff.Get(id), cs.Name, pod.Name),
+			}}
+			cs.Ready = false
+		}
+	}
+
+	// The pod is not done as long as some of its containers are going to be restarted.
+	if (restart || pending) && (pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed) {
+		pod.Status.Phase = corev1.PodRunning
+		pod.Status.Reason = ""
+		pod.Status.Message = ""
+	}
+	return restart
+}
+
+// restartContainers restarts the containers of the pod which terminated, unless they are in back-off, in which case
+// the pod is requeued for when the back-off expires.
+// status is the last status of the pod reported by the provider, as amended by updateStatus.
+// It returns the names of the containers which were restarted, and of those which are in back-off.
+func (rm *restartManager) restartContainers(ctx context.Context, key string, pod *corev1.Pod, status *corev1.PodStatus) (restarted, backingOff []string, _ error) {
+	for i := range status.ContainerStatuses {
+		cs := &status.ContainerStatuses[i]
+		terminated := terminationOf(cs)
+		if terminated == nil || !shouldRestartContainer(pod.Spec.RestartPolicy, terminated) {
+			continue
+		}
+		id := containerRestartID(key, cs.Name)
+		logger := log.G(ctx).WithField("container", cs.Name)
+
+		rm.mu.Lock()
+		restarts, ok := rm.containers[id]
+		if !ok {
+			restarts = &containerRestarts{}
+			rm.containers[id] = restarts
+		}
+		if restarts.lastTermination != nil && sameTermination(restarts.lastTermination, terminated) {
+			rm.mu.Unlock()
+			continue
+		}
+		if rm.backOff.IsInBackOffSince(id, terminated.FinishedAt.Time) {
+			delay := rm.backOff.Get(id) - rm.backOff.Clock.Since(terminated.FinishedAt.Time)
+			rm.mu.Unlock()
+			logger.WithField("delay", delay).Debug("Container is in back-off, postponing restart")
+			rm.q.AddAfter(key, delay)
+			backingOff = append(backingOff, cs.Name)
+			continue
+		}
+		rm.backOff.Next(id, terminated.FinishedAt.Time)
+		rm.mu.Unlock()
+
+		logger.Debug("Restarting container in provider")
+		if err := rm.restarter.RestartContainer(ctx, pod.DeepCopy(), cs.Name); err != nil {
+			return restarted, backingOff, pkgerrors.Wrapf(err, "failed to restart container %q", cs.Name)
+		}
+
+		rm.mu.Lock()
+		restarts.count++
+		restarts.lastTermination = terminated.DeepCopy()
+		rm.mu.Unlock()
+		logger.Info("Restarted container in provider")
+		restarted = append(restarted, cs.Name)
+	}
+	return restarted, backingOff, nil
+}
+
+// restartUnhealthyContainer restarts a running container which the probe manager found to be unhealthy.
+func (rm *restartManager) restartUnhealthyContainer(ctx context.Context, key string, pod *corev1.Pod, containerName string) error {
+	if err := rm.restarter.RestartContainer(ctx, pod.DeepCopy(), containerName); err != nil {
+		return pkgerrors.Wrapf(err, "failed to restart container %q", containerName)
+	}
+
+	id := containerRestartID(key, containerName)
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	restarts, ok := rm.containers[id]
+	if !ok {
+		restarts = &containerRestarts{}
+		rm.containers[id] = restarts
+	}
+	restarts.count++
+	return nil
+}
+
+// forget drops the restarts of the containers of the pod with the given key.
+func (rm *restartManager) forget(key string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	prefix := key + "/"
+	for id := range rm.containers {
+		if strings.HasPrefix(id, prefix) {
+			delete(rm.containers, id)
+			rm.backOff.Reset(id)
+		}
+	}
+}
+
+func (pc *PodController) runRestartContainersWorker(ctx context.Context, workerID string, q workqueue.RateLimitingInterface) {
+	for pc.breaker.wait(ctx) && pc.processRestartContainers(ctx, workerID, q) {
+	}
+}
+
+func (pc *PodController) processRestartContainers(ctx context.Context, workerID string, q workqueue.RateLimitingInterface) bool {
+	ctx, span := trace.StartSpan(ctx, "processRestartContainers")
+	defer span.End()
+
+	// Add the ID of the current worker as an attribute to the current span.
+	ctx = span.WithField(ctx, "workerID", workerID)
+
+	return handleQueueItem(ctx, q, pc.restartContainersHandler, DefaultMaxRetries, pc.retriesExhausted(restartContainersQueueName))
+}
+
+func (pc *PodController) restartContainersHandler(ctx context.Context, key string) (retErr error) {
+	ctx, span := trace.StartSpan(ctx, "restartContainersHandler")
+	defer span.End()
+
+	ctx = span.WithField(ctx, "key", key)
+	defer func() {
+		span.SetStatus(retErr)
+	}()
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		// Log the error as a warning, but do not requeue the key as it is invalid.
+		log.G(ctx).Warn(pkgerrors.Wrapf(err, "invalid resource key: %q", key))
+		return nil
+	}
+
+	pod, err := pc.podsLister.Pods(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			pc.restarts.forget(key)
+			return nil
+		}
+		return pkgerrors.Wrap(err, "error looking up pod")
+	}
+	// Containers of pods which are being deleted must not be restarted.
+	if pod.DeletionTimestamp != nil {
+		return nil
+	}
+
+	obj, ok := pc.knownPods.Load(key)
+	if !ok {
+		return nil
+	}
+	kPod := obj.(*knownPod)
+	kPod.Lock()
+	var status *corev1.PodStatus
+	if kPod.lastPodStatusReceivedFromProvider != nil {
+		status = kPod.lastPodStatusReceivedFromProvider.Status.DeepCopy()
+	}
+	kPod.Unlock()
+	if status == nil {
+		return nil
+	}
+
+	restarted, backingOff, err := pc.restarts.restartContainers(ctx, key, pod, status)
+	for _, name := range restarted {
+		pc.recorder.Eventf(pod, corev1.EventTypeNormal, podEventContainerRestartSuccess, "Restarted container %s in provider successfully", name)
+	}
+	for _, name := range backingOff {
+		pc.recorder.Eventf(pod, corev1.EventTypeWarning, podEventBackOff, "Back-off restarting failed container %s", name)
+	}
+	if err != nil {
+		pc.recorder.Event(pod, corev1.EventTypeWarning, podEventContainerRestartFailed, err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+type mockContainerRestarter struct {
+	restarts []string
+}
+
+func (r *mockContainerRestarter) RestartContainer(ctx context.Context, pod *corev1.Pod, containerName string) error {
+	r.restarts = append(r.restarts, containerName)
+	return nil
+}
+
+func TestShouldRestartContainer(t *testing.T) {
+	succeeded := &corev1.ContainerStateTerminated{ExitCode: 0}
+	failed := &corev1.ContainerStateTerminated{ExitCode: 1}
+
+	assert.Check(t, shouldRestartContainer(corev1.RestartPolicyAlways, succeeded))
+	assert.Check(t, shouldRestartContainer(corev1.RestartPolicyAlways, failed))
+	assert.Check(t, !shouldRestartContainer(corev1.RestartPolicyOnFailure, succeeded))
+	assert.Check(t, shouldRestartContainer(corev1.RestartPolicyOnFailure, failed))
+	assert.Check(t, !shouldRestartContainer(corev1.RestartPolicyNever, failed))
+}
+
+func TestRestartContainersWithBackOff(t *testing.T) {
+	tc := newTestController()
+	ctx := context.Background()
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	restarter := &mockContainerRestarter{}
+	tc.restarts = newRestartManager(restarter, flowcontrol.NewFakeBackOff(10*time.Second, 40*time.Second, fakeClock), "")
+	defer tc.restarts.q.ShutDown()
+
+	pod := &corev1.Pod{}
+	pod.ObjectMeta.Namespace = "default"
+	pod.ObjectMeta.Name = "nginx"
+	pod.Spec = newPodSpec()
+	pod.Spec.RestartPolicy = corev1.RestartPolicyAlways
+	assert.NilError(t, tc.podsInformer.Informer().GetStore().Add(pod))
+	key := "default/nginx"
+	kPod := &knownPod{}
+	tc.knownPods.Store(key, kPod)
+
+	report := func(state corev1.ContainerState, phase corev1.PodPhase) *corev1.ContainerStatus {
+		reported := pod.DeepCopy()
+		reported.Status.Phase = phase
+		reported.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "nginx", State: state}}
+		tc.enqueuePodStatusUpdate(ctx, tc.podStatusQ, reported)
+
+		kPod.Lock()
+		defer kPod.Unlock()
+		assert.Check(t, is.Equal(kPod.lastPodStatusReceivedFromProvider.Status.Phase, corev1.PodRunning))
+		return &kPod.lastPodStatusReceivedFromProvider.Status.ContainerStatuses[0]
+	}
+	terminated := func(containerID string) corev1.ContainerState {
+		return corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+			ContainerID: containerID,
+			ExitCode:    1,
+			FinishedAt:  metav1.NewTime(fakeClock.Now()),
+		}}
+	}
+
+	// The first time the container terminates, it is restarted right away, and the pod is not reported as failed.
+	cs := report(terminated("c1"), corev1.PodFailed)
+	assert.Check(t, cs.State.Terminated != nil)
+	assert.Check(t, is.Equal(tc.restarts.q.Len(), 1))
+	assert.NilError(t, tc.restartContainersHandler(ctx, key))
+	assert.Check(t, is.DeepEqual(restarter.restarts, []string{"nginx"}))
+
+	// Handling the same termination again must not restart the container again.
+	assert.NilError(t, tc.restartContainersHandler(ctx, key))
+	assert.Check(t, is.Len(restarter.restarts, 1))
+
+	// The restart count is kept by the pod controller.
+	cs = report(corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}, corev1.PodRunning)
+	assert.Check(t, is.Equal(cs.RestartCount, int32(1)))
+	assert.Check(t, cs.LastTerminationState.Terminated != nil)
+
+	// When the container terminates again, it is in back-off.
+	fakeClock.Step(time.Second)
+	cs = report(terminated("c2"), corev1.PodRunning)
+	assert.Assert(t, cs.State.Waiting != nil)
+	assert.Check(t, is.Equal(cs.State.Waiting.Reason, containerStateReasonCrashLoopBackOff))
+	assert.Check(t, is.Equal(cs.LastTerminationState.Terminated.ContainerID, "c2"))
+	assert.Check(t, is.Equal(cs.RestartCount, int32(1)))
+	assert.NilError(t, tc.restartContainersHandler(ctx, key))
+	assert.Check(t, is.Len(restarter.restarts, 1))
+
+	// Once the back-off expires, the container is restarted.
+	fakeClock.Step(10 * time.Second)
+	assert.NilError(t, tc.restartContainersHandler(ctx, key))
+	assert.Check(t, is.Len(restarter.restarts, 2))
+
+	cs = report(corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}, corev1.PodRunning)
+	assert.Check(t, is.Equal(cs.RestartCount, int32(2)))
+
+	// Deleting the pod drops its restarts.
+	tc.restarts.forget(key)
+	assert.Check(t, is.Len(tc.restarts.containers, 0))
+}
+
+func TestRestartContainersRespectsRestartPolicy(t *testing.T) {
+	tc := newTestController()
+	ctx := context.Background()
+
+	restarter := &mockContainerRestarter{}
+	tc.restarts = newRestartManager(restarter, flowcontrol.NewBackOff(DefaultContainerRestartBackOff, DefaultContainerRestartMaxBackOff), "")
+	defer tc.restarts.q.ShutDown()
+
+	pod := &corev1.Pod{}
+	pod.ObjectMeta.Namespace = "default"
+	pod.ObjectMeta.Name = "nginx"
+	pod.Spec = newPodSpec()
+	pod.Spec.RestartPolicy = corev1.RestartPolicyOnFailure
+	assert.NilError(t, tc.podsInformer.Informer().GetStore().Add(pod))
+	key := "default/nginx"
+	tc.knownPods.Store(key, &knownPod{})
+
+	reported := pod.DeepCopy()
+	reported.Status.Phase = corev1.PodSucceeded
+	reported.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{Name: "nginx", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}},
+	}
+	tc.enqueuePodStatusUpdate(ctx, tc.podStatusQ, reported)
+
+	assert.Check(t, is.Equal(tc.restarts.q.Len(), 0))
+	assert.NilError(t, tc.restartContainersHandler(ctx, key))
+	assert.Check(t, is.Len(restarter.restarts, 0))
+}
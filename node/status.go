@@ -0,0 +1,135 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// DefaultPodStatusCoalescePeriod is the default period during which successive status updates of a pod are coalesced
+// into a single update in Kubernetes.
+const DefaultPodStatusCoalescePeriod = 250 * time.Millisecond
+
+// mergeOwnedPodStatus returns the given status of a pod from Kubernetes, with the fields owned by virtual-kubelet
+// replaced by those of the status reported for it.
+// Conditions are merged by type, so that conditions which are not reported (such as those of readiness gates, which
+// are written by other controllers) are left untouched.
+func mergeOwnedPodStatus(current, reported *corev1.PodStatus) *corev1.PodStatus {
+	merged := current.DeepCopy()
+	merged.Phase = reported.Phase
+	merged.Reason = reported.Reason
+	merged.Message = reported.Message
+	merged.HostIP = reported.HostIP
+	merged.PodIP = reported.PodIP
+	merged.StartTime = reported.StartTime.DeepCopy()
+	merged.InitContainerStatuses = reported.DeepCopy().InitContainerStatuses
+	merged.ContainerStatuses = reported.DeepCopy().ContainerStatuses
+	if reported.QOSClass != "" {
+		merged.QOSClass = reported.QOSClass
+	}
+
+	for _, c := range reported.Conditions {
+		replaced := false
+		for i := range merged.Conditions {
+			if merged.Conditions[i].Type == c.Type {
+				merged.Conditions[i] = *c.DeepCopy()
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged.Conditions = append(merged.Conditions, *c.DeepCopy())
+		}
+	}
+	return merged
+}
+
+// podStatusPatch returns a strategic merge patch updating the status of the pod with the fields of the reported
+// status owned by virtual-kubelet, or nil if there is nothing to update.
+// The patch is conditioned on the pod's UID and resource version, so that it fails with a conflict if the pod has
+// changed in the meantime.
+// Based on PatchPodStatus in pkg/util/pod/pod.go.
+func podStatusPatch(pod *corev1.Pod, reported *corev1.PodStatus) ([]byte, error) {
+	merged := mergeOwnedPodStatus(&pod.Status, reported)
+	if equality.Semantic.DeepEqual(&pod.Status, merged) {
+		return nil, nil
+	}
+
+	oldData, err := json.Marshal(corev1.Pod{Status: pod.Status})
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "failed to marshal the current pod status")
+	}
+	newData, err := json.Marshal(corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{UID: pod.UID, ResourceVersion: pod.ResourceVersion},
+		Status:     *merged,
+	})
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "failed to marshal the new pod status")
+	}
+	patch, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, corev1.Pod{})
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "failed to create pod status patch")
+	}
+	return patch, nil
+}
+
+// patchPodStatus patches the status of the given pod from Kubernetes with the fields of the reported status owned by
+// virtual-kubelet. On conflicts, the pod is fetched again and the patch retried.
+func (pc *PodController) patchPodStatus(ctx context.Context, pod *corev1.Pod, reported *corev1.PodStatus) error {
+	current := pod
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		patch, err := podStatusPatch(current, reported)
+		if err != nil || patch == nil {
+			return err
+		}
+		_, err = pc.client.Pods(current.Namespace).Patch(current.Name, types.StrategicMergePatchType, patch, "status")
+		if errors.IsConflict(err) {
+			log.G(ctx).WithError(err).Debug("Conflict while patching pod status, retrying")
+			latest, getErr := pc.client.Pods(current.Namespace).Get(current.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			if latest.UID != pod.UID {
+				// The pod was deleted and recreated, so the status does not apply to it.
+				return nil
+			}
+			current = latest
+		}
+		return err
+	})
+}
+
+// queuePodStatusUpdate queues the pod with the given key for its status to be updated in Kubernetes.
+// Status updates queued within the coalesce period result in a single update, with the latest status.
+func (pc *PodController) queuePodStatusUpdate(q workqueue.RateLimitingInterface, key string) {
+	if pc.podStatusCoalescePeriod > 0 {
+		q.AddAfter(key, pc.podStatusCoalescePeriod)
+		return
+	}
+	q.AddRateLimited(key)
+}
@@ -0,0 +1,106 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestMergeOwnedPodStatusKeepsForeignConditions(t *testing.T) {
+	current := &corev1.PodStatus{
+		Phase: corev1.PodPending,
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodReady, Status: corev1.ConditionFalse},
+			{Type: "example.com/gate", Status: corev1.ConditionTrue},
+		},
+	}
+	reported := &corev1.PodStatus{
+		Phase:  corev1.PodRunning,
+		PodIP:  "10.0.0.1",
+		HostIP: "1.2.3.4",
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+			{Type: corev1.PodScheduled, Status: corev1.ConditionTrue},
+		},
+	}
+
+	merged := mergeOwnedPodStatus(current, reported)
+	assert.Check(t, is.Equal(merged.Phase, corev1.PodRunning))
+	assert.Check(t, is.Equal(merged.PodIP, "10.0.0.1"))
+	assert.Check(t, is.DeepEqual(merged.Conditions, []corev1.PodCondition{
+		{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+		{Type: "example.com/gate", Status: corev1.ConditionTrue},
+		{Type: corev1.PodScheduled, Status: corev1.ConditionTrue},
+	}))
+	// The current status must not be modified.
+	assert.Check(t, is.Equal(current.Phase, corev1.PodPending))
+}
+
+func TestPodStatusPatchIsNilWhenUnchanged(t *testing.T) {
+	pod := newRunningPod()
+	patch, err := podStatusPatch(pod, pod.Status.DeepCopy())
+	assert.NilError(t, err)
+	assert.Check(t, is.Nil(patch))
+}
+
+func TestUpdatePodStatusPreservesForeignConditions(t *testing.T) {
+	tc := newTestController()
+	ctx := context.Background()
+	key := "default/nginx"
+
+	pod := newRunningPod()
+	pod.Status.Phase = corev1.PodPending
+	pod.Status.ContainerStatuses = nil
+	pod.Status.Conditions = []corev1.PodCondition{{Type: "example.com/gate", Status: corev1.ConditionTrue}}
+	pod, err := tc.client.CoreV1().Pods(pod.Namespace).Create(pod)
+	assert.NilError(t, err)
+
+	fromProvider := newRunningPod()
+	fromProvider.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	tc.knownPods.Store(key, &knownPod{lastPodStatusReceivedFromProvider: fromProvider})
+
+	assert.NilError(t, tc.updatePodStatus(ctx, pod, key))
+
+	updated, err := tc.client.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(updated.Status.Phase, corev1.PodRunning))
+	assert.Check(t, is.Len(updated.Status.ContainerStatuses, 1))
+	assert.Check(t, is.DeepEqual(updated.Status.Conditions, []corev1.PodCondition{
+		{Type: "example.com/gate", Status: corev1.ConditionTrue},
+		{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+	}))
+}
+
+func TestPodStatusUpdatesAreCoalesced(t *testing.T) {
+	tc := newTestController(func(cfg *PodControllerConfig, _ *mockProviderAsync) {
+		cfg.PodStatusCoalescePeriod = 500 * time.Millisecond
+	})
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer q.ShutDown()
+
+	for i := 0; i < 3; i++ {
+		tc.queuePodStatusUpdate(q, "default/nginx")
+	}
+	assert.Check(t, is.Equal(q.Len(), 0), "the update must be delayed by the coalesce period")
+
+	// The updates are delivered as a single item once the coalesce period ends.
+	got := make(chan interface{}, 1)
+	go func() {
+		item, _ := q.Get()
+		got <- item
+	}()
+	select {
+	case item := <-got:
+		assert.Check(t, is.Equal(item, "default/nginx"))
+		q.Done(item)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the coalesced update was not queued")
+	}
+	assert.Check(t, is.Equal(q.Len(), 0), "the updates must be coalesced into a single item")
+}
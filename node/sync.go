@@ -54,13 +54,29 @@ func (p *syncProviderWrapper) _deletePodKey(ctx context.Context, key string) {
 
 func (p *syncProviderWrapper) DeletePod(ctx context.Context, pod *corev1.Pod) error {
 	log.G(ctx).Debug("syncProviderWrappper.DeletePod")
+	return p.deletePod(ctx, pod, p.PodLifecycleHandler.DeletePod)
+}
+
+// DeletePodWithGracePeriod passes the grace period on to the wrapped provider if it implements GracefulPodDeleter,
+// and otherwise falls back to DeletePod.
+func (p *syncProviderWrapper) DeletePodWithGracePeriod(ctx context.Context, pod *corev1.Pod, gracePeriod time.Duration) error {
+	log.G(ctx).Debug("syncProviderWrappper.DeletePodWithGracePeriod")
+	return p.deletePod(ctx, pod, func(ctx context.Context, pod *corev1.Pod) error {
+		if d, ok := p.PodLifecycleHandler.(GracefulPodDeleter); ok {
+			return d.DeletePodWithGracePeriod(ctx, pod, gracePeriod)
+		}
+		return p.PodLifecycleHandler.DeletePod(ctx, pod)
+	})
+}
+
+func (p *syncProviderWrapper) deletePod(ctx context.Context, pod *corev1.Pod, deleteFn func(context.Context, *corev1.Pod) error) error {
 	key, err := cache.MetaNamespaceKeyFunc(pod)
 	if err != nil {
 		return err
 	}
 
 	p.deletedPods.Store(key, pod)
-	if err := p.PodLifecycleHandler.DeletePod(ctx, pod.DeepCopy()); err != nil {
+	if err := deleteFn(ctx, pod.DeepCopy()); err != nil {
 		log.G(ctx).WithField("key", key).WithError(err).Debug("Removed key from deleted pods cache")
 		// We aren't going to actually delete the pod from the provider since there is an error so delete it from our cache,
 		// otherwise we could end up leaking pods in our deletion cache.
@@ -187,7 +203,16 @@ func (p *syncProviderWrapper) updatePodStatus(ctx context.Context, podFromKubern
 	// Only change the status when the pod was already up.
 	// Only doing so when the pod was successfully running makes sure we don't run into race conditions during pod creation.
 	// Set the pod to failed, this makes sure if the underlying container implementation is gone that a new pod will be created.
-	podStatus = podFromKubernetes.Status.DeepCopy()
+	log.G(ctx).Debug("Setting pod not found on pod status")
+	p.notify(podNotFound(podFromKubernetes))
+	return nil
+}
+
+// podNotFound returns a copy of the pod marked as failed because the provider no longer knows about it, with its
+// running containers marked as terminated.
+func podNotFound(pod *corev1.Pod) *corev1.Pod {
+	pod = pod.DeepCopy()
+	podStatus := &pod.Status
 	podStatus.Phase = corev1.PodFailed
 	podStatus.Reason = podStatusReasonNotFound
 	podStatus.Message = podStatusMessageNotFound
@@ -206,10 +231,5 @@ func (p *syncProviderWrapper) updatePodStatus(ctx context.Context, podFromKubern
 		}
 		podStatus.ContainerStatuses[i].State.Running = nil
 	}
-
-	log.G(ctx).Debug("Setting pod not found on pod status")
-	pod := podFromKubernetes.DeepCopy()
-	podStatus.DeepCopyInto(&pod.Status)
-	p.notify(pod)
-	return nil
+	return pod
 }
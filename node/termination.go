@@ -0,0 +1,208 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	podStatusReasonDeadlineExceeded  = "DeadlineExceeded"
+	podStatusMessageDeadlineExceeded = "Pod was active on the node longer than the specified deadline"
+	podEventFailedPreStopHook        = "FailedPreStopHook"
+
+	// defaultTerminationGracePeriod is the grace period of pods which do not specify one.
+	defaultTerminationGracePeriod = 30 * time.Second
+	// minimumGracePeriod is the minimum grace period given to the provider once the preStop hooks have run, so that
+	// containers get a chance to stop even if the hooks used up the pod's grace period. This is the same as the
+	// kubelet's.
+	minimumGracePeriod = 2 * time.Second
+)
+
+// activeDeadlineRemaining returns the time left before the pod exceeds its activeDeadlineSeconds, which is negative
+// once it has been exceeded. It returns false if the pod has no active deadline, or has not been started yet.
+// Based on pastActiveDeadline in pkg/kubelet/kubelet_pods.go.
+func activeDeadlineRemaining(pod *corev1.Pod, now time.Time) (time.Duration, bool) {
+	if pod.Spec.ActiveDeadlineSeconds == nil || pod.Status.StartTime == nil {
+		return 0, false
+	}
+	deadline := pod.Status.StartTime.Add(time.Duration(*pod.Spec.ActiveDeadlineSeconds) * time.Second)
+	return deadline.Sub(now), true
+}
+
+// terminationGracePeriod returns the grace period of the pod, which is the one it was deleted with if it is being
+// deleted.
+func terminationGracePeriod(pod *corev1.Pod) time.Duration {
+	switch {
+	case pod.DeletionGracePeriodSeconds != nil:
+		return time.Duration(*pod.DeletionGracePeriodSeconds) * time.Second
+	case pod.Spec.TerminationGracePeriodSeconds != nil:
+		return time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second
+	default:
+		return defaultTerminationGracePeriod
+	}
+}
+
+// terminatePod gracefully terminates the pod: the preStop hooks of its running containers are run, and the pod is
+// then deleted in the provider with what is left of its grace period.
+// The grace period starts the first time the pod is terminated, and is shortened if the pod is deleted again with a
+// shorter one.
+//
+// The hooks are run in the background, so that they do not hold up a worker for the whole grace period: hooksRunning
+// is set while they run, in which case the pod is not deleted yet, and the key is added back to k8sQ once they
+// complete. Otherwise, it returns when the pod must be killed if it is still running: once the grace period ends, but
+// not before the provider has been given minimumGracePeriod.
+func (pc *PodController) terminatePod(ctx context.Context, pod *corev1.Pod, key string, kPod *knownPod) (killAt time.Time, hooksRunning bool, _ error) {
+	ctx, span := trace.StartSpan(ctx, "terminatePod")
+	defer span.End()
+
+	gracePeriod := terminationGracePeriod(pod)
+	kPod.Lock()
+	if deadline := time.Now().Add(gracePeriod); kPod.terminationDeadline.IsZero() || deadline.Before(kPod.terminationDeadline) {
+		kPod.terminationDeadline = deadline
+	}
+	deadline := kPod.terminationDeadline
+	startHooks := !kPod.preStopHooksStarted && gracePeriod > 0 && len(preStopHookContainers(pod)) > 0
+	if startHooks {
+		kPod.preStopHooksStarted = true
+	}
+	// Hooks which were started are waited for, unless the pod was deleted again without a grace period.
+	hooksRunning = kPod.preStopHooksStarted && !kPod.preStopHooksRun && gracePeriod > 0
+	kPod.Unlock()
+
+	if startHooks {
+		go func() {
+			pc.runPreStopHooks(ctx, pod, deadline)
+			kPod.Lock()
+			kPod.preStopHooksRun = true
+			kPod.Unlock()
+			pc.k8sQ.Add(key)
+		}()
+	}
+	if hooksRunning {
+		return deadline, true, nil
+	}
+
+	remaining := time.Until(deadline)
+	if gracePeriod > 0 && remaining < minimumGracePeriod {
+		remaining = minimumGracePeriod
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	killAt = deadline
+	if t := time.Now().Add(remaining); t.After(killAt) {
+		killAt = t
+	}
+	err := pc.deletePod(ctx, pod, remaining.Round(time.Second))
+	span.SetStatus(err)
+	return killAt, false, err
+}
+
+// runPreStopHooks runs the preStop hooks of the pod's running containers concurrently, and waits for them to complete
+// until the deadline. Failing hooks do not prevent the pod from being terminated, but result in a warning event.
+// Only exec hooks are supported, which are run through the provider's RunInContainer method.
+func (pc *PodController) runPreStopHooks(ctx context.Context, pod *corev1.Pod, deadline time.Time) {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, c := range preStopHookContainers(pod) {
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger := log.G(ctx).WithField("container", c.Name)
+			logger.Debug("Running preStop hook")
+			if err := pc.runPreStopHook(ctx, pod, c); err != nil {
+				logger.WithError(err).Warn("PreStop hook failed")
+				pc.recorder.Eventf(pod, corev1.EventTypeWarning, podEventFailedPreStopHook, "PreStop hook of container %s failed: %v", c.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// preStopHookContainers returns the running containers of the pod which have a preStop hook.
+func preStopHookContainers(pod *corev1.Pod) []*corev1.Container {
+	var containers []*corev1.Container
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		if c.Lifecycle == nil || c.Lifecycle.PreStop == nil {
+			continue
+		}
+		if cs := findContainerStatus(&pod.Status, c.Name); cs == nil || cs.State.Running == nil {
+			continue
+		}
+		containers = append(containers, c)
+	}
+	return containers
+}
+
+func (pc *PodController) runPreStopHook(ctx context.Context, pod *corev1.Pod, container *corev1.Container) error {
+	exec := container.Lifecycle.PreStop.Exec
+	if exec == nil {
+		return errdefs.InvalidInput("only exec preStop hooks are supported")
+	}
+	if pc.runner == nil {
+		return pkgerrors.New("the provider does not support running commands in containers")
+	}
+	output := &probeOutput{}
+	if err := pc.runner.RunInContainer(ctx, pod.Namespace, pod.Name, container.Name, exec.Command, output); err != nil {
+		return pkgerrors.Wrapf(err, "command %v failed with output %q", exec.Command, output.String())
+	}
+	return nil
+}
+
+// failPodDeadlineExceeded terminates a pod which exceeded its active deadline, and marks it as failed.
+// The pod is deleted in the provider with the pod's termination grace period, which the provider is expected to
+// enforce, but it is kept in Kubernetes. While the preStop hooks run, the pod is left as is, and this is called again
+// once they complete.
+func (pc *PodController) failPodDeadlineExceeded(ctx context.Context, pod *corev1.Pod, key string, kPod *knownPod) error {
+	ctx, span := trace.StartSpan(ctx, "failPodDeadlineExceeded")
+	defer span.End()
+
+	log.G(ctx).Info("Pod exceeded its active deadline, stopping it")
+	pc.recorder.Event(pod, corev1.EventTypeWarning, podStatusReasonDeadlineExceeded, podStatusMessageDeadlineExceeded)
+
+	failed := pod.DeepCopy()
+	failed.Status.Phase = corev1.PodFailed
+	failed.Status.Reason = podStatusReasonDeadlineExceeded
+	failed.Status.Message = podStatusMessageDeadlineExceeded
+
+	// The pod is deleted in the provider before its status is updated, since failed pods are no longer synced.
+	_, hooksRunning, err := pc.terminatePod(ctx, failed, key, kPod)
+	if err != nil && !errdefs.IsNotFound(err) {
+		span.SetStatus(err)
+		return err
+	}
+	if hooksRunning {
+		return nil
+	}
+
+	if err := pc.patchPodStatus(ctx, pod, &failed.Status); err != nil {
+		span.SetStatus(err)
+		return pkgerrors.Wrap(err, "error while updating pod status in kubernetes")
+	}
+	return nil
+}
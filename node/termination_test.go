@@ -0,0 +1,191 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// mockGracefulProvider is a provider which records the grace periods it is given when deleting pods.
+type mockGracefulProvider struct {
+	*mockProviderAsync
+	gracePeriods []time.Duration
+}
+
+func (p *mockGracefulProvider) DeletePodWithGracePeriod(ctx context.Context, pod *corev1.Pod, gracePeriod time.Duration) error {
+	p.gracePeriods = append(p.gracePeriods, gracePeriod)
+	return p.DeletePod(ctx, pod)
+}
+
+// newGracefulTestController creates a pod controller whose provider records the grace periods it is given, and runs
+// the commands of the containers, such as preStop hooks, with runner.
+func newGracefulTestController(runner containerRunner) (*TestController, *mockGracefulProvider) {
+	var p *mockGracefulProvider
+	tc := newTestController(func(cfg *PodControllerConfig, mock *mockProviderAsync) {
+		p = &mockGracefulProvider{mockProviderAsync: mock}
+		cfg.Provider = struct {
+			*mockGracefulProvider
+			containerRunner
+		}{p, runner}
+	})
+	return tc, p
+}
+
+func newRunningPod() *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+		Spec:       newPodSpec(),
+	}
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{Name: "nginx", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+	}
+	return pod
+}
+
+func TestActiveDeadlineRemaining(t *testing.T) {
+	now := time.Now()
+	pod := newRunningPod()
+
+	_, ok := activeDeadlineRemaining(pod, now)
+	assert.Check(t, !ok)
+
+	deadline := int64(60)
+	pod.Spec.ActiveDeadlineSeconds = &deadline
+	_, ok = activeDeadlineRemaining(pod, now)
+	assert.Check(t, !ok, "pods which have not started yet have no deadline")
+
+	startTime := metav1.NewTime(now.Add(-time.Minute - time.Second))
+	pod.Status.StartTime = &startTime
+	remaining, ok := activeDeadlineRemaining(pod, now)
+	assert.Check(t, ok)
+	assert.Check(t, is.Equal(remaining, -time.Second))
+}
+
+func TestPodFailedWhenActiveDeadlineExceeded(t *testing.T) {
+	tc := newTestController()
+	ctx := context.Background()
+	key := "default/nginx"
+
+	pod := newRunningPod()
+	deadline := int64(10)
+	pod.Spec.ActiveDeadlineSeconds = &deadline
+	startTime := metav1.NewTime(time.Now().Add(-time.Minute))
+	pod.Status.StartTime = &startTime
+
+	_, err := tc.client.CoreV1().Pods(pod.Namespace).Create(pod)
+	assert.NilError(t, err)
+	assert.NilError(t, tc.mock.CreatePod(ctx, pod.DeepCopy()))
+	tc.knownPods.Store(key, &knownPod{})
+
+	assert.NilError(t, tc.syncPodInProvider(ctx, pod, key))
+	assert.Check(t, is.Equal(tc.mock.deletes.read(), 1))
+
+	updated, err := tc.client.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(updated.Status.Phase, corev1.PodFailed))
+	assert.Check(t, is.Equal(updated.Status.Reason, podStatusReasonDeadlineExceeded))
+}
+
+func TestGracefulTermination(t *testing.T) {
+	runner := &mockContainerRunner{}
+	tc, p := newGracefulTestController(runner)
+	ctx := context.Background()
+	key := "default/nginx"
+
+	pod := newRunningPod()
+	pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{
+		PreStop: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"nginx", "-s", "quit"}}},
+	}
+	assert.NilError(t, tc.mock.CreatePod(ctx, pod.DeepCopy()))
+	tc.knownPods.Store(key, &knownPod{})
+
+	now := metav1.Now()
+	gracePeriod := int64(30)
+	pod.DeletionTimestamp = &now
+	pod.DeletionGracePeriodSeconds = &gracePeriod
+
+	// The hooks are run in the background, and the pod is synced again once they complete.
+	assert.NilError(t, tc.syncPodInProvider(ctx, pod, key))
+	assert.Check(t, is.Len(p.gracePeriods, 0), "the pod must not be deleted before its preStop hooks complete")
+	waitForQueuedKey(t, tc.k8sQ, key)
+	assert.Check(t, is.DeepEqual(runner.cmds, [][]string{{"nginx", "-s", "quit"}}))
+
+	assert.NilError(t, tc.syncPodInProvider(ctx, pod, key))
+	assert.Assert(t, is.Len(p.gracePeriods, 1))
+	assert.Check(t, is.Equal(p.gracePeriods[0], 30*time.Second))
+	// The pod is only force deleted once the grace period ends.
+	assert.Check(t, is.Equal(tc.deletionQ.Len(), 0))
+
+	// Deleting the pod again with a shorter grace period shortens it, but does not run the hooks again.
+	gracePeriod = 0
+	pod = pod.DeepCopy()
+	pod.DeletionGracePeriodSeconds = &gracePeriod
+	err := tc.syncPodInProvider(ctx, pod, key)
+	assert.Check(t, err)
+	assert.Check(t, is.Len(runner.cmds, 1))
+	assert.Assert(t, is.Len(p.gracePeriods, 2))
+	assert.Check(t, is.Equal(p.gracePeriods[1], time.Duration(0)))
+}
+
+// waitForQueuedKey waits for the key to be added to the queue, and marks it as done.
+func waitForQueuedKey(t *testing.T, q workqueue.RateLimitingInterface, key string) {
+	t.Helper()
+	got := make(chan interface{}, 1)
+	go func() {
+		item, _ := q.Get()
+		got <- item
+	}()
+	select {
+	case item := <-got:
+		assert.Check(t, is.Equal(item, key))
+		q.Done(item)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s was not added to the queue", key)
+	}
+}
+
+// blockingContainerRunner is a container runner whose commands run until their context is done.
+type blockingContainerRunner struct{}
+
+func (blockingContainerRunner) RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach api.AttachIO) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestGracefulTerminationKillsAfterMinimumGracePeriod(t *testing.T) {
+	tc, p := newGracefulTestController(blockingContainerRunner{})
+	ctx := context.Background()
+	key := "default/nginx"
+
+	pod := newRunningPod()
+	pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{
+		PreStop: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"sleep", "infinity"}}},
+	}
+	assert.NilError(t, tc.mock.CreatePod(ctx, pod.DeepCopy()))
+	tc.knownPods.Store(key, &knownPod{})
+
+	now := metav1.Now()
+	gracePeriod := int64(1)
+	pod.DeletionTimestamp = &now
+	pod.DeletionGracePeriodSeconds = &gracePeriod
+
+	// The hook uses up the whole grace period, without holding up the worker.
+	start := time.Now()
+	assert.NilError(t, tc.syncPodInProvider(ctx, pod, key))
+	assert.Check(t, time.Since(start) < time.Second)
+	waitForQueuedKey(t, tc.k8sQ, key)
+
+	assert.NilError(t, tc.syncPodInProvider(ctx, pod, key))
+	assert.Assert(t, is.Len(p.gracePeriods, 1))
+	assert.Check(t, is.Equal(p.gracePeriods[0], minimumGracePeriod))
+	// The pod must not be killed before the provider had the minimum grace period to stop it.
+	assert.Check(t, is.Equal(tc.deletionQ.Len(), 0))
+}
@@ -0,0 +1,269 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"fmt"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/internal/manager"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+)
+
+// VolumeFile is a file within one of a pod's volumes, whose content has been resolved by the pod controller.
+type VolumeFile struct {
+	// Key is the key of the configmap or secret the file was projected from.
+	// It is empty for files projected from the downward API.
+	Key string
+	// Path is the path of the file, relative to the root of the volume.
+	Path string
+	// Data is the content of the file.
+	Data []byte
+	// Mode is the file's permission bits.
+	Mode int32
+}
+
+// PodVolumes maps the names of a pod's volumes to the files they contain.
+// Only the volumes resolved by the pod controller are present, which are configmap, secret, projected and downward
+// API volumes. A volume whose (optional) sources could not be found is present, but contains no files.
+type PodVolumes map[string][]VolumeFile
+
+// volumeResolver resolves the contents of the volumes of a pod.
+type volumeResolver struct {
+	pod      *corev1.Pod
+	node     *corev1.Node
+	podIPs   []string
+	rm       *manager.ResourceManager
+	recorder record.EventRecorder
+}
+
+// resolveVolumes resolves the contents of the pod's configmap, secret, projected and downward API volumes.
+// node and podIPs are used as for environment variables, see populateEnvironmentVariables.
+// Missing optional sources and keys result in a warning event, while missing mandatory ones result in a warning event
+// and an error, the same as for environment variables.
+func resolveVolumes(ctx context.Context, pod *corev1.Pod, node *corev1.Node, podIPs []string, rm *manager.ResourceManager, recorder record.EventRecorder) (PodVolumes, error) {
+	r := &volumeResolver{pod: pod, node: node, podIPs: podIPs, rm: rm, recorder: recorder}
+
+	volumes := make(PodVolumes)
+	for _, v := range pod.Spec.Volumes {
+		var (
+			files []VolumeFile
+			err   error
+		)
+		switch {
+		case v.ConfigMap != nil:
+			mode := defaultMode(v.ConfigMap.DefaultMode, corev1.ConfigMapVolumeSourceDefaultMode)
+			files, err = r.configMapFiles(ctx, v.ConfigMap.Name, v.ConfigMap.Items, v.ConfigMap.Optional, mode)
+		case v.Secret != nil:
+			mode := defaultMode(v.Secret.DefaultMode, corev1.SecretVolumeSourceDefaultMode)
+			files, err = r.secretFiles(ctx, v.Secret.SecretName, v.Secret.Items, v.Secret.Optional, mode)
+		case v.Projected != nil:
+			files, err = r.projectedFiles(ctx, v.Projected)
+		case v.DownwardAPI != nil:
+			mode := defaultMode(v.DownwardAPI.DefaultMode, corev1.DownwardAPIVolumeSourceDefaultMode)
+			files, err = r.downwardAPIFiles(v.DownwardAPI.Items, mode)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, pkgerrors.Wrapf(err, "error resolving volume %q", v.Name)
+		}
+		volumes[v.Name] = files
+	}
+	return volumes, nil
+}
+
+func defaultMode(mode *int32, def int32) int32 {
+	if mode != nil {
+		return *mode
+	}
+	return def
+}
+
+// projectedFiles returns the files of a projected volume.
+// Service account token projections are not resolved, and are left to the provider.
+// Based on collectData in pkg/volume/projected/projected.go.
+func (r *volumeResolver) projectedFiles(ctx context.Context, source *corev1.ProjectedVolumeSource) ([]VolumeFile, error) {
+	mode := defaultMode(source.DefaultMode, corev1.ProjectedVolumeSourceDefaultMode)
+
+	var files []VolumeFile
+	for _, s := range source.Sources {
+		var (
+			projected []VolumeFile
+			err       error
+		)
+		switch {
+		case s.ConfigMap != nil:
+			projected, err = r.configMapFiles(ctx, s.ConfigMap.Name, s.ConfigMap.Items, s.ConfigMap.Optional, mode)
+		case s.Secret != nil:
+			projected, err = r.secretFiles(ctx, s.Secret.Name, s.Secret.Items, s.Secret.Optional, mode)
+		case s.DownwardAPI != nil:
+			projected, err = r.downwardAPIFiles(s.DownwardAPI.Items, mode)
+		case s.ServiceAccountToken != nil:
+			log.G(ctx).WithField("path", s.ServiceAccountToken.Path).Debug("Skipping service account token projection")
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, projected...)
+	}
+	return files, nil
+}
+
+// configMapFiles returns the files projected from the configmap with the given name.
+// Based on MakePayload in pkg/volume/configmap/configmap.go.
+func (r *volumeResolver) configMapFiles(ctx context.Context, name string, items []corev1.KeyToPath, optionalRef *bool, mode int32) ([]VolumeFile, error) {
+	// Check whether the configmap reference is optional.
+	// This will control whether we fail when unable to read the configmap.
+	optional := optionalRef != nil && *optionalRef
+	// Try to grab the referenced configmap.
+	m, err := r.rm.GetConfigMap(name, r.pod.Namespace)
+	if err != nil {
+		// We couldn't fetch the configmap.
+		// However, if the configmap reference is optional we should not fail.
+		if optional {
+			if errors.IsNotFound(err) {
+				r.recorder.Eventf(r.pod, corev1.EventTypeWarning, ReasonOptionalConfigMapNotFound, "configmap %q not found", name)
+			} else {
+				log.G(ctx).Warnf("failed to read configmap %q: %v", name, err)
+				r.recorder.Eventf(r.pod, corev1.EventTypeWarning, ReasonFailedToReadOptionalConfigMap, "failed to read configmap %q", name)
+			}
+			return nil, nil
+		}
+		// At this point we know the configmap reference is mandatory.
+		// Hence, we should return a meaningful error.
+		if errors.IsNotFound(err) {
+			r.recorder.Eventf(r.pod, corev1.EventTypeWarning, ReasonMandatoryConfigMapNotFound, "configmap %q not found", name)
+			return nil, fmt.Errorf("configmap %q not found", name)
+		}
+		r.recorder.Eventf(r.pod, corev1.EventTypeWarning, ReasonFailedToReadMandatoryConfigMap, "failed to read configmap %q", name)
+		return nil, fmt.Errorf("failed to fetch configmap %q: %v", name, err)
+	}
+
+	data := make(map[string][]byte, len(m.Data)+len(m.BinaryData))
+	for key, val := range m.Data {
+		data[key] = []byte(val)
+	}
+	for key, val := range m.BinaryData {
+		data[key] = val
+	}
+
+	files, missingKey := keyFiles(data, items, optional, mode)
+	if missingKey != "" {
+		r.recorder.Eventf(r.pod, corev1.EventTypeWarning, ReasonMandatoryConfigMapKeyNotFound, "key %q does not exist in configmap %q", missingKey, name)
+		return nil, fmt.Errorf("configmap %q doesn't contain the %q key required by pod %s", name, missingKey, r.pod.Name)
+	}
+	return files, nil
+}
+
+// secretFiles returns the files projected from the secret with the given name.
+// Based on MakePayload in pkg/volume/secret/secret.go.
+func (r *volumeResolver) secretFiles(ctx context.Context, name string, items []corev1.KeyToPath, optionalRef *bool, mode int32) ([]VolumeFile, error) {
+	// Check whether the secret reference is optional.
+	// This will control whether we fail when unable to read the secret.
+	optional := optionalRef != nil && *optionalRef
+	// Try to grab the referenced secret.
+	s, err := r.rm.GetSecret(name, r.pod.Namespace)
+	if err != nil {
+		// We couldn't fetch the secret.
+		// However, if the secret reference is optional we should not fail.
+		if optional {
+			if errors.IsNotFound(err) {
+				r.recorder.Eventf(r.pod, corev1.EventTypeWarning, ReasonOptionalSecretNotFound, "secret %q not found", name)
+			} else {
+				log.G(ctx).Warnf("failed to read secret %q: %v", name, err)
+				r.recorder.Eventf(r.pod, corev1.EventTypeWarning, ReasonFailedToReadOptionalSecret, "failed to read secret %q", name)
+			}
+			return nil, nil
+		}
+		// At this point we know the secret reference is mandatory.
+		// Hence, we should return a meaningful error.
+		if errors.IsNotFound(err) {
+			r.recorder.Eventf(r.pod, corev1.EventTypeWarning, ReasonMandatorySecretNotFound, "secret %q not found", name)
+			return nil, fmt.Errorf("secret %q not found", name)
+		}
+		r.recorder.Eventf(r.pod, corev1.EventTypeWarning, ReasonFailedToReadMandatorySecret, "failed to read secret %q", name)
+		return nil, fmt.Errorf("failed to fetch secret %q: %v", name, err)
+	}
+
+	files, missingKey := keyFiles(s.Data, items, optional, mode)
+	if missingKey != "" {
+		r.recorder.Eventf(r.pod, corev1.EventTypeWarning, ReasonMandatorySecretKeyNotFound, "key %q does not exist in secret %q", missingKey, name)
+		return nil, fmt.Errorf("secret %q doesn't contain the %q key required by pod %s", name, missingKey, r.pod.Name)
+	}
+	return files, nil
+}
+
+// keyFiles returns the files projected from the keys of a configmap or secret.
+// If no items are specified, every key is projected to a file of the same name, in the order of the keys.
+// Otherwise, only the keys of the specified items are projected. Items referencing a key that does not exist are
+// skipped if the source is optional, or else the name of the missing key is returned.
+func keyFiles(data map[string][]byte, items []corev1.KeyToPath, optional bool, mode int32) ([]VolumeFile, string) {
+	if len(items) == 0 {
+		files := make([]VolumeFile, 0, len(data))
+		for _, key := range sets.StringKeySet(data).List() {
+			files = append(files, VolumeFile{Key: key, Path: key, Data: data[key], Mode: mode})
+		}
+		return files, ""
+	}
+
+	files := make([]VolumeFile, 0, len(items))
+	for _, item := range items {
+		val, ok := data[item.Key]
+		if !ok {
+			if optional {
+				continue
+			}
+			return nil, item.Key
+		}
+		files = append(files, VolumeFile{Key: item.Key, Path: item.Path, Data: val, Mode: defaultMode(item.Mode, mode)})
+	}
+	return files, ""
+}
+
+// downwardAPIFiles returns the files projected from the downward API by the given items.
+// Based on CollectData in pkg/volume/downwardapi/downwardapi.go.
+func (r *volumeResolver) downwardAPIFiles(items []corev1.DownwardAPIVolumeFile, mode int32) ([]VolumeFile, error) {
+	files := make([]VolumeFile, 0, len(items))
+	for _, item := range items {
+		var (
+			value string
+			err   error
+		)
+		switch {
+		case item.FieldRef != nil:
+			value, err = podFieldSelectorRuntimeValue(item.FieldRef, r.pod, r.podIPs)
+		case item.ResourceFieldRef != nil:
+			// Unlike environment variables, volumes do not belong to a container, so the container must be specified.
+			if item.ResourceFieldRef.ContainerName == "" {
+				return nil, fmt.Errorf("resourceFieldRef of file %q does not specify a container name", item.Path)
+			}
+			value, err = containerResourceRuntimeValue(item.ResourceFieldRef, r.pod, nil, r.node)
+		default:
+			return nil, fmt.Errorf("file %q does not reference any field or resource", item.Path)
+		}
+		if err != nil {
+			return nil, pkgerrors.Wrapf(err, "error resolving file %q", item.Path)
+		}
+
+		files = append(files, VolumeFile{Path: item.Path, Data: []byte(value), Mode: defaultMode(item.Mode, mode)})
+	}
+	return files, nil
+}
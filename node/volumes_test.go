@@ -0,0 +1,231 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	testutil "github.com/virtual-kubelet/virtual-kubelet/internal/test/util"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResolveDownwardAPIVolumes(t *testing.T) {
+	fileMode := int32(0440)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "nginx",
+			Labels:    map[string]string{"app": "nginx", "tier": "web"},
+		},
+		Spec: newPodSpec(),
+	}
+	pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")}
+	pod.Spec.Volumes = []corev1.Volume{
+		{
+			Name:         "empty",
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		},
+		{
+			Name: "podinfo",
+			VolumeSource: corev1.VolumeSource{DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				DefaultMode: &fileMode,
+				Items: []corev1.DownwardAPIVolumeFile{
+					{Path: "labels", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels"}},
+					{Path: "mem_limit", ResourceFieldRef: &corev1.ResourceFieldSelector{ContainerName: "nginx", Resource: "limits.memory", Divisor: resource.MustParse("1Mi")}},
+				},
+			}},
+		},
+	}
+
+	volumes, err := resolveVolumes(context.Background(), pod, nil, nil, testutil.FakeResourceManager(), testutil.FakeEventRecorder(defaultEventRecorderBufferSize))
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(volumes, PodVolumes{
+		"podinfo": {
+			{Path: "labels", Data: []byte("app=\"nginx\"\ntier=\"web\""), Mode: fileMode},
+			{Path: "mem_limit", Data: []byte("128"), Mode: fileMode},
+		},
+	}))
+}
+
+func TestResolveDownwardAPIVolumesRequiresContainerName(t *testing.T) {
+	pod := &corev1.Pod{Spec: newPodSpec()}
+	pod.Spec.Volumes = []corev1.Volume{
+		{
+			Name: "podinfo",
+			VolumeSource: corev1.VolumeSource{DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{
+					{Path: "cpu_limit", ResourceFieldRef: &corev1.ResourceFieldSelector{Resource: "limits.cpu"}},
+				},
+			}},
+		},
+	}
+
+	_, err := resolveVolumes(context.Background(), pod, nil, nil, testutil.FakeResourceManager(), testutil.FakeEventRecorder(defaultEventRecorderBufferSize))
+	assert.Check(t, is.ErrorContains(err, "does not specify a container name"))
+}
+
+func TestResolveConfigMapSecretAndProjectedVolumes(t *testing.T) {
+	rm := testutil.FakeResourceManager(
+		testutil.FakeConfigMap("default", "config", map[string]string{"b.conf": "b", "a.conf": "a"}),
+		testutil.FakeSecret("default", "credentials", map[string]string{"password": "hunter2", "username": "admin"}),
+	)
+	er := testutil.FakeEventRecorder(defaultEventRecorderBufferSize)
+
+	secretMode := int32(0400)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+		Spec:       newPodSpec(),
+	}
+	pod.Spec.Volumes = []corev1.Volume{
+		{
+			Name:         "config",
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "config"}}},
+		},
+		{
+			Name: "credentials",
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+				SecretName:  "credentials",
+				DefaultMode: &secretMode,
+				Items: []corev1.KeyToPath{
+					{Key: "password", Path: "secret/password"},
+					{Key: "missing", Path: "missing"},
+				},
+				Optional: &bTrue,
+			}},
+		},
+		{
+			Name: "optional",
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "missing"},
+				Optional:             &bTrue,
+			}},
+		},
+		{
+			Name: "projected",
+			VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{ConfigMap: &corev1.ConfigMapProjection{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "config"},
+						Items:                []corev1.KeyToPath{{Key: "a.conf", Path: "a.conf"}},
+					}},
+					{Secret: &corev1.SecretProjection{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "credentials"},
+						Items:                []corev1.KeyToPath{{Key: "username", Path: "username", Mode: &secretMode}},
+					}},
+					{DownwardAPI: &corev1.DownwardAPIProjection{
+						Items: []corev1.DownwardAPIVolumeFile{{Path: "name", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+					}},
+				},
+			}},
+		},
+	}
+
+	volumes, err := resolveVolumes(context.Background(), pod, nil, nil, rm, er)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(volumes, PodVolumes{
+		"config": {
+			{Key: "a.conf", Path: "a.conf", Data: []byte("a"), Mode: corev1.ConfigMapVolumeSourceDefaultMode},
+			{Key: "b.conf", Path: "b.conf", Data: []byte("b"), Mode: corev1.ConfigMapVolumeSourceDefaultMode},
+		},
+		"credentials": {
+			{Key: "password", Path: "secret/password", Data: []byte("hunter2"), Mode: secretMode},
+		},
+		"optional": nil,
+		"projected": {
+			{Key: "a.conf", Path: "a.conf", Data: []byte("a"), Mode: corev1.ProjectedVolumeSourceDefaultMode},
+			{Key: "username", Path: "username", Data: []byte("admin"), Mode: secretMode},
+			{Path: "name", Data: []byte("nginx"), Mode: corev1.ProjectedVolumeSourceDefaultMode},
+		},
+	}))
+
+	// Make sure that an event has been recorded for the missing optional configmap.
+	assert.Check(t, is.Len(er.Events, 1))
+	event := <-er.Events
+	assert.Check(t, is.Contains(event, ReasonOptionalConfigMapNotFound))
+}
+
+func TestResolveVolumesMissingMandatorySources(t *testing.T) {
+	rm := testutil.FakeResourceManager(testutil.FakeSecret("default", "credentials", map[string]string{"username": "admin"}))
+
+	testCases := []struct {
+		name   string
+		source corev1.VolumeSource
+		reason string
+	}{
+		{
+			name:   "configmap not found",
+			source: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}}},
+			reason: ReasonMandatoryConfigMapNotFound,
+		},
+		{
+			name:   "secret not found",
+			source: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "missing"}},
+			reason: ReasonMandatorySecretNotFound,
+		},
+		{
+			name: "secret key not found",
+			source: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{
+				{Secret: &corev1.SecretProjection{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "credentials"},
+					Items:                []corev1.KeyToPath{{Key: "password", Path: "password"}},
+				}},
+			}}},
+			reason: ReasonMandatorySecretKeyNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			er := testutil.FakeEventRecorder(defaultEventRecorderBufferSize)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+				Spec:       newPodSpec(),
+			}
+			pod.Spec.Volumes = []corev1.Volume{{Name: "volume", VolumeSource: tc.source}}
+
+			_, err := resolveVolumes(context.Background(), pod, nil, nil, rm, er)
+			assert.Check(t, is.ErrorContains(err, `error resolving volume "volume"`))
+			assert.Assert(t, is.Len(er.Events, 1))
+			event := <-er.Events
+			assert.Check(t, is.Contains(event, tc.reason))
+		})
+	}
+}
+
+func TestPodUpdatedWhenVolumesChange(t *testing.T) {
+	var p *mockIPAllocatorProvider
+	tc := newTestController(func(cfg *PodControllerConfig, mock *mockProviderAsync) {
+		p = &mockIPAllocatorProvider{mockProviderAsync: mock}
+		cfg.Provider = p
+	})
+	tc.resourceManager = testutil.FakeResourceManager(testutil.FakeConfigMap("default", "config", map[string]string{"app.conf": "v1"}))
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+		Spec:       newPodSpec(),
+	}
+	pod.Spec.Volumes = []corev1.Volume{
+		{
+			Name:         "config",
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "config"}}},
+		},
+	}
+	tc.knownPods.Store("default/nginx", &knownPod{})
+
+	assert.NilError(t, tc.createOrUpdatePod(context.Background(), pod.DeepCopy()))
+	assert.Check(t, is.Equal(tc.mock.creates.read(), 1))
+	assert.Check(t, is.DeepEqual(p.volumes["config"][0].Data, []byte("v1")))
+
+	// Nothing changed, so the pod must not be updated.
+	assert.NilError(t, tc.createOrUpdatePod(context.Background(), pod.DeepCopy()))
+	assert.Check(t, is.Equal(tc.mock.updates.read(), 0))
+
+	// The pod must be updated when the configmap changes, even though the pod itself did not.
+	tc.resourceManager = testutil.FakeResourceManager(testutil.FakeConfigMap("default", "config", map[string]string{"app.conf": "v2"}))
+	assert.NilError(t, tc.createOrUpdatePod(context.Background(), pod.DeepCopy()))
+	assert.Check(t, is.Equal(tc.mock.updates.read(), 1))
+	assert.Check(t, is.DeepEqual(p.volumes["config"][0].Data, []byte("v2")))
+}